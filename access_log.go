@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// AccessRecord is the structured access log entry written for each request.
+type AccessRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	LatencyMS  float64   `json:"latency_ms"`
+	Principal  string    `json:"principal,omitempty"`
+	Decision   string    `json:"decision,omitempty"`
+	NodeID     string    `json:"node_id,omitempty"`
+	JobID      string    `json:"job_id,omitempty"`
+	TaskID     string    `json:"task_id,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// AuditRecord is written to the audit log for every authorized access to non-public data.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Principal  string    `json:"principal"`
+	Decision   string    `json:"decision"`
+	Method     string    `json:"method"`
+	NodeID     string    `json:"node_id"`
+	JobID      string    `json:"job_id"`
+	TaskID     string    `json:"task_id"`
+	Filename   string    `json:"filename"`
+}
+
+// requestLogInfo is filled in by handlers as a request is served and included in its access
+// log entry.
+type requestLogInfo struct {
+	RequestID string
+	Principal string
+	Decision  string
+	File      *StorageFile
+}
+
+type requestLogInfoKey struct{}
+
+// requestLogInfoFromContext returns the log info for the request. It returns a detached
+// value if the request is not being logged, so callers never need to check for nil.
+func requestLogInfoFromContext(ctx context.Context) *requestLogInfo {
+	if info, ok := ctx.Value(requestLogInfoKey{}).(*requestLogInfo); ok {
+		return info
+	}
+	return &requestLogInfo{}
+}
+
+// requestID returns the ID of the request being served or an empty string.
+func requestID(ctx context.Context) string {
+	return requestLogInfoFromContext(ctx).RequestID
+}
+
+var requestIDRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// AccessLogger assigns each request an ID and writes a structured access log entry for it.
+// An incoming X-Request-ID header is reused if well formed so requests can be traced across
+// proxies. The ID is returned in the X-Request-ID response header.
+type AccessLogger struct {
+	Handler http.Handler
+	// Logger is optional. Request IDs are still assigned if it is nil.
+	Logger *JSONLogger
+	// AnonymizeIP truncates remote addresses before they are logged.
+	AnonymizeIP       bool
+	TrustForwardedFor bool
+}
+
+func (l *AccessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	id := r.Header.Get("X-Request-ID")
+	if !requestIDRE.MatchString(id) {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", id)
+
+	info := &requestLogInfo{RequestID: id}
+	r = r.WithContext(context.WithValue(r.Context(), requestLogInfoKey{}, info))
+
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	l.Handler.ServeHTTP(lw, r)
+
+	if l.Logger == nil {
+		return
+	}
+
+	record := &AccessRecord{
+		Time:       start.UTC(),
+		RequestID:  id,
+		RemoteAddr: l.remoteAddr(r),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     lw.status,
+		Bytes:      lw.bytes,
+		LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+		Principal:  info.Principal,
+		Decision:   info.Decision,
+		UserAgent:  r.UserAgent(),
+	}
+	if info.File != nil {
+		record.NodeID = info.File.NodeID
+		record.JobID = info.File.JobID
+		record.TaskID = info.File.TaskID
+	}
+	l.Logger.Log(record)
+}
+
+func (l *AccessLogger) remoteAddr(r *http.Request) string {
+	ip := clientIP(r, l.TrustForwardedFor)
+	if l.AnonymizeIP {
+		return anonymizeIP(ip)
+	}
+	return ip
+}
+
+// anonymizeIP zeroes the last octet of an IPv4 address or the last 80 bits of an IPv6 address.
+func anonymizeIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggingResponseWriter records the status code and number of bytes written.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *loggingResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.status = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// AuditLogger writes an AuditRecord for every authorized access to non-public data.
+type AuditLogger struct {
+	Logger            *JSONLogger
+	AnonymizeIP       bool
+	TrustForwardedFor bool
+}
+
+// Record writes an audit record for principal accessing f.
+func (l *AuditLogger) Record(r *http.Request, f *StorageFile, principal, decision string) {
+	remoteAddr := clientIP(r, l.TrustForwardedFor)
+	if l.AnonymizeIP {
+		remoteAddr = anonymizeIP(remoteAddr)
+	}
+	l.Logger.Log(&AuditRecord{
+		Time:       time.Now().UTC(),
+		RequestID:  requestID(r.Context()),
+		RemoteAddr: remoteAddr,
+		Principal:  principal,
+		Decision:   decision,
+		Method:     r.Method,
+		NodeID:     f.NodeID,
+		JobID:      f.JobID,
+		TaskID:     f.TaskID,
+		Filename:   f.Filename,
+	})
+}
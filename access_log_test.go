@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	handler := &AccessLogger{
+		Handler: newTestAuditStorageHandler(nil),
+		Logger:  NewJSONLogger(&buf),
+	}
+
+	r := httptest.NewRequest("GET", "/sage/imagesampler-top/privatenode/1638576647406523064-sample.jpg", nil)
+	r.RemoteAddr = "192.168.1.23:4567"
+	r.Header.Set("X-Request-ID", "abc-123")
+	r.SetBasicAuth("user", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assertStatusCode(t, w.Result(), http.StatusTemporaryRedirect)
+
+	if id := w.Header().Get("X-Request-ID"); id != "abc-123" {
+		t.Fatalf("expected request id to be reused. got: %q", id)
+	}
+
+	var record AccessRecord
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to decode access log: %s", err)
+	}
+
+	if record.RequestID != "abc-123" ||
+		record.Status != http.StatusTemporaryRedirect ||
+		record.Principal != "user" ||
+		record.Decision != "credential" ||
+		record.NodeID != "privatenode" ||
+		record.JobID != "sage" ||
+		record.TaskID != "imagesampler-top" ||
+		record.RemoteAddr != "192.168.1.23" {
+		t.Fatalf("incorrect access log record: %+v", record)
+	}
+}
+
+func TestAccessLoggerRequestID(t *testing.T) {
+	handler := &AccessLogger{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(requestID(r.Context())))
+		}),
+	}
+
+	for _, header := range []string{"", "has spaces", string(make([]byte, 100))} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("X-Request-ID", header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get("X-Request-ID")
+		if id == "" || id == header {
+			t.Fatalf("expected new request id for header %q. got: %q", header, id)
+		}
+		if w.Body.String() != id {
+			t.Fatalf("request id in context does not match header. got: %q want: %q", w.Body.String(), id)
+		}
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	testcases := map[string]string{
+		"192.168.1.23":            "192.168.1.0",
+		"2001:db8:85a3:1:2:3:4:5": "2001:db8:85a3::",
+		"not-an-ip":               "",
+	}
+	for ip, want := range testcases {
+		if got := anonymizeIP(ip); got != want {
+			t.Errorf("anonymizeIP(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	testcases := map[string]struct {
+		URL     string
+		Auth    bool
+		Status  int
+		Audited bool
+	}{
+		"PrivateWithCredentials": {
+			URL:     "sage/imagesampler-top/privatenode/1638576647406523064-sample.jpg",
+			Auth:    true,
+			Status:  http.StatusTemporaryRedirect,
+			Audited: true,
+		},
+		"PrivateWithoutCredentials": {
+			URL:    "sage/imagesampler-top/privatenode/1638576647406523064-sample.jpg",
+			Status: http.StatusUnauthorized,
+		},
+		"PublicWithCredentials": {
+			URL:    "sage/imagesampler-top/publicnode/1638576647406523064-sample.jpg",
+			Auth:   true,
+			Status: http.StatusTemporaryRedirect,
+		},
+		"Public": {
+			URL:    "sage/imagesampler-top/publicnode/1638576647406523064-sample.jpg",
+			Status: http.StatusTemporaryRedirect,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			handler := newTestAuditStorageHandler(&AuditLogger{
+				Logger:      NewJSONLogger(&buf),
+				AnonymizeIP: true,
+			})
+
+			r := httptest.NewRequest("GET", "/"+tc.URL, nil)
+			r.RemoteAddr = "192.168.1.23:4567"
+			if tc.Auth {
+				r.SetBasicAuth("user", "secret")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assertStatusCode(t, w.Result(), tc.Status)
+
+			if !tc.Audited {
+				if buf.Len() != 0 {
+					t.Fatalf("expected no audit record. got: %s", buf.String())
+				}
+				return
+			}
+
+			var record AuditRecord
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("failed to decode audit log: %s", err)
+			}
+			if record.Principal != "user" || record.Decision != "credential" || record.NodeID != "privatenode" ||
+				record.Filename != "1638576647406523064-sample.jpg" || record.RemoteAddr != "192.168.1.0" {
+				t.Fatalf("incorrect audit record: %+v", record)
+			}
+		})
+	}
+}
+
+func newTestAuditStorageHandler(audit *AuditLogger) http.Handler {
+	commissionDate := time.Now().AddDate(-5, 0, 0)
+
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Credentials: []*Credential{
+			{Username: "user", Password: "secret"},
+		},
+		Nodes: map[string]*TableAuthenticatorNode{
+			"publicnode":  {Public: true, CommissionDate: &commissionDate},
+			"privatenode": {Public: false, CommissionDate: &commissionDate},
+		},
+	})
+
+	handler := &StorageHandler{
+		Storage: &mockStorage{
+			files: map[string][]byte{
+				"node-data/sage/imagesampler-top/publicnode/1638576647406523064-sample.jpg":  randomContent(),
+				"node-data/sage/imagesampler-top/privatenode/1638576647406523064-sample.jpg": randomContent(),
+			},
+		},
+		RootFolder:    "node-data",
+		Authenticator: auth,
+		Audit:         audit,
+	}
+
+	return http.StripPrefix("/", handler)
+}
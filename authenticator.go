@@ -1,5 +1,10 @@
 package main
 
+import (
+	"context"
+	"time"
+)
+
 // Authenticator defines the Authorized method which can be used to implement whether
 // or not a user has access a specific file.
 //
@@ -9,3 +14,23 @@ package main
 type Authenticator interface {
 	Authorized(f *StorageFile, username, password string, hasAuth bool) bool
 }
+
+// EmbargoReporter is optionally implemented by an Authenticator which can report when
+// a file which is currently private becomes public.
+type EmbargoReporter interface {
+	PublicAfter(f *StorageFile) (time.Time, bool)
+}
+
+// CredentialChecker is optionally implemented by an Authenticator which can check whether
+// credentials are valid independent of any file.
+type CredentialChecker interface {
+	Authenticated(username, password string) bool
+}
+
+// TokenAuthenticator is optionally implemented by an Authenticator which can authorize
+// bearer tokens locally. ValidateToken returns an error if the token itself is invalid and
+// otherwise a func reporting whether the token grants access to a file, so requests covering
+// many files only validate the token once.
+type TokenAuthenticator interface {
+	ValidateToken(ctx context.Context, token string) (func(f *StorageFile) bool, error)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//go:embed templates/browse.html
+var browseTemplateText string
+
+var browseTemplate = template.Must(template.New("browse").Parse(browseTemplateText))
+
+const browsePageSize = 100
+
+// maxBrowseThumbnails limits the thumbnails on a page. Each thumbnail is a full download from the
+// data endpoint, so this is kept below the default anonymous rate limit burst.
+const maxBrowseThumbnails = 10
+
+// maxBrowseScan bounds the objects listed by a single request. Node pages where the client can
+// download few files link to continue after the last object listed rather than listing the
+// whole prefix.
+const maxBrowseScan = 1000
+
+// browsePage is the data for the directory view template. Refs are relative to the page.
+type browsePage struct {
+	Title   string
+	RootRef string
+	Crumbs  []*browseLink
+	// Files is set for node pages, which list files rather than prefixes.
+	Files    bool
+	Entries  []*browseEntry
+	FirstRef string
+	NextRef  string
+}
+
+type browseLink struct {
+	Name string
+	Ref  string
+}
+
+type browseEntry struct {
+	Name      string
+	Ref       string
+	Time      time.Time
+	Size      string
+	Thumbnail bool
+}
+
+// imageExtensions are the file extensions shown as thumbnails.
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// isBrowseRequest reports whether r is from a browser for a prefix rather than a file: the root,
+// {job}/, {job}/{task}/ or {job}/{task}/{node}/.
+func isBrowseRequest(r *http.Request) bool {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	p := strings.Trim(r.URL.Path, "/")
+	return p == "" || strings.Count(p, "/") < 3
+}
+
+// handleBrowse renders an HTML directory view of a prefix, a page at a time. Pages continue
+// after the name in the after query parameter.
+func (h *StorageHandler) handleBrowse(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(r.URL.Path, "/")
+
+	// directory pages end in "/" so relative links resolve under them.
+	if p != "" && !strings.HasSuffix(r.URL.Path, "/") {
+		ref := path.Base(p) + "/"
+		if r.URL.RawQuery != "" {
+			ref += "?" + r.URL.RawQuery
+		}
+		w.Header().Set("Location", ref)
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+
+	authorized, err := authorizeRequestFiles(w, r, h.Authenticator, h.LoginLimiter)
+	if err != nil {
+		h.log("%s %s -> %s: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		return
+	}
+
+	if err := h.handleRateLimit(w, r); err != nil {
+		return
+	}
+
+	var segments []string
+	if p != "" {
+		segments = strings.Split(p, "/")
+	}
+	depth := len(segments)
+
+	page := &browsePage{
+		RootRef: parentRef(depth),
+		Files:   depth == 3,
+	}
+	for i, name := range segments {
+		page.Crumbs = append(page.Crumbs, &browseLink{Name: name, Ref: parentRef(depth - 1 - i)})
+		page.Title = name
+	}
+
+	prefix := folderPrefix(h.RootFolder)
+	if p != "" {
+		prefix += p + "/"
+	}
+	after := r.URL.Query().Get("after")
+
+	var scanAfter string
+	if page.Files {
+		page.Entries, scanAfter, err = h.browseFiles(r, prefix, after, authorized)
+	} else {
+		page.Entries, err = h.browsePrefixes(r, prefix, after)
+	}
+	if err != nil {
+		h.handleS3Error(w, r, err)
+		return
+	}
+
+	if len(page.Entries) > browsePageSize {
+		page.Entries = page.Entries[:browsePageSize]
+		page.NextRef = "?after=" + url.QueryEscape(page.Entries[len(page.Entries)-1].Name)
+	} else if scanAfter != "" {
+		page.NextRef = "?after=" + url.QueryEscape(scanAfter)
+	}
+	if after != "" {
+		page.FirstRef = "./"
+	}
+
+	var b bytes.Buffer
+	if err := browseTemplate.Execute(&b, page); err != nil {
+		h.log("%s %s -> %s: failed to render directory: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "failed to render directory")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", b.Len()))
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+}
+
+// browsePrefixes lists the prefixes under prefix with names after after. It returns up to one
+// more entry than fits on a page, so callers know whether there is a next page.
+func (h *StorageHandler) browsePrefixes(r *http.Request, prefix, after string) ([]*browseEntry, error) {
+	prefixes, err := h.Lister.ListPrefixes(r.Context(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(prefixes)
+
+	var entries []*browseEntry
+	for _, p := range prefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+		if name <= after {
+			continue
+		}
+		entries = append(entries, &browseEntry{
+			Name: name,
+			Ref:  "./" + url.PathEscape(name) + "/",
+		})
+		if len(entries) > browsePageSize {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// browseFiles lists the files under a {job}/{task}/{node}/ prefix with names after after. Only
+// files the client could download are listed, so private file names aren't revealed, and
+// thumbnails are only shown for the first maxBrowseThumbnails public images. It returns up to
+// one more entry than fits on a page. If maxBrowseScan objects are listed before the page is
+// full, it also returns the name of the last object listed to continue after.
+func (h *StorageHandler) browseFiles(r *http.Request, prefix, after string, authorized fileAuthorizer) ([]*browseEntry, string, error) {
+	var startAfter string
+	if after != "" {
+		startAfter = prefix + after
+	}
+
+	root := folderPrefix(h.RootFolder)
+
+	var entries []*browseEntry
+	var scanAfter string
+	thumbnails := 0
+	scanned := 0
+
+	add := func(obj *s3.Object) {
+		f, err := parseStorageFilePath(strings.TrimPrefix(aws.StringValue(obj.Key), root))
+		if err != nil {
+			return
+		}
+		if h.Denylist != nil {
+			if _, blocked := h.Denylist.Blocked(f); blocked {
+				return
+			}
+		}
+		if !authorized(f) {
+			return
+		}
+		thumbnail := thumbnails < maxBrowseThumbnails &&
+			imageExtensions[strings.ToLower(path.Ext(f.Filename))] &&
+			h.Authenticator.Authorized(f, "", "", false)
+		if thumbnail {
+			thumbnails++
+		}
+		entries = append(entries, &browseEntry{
+			Name:      f.Filename,
+			Ref:       "./" + url.PathEscape(f.Filename),
+			Time:      f.Timestamp.UTC(),
+			Size:      formatByteSize(aws.Int64Value(obj.Size)),
+			Thumbnail: thumbnail,
+		})
+	}
+
+	err := h.Lister.ListObjectsAfter(r.Context(), prefix, startAfter, func(obj *s3.Object) bool {
+		add(obj)
+		if len(entries) > browsePageSize {
+			return false
+		}
+		if scanned++; scanned >= maxBrowseScan {
+			scanAfter = strings.TrimPrefix(aws.StringValue(obj.Key), prefix)
+			return false
+		}
+		return true
+	})
+	return entries, scanAfter, err
+}
+
+// parentRef returns a relative reference to the directory n levels up.
+func parentRef(n int) string {
+	if n <= 0 {
+		return "./"
+	}
+	return strings.Repeat("../", n)
+}
+
+// formatByteSize formats n using binary units, such as 1.5 MiB.
+func formatByteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// publicNodeAuthenticator authorizes anonymous access to files from a single node and access
+// to all files with the user:secret credentials.
+type publicNodeAuthenticator struct {
+	nodeID string
+}
+
+func (a *publicNodeAuthenticator) Authorized(f *StorageFile, username, password string, hasAuth bool) bool {
+	return f.NodeID == a.nodeID || (hasAuth && username == "user" && password == "secret")
+}
+
+func TestHandlerBrowse(t *testing.T) {
+	storage := newTestLookupStorage()
+	storage.files["node-data/sage/imagesampler-top/0000000000000002/1672531240000000000-sample.flac"] = make([]byte, 1536)
+
+	handler := &StorageHandler{
+		Storage:       storage,
+		RootFolder:    "node-data",
+		Authenticator: &publicNodeAuthenticator{"0000000000000001"},
+		Lister:        storage,
+	}
+
+	browseAs := func(url, username, password string) (*http.Response, string) {
+		r := httptest.NewRequest(http.MethodGet, "/"+url, nil)
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/")
+		r.Header.Set("Accept", "text/html,application/xhtml+xml")
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		resp := w.Result()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	browse := func(url string) (*http.Response, string) {
+		return browseAs(url, "", "")
+	}
+
+	assertContains := func(body string, substrs ...string) {
+		t.Helper()
+		for _, s := range substrs {
+			if !strings.Contains(body, s) {
+				t.Fatalf("expected page to contain %q. got:\n%s", s, body)
+			}
+		}
+	}
+
+	resp, body := browse("")
+	assertStatusCode(t, resp, http.StatusOK)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("incorrect content type: %s", ct)
+	}
+	assertContains(body, `<a href="./sage/">sage</a>`)
+
+	resp, _ = browse("sage/imagesampler-top")
+	assertStatusCode(t, resp, http.StatusMovedPermanently)
+	if loc := resp.Header.Get("Location"); loc != "imagesampler-top/" {
+		t.Fatalf("incorrect location: %s", loc)
+	}
+
+	resp, body = browse("sage/imagesampler-top/")
+	assertStatusCode(t, resp, http.StatusOK)
+	assertContains(body, `<a href="../../">data</a>`, `<a href="../">sage</a>`, `<a href="./0000000000000001/">0000000000000001</a>`, `<a href="./0000000000000002/">0000000000000002</a>`)
+
+	resp, body = browse("sage/imagesampler-top/0000000000000001/")
+	assertStatusCode(t, resp, http.StatusOK)
+	assertContains(body,
+		`<a href="./1672531200000000000-sample.jpg">1672531200000000000-sample.jpg</a>`,
+		`<img class="thumbnail" src="./1672531200000000000-sample.jpg"`,
+		"2023-01-01 00:00:00 UTC",
+		"1 B",
+	)
+
+	// private files are only listed for clients which could download them.
+	resp, body = browse("sage/imagesampler-top/0000000000000002/")
+	assertStatusCode(t, resp, http.StatusOK)
+	if strings.Contains(body, "sample.jpg") || strings.Contains(body, "sample.flac") {
+		t.Fatalf("expected private files to be hidden. got:\n%s", body)
+	}
+
+	// thumbnails are only shown for public files.
+	resp, body = browseAs("sage/imagesampler-top/0000000000000002/", "user", "secret")
+	assertStatusCode(t, resp, http.StatusOK)
+	assertContains(body, "1672531230000000000-sample.jpg", "1.5 KiB")
+	if strings.Contains(body, "<img") {
+		t.Fatalf("expected no thumbnails for private files")
+	}
+
+	// clients which don't accept html keep getting an error for prefixes.
+	assertStatusCode(t, getResponse(t, handler, http.MethodGet, "sage/imagesampler-top/"), http.StatusBadRequest)
+}
+
+func TestHandlerBrowsePages(t *testing.T) {
+	storage := &mockStorage{files: map[string][]byte{}}
+	for i := 0; i < browsePageSize+5; i++ {
+		storage.files[fmt.Sprintf("sage/task/0000000000000001/%d-sample.jpg", 1672531200000000000+int64(i))] = []byte("a")
+	}
+
+	handler := &StorageHandler{
+		Storage:       storage,
+		Authenticator: &mockAuthenticator{true},
+		Lister:        storage,
+	}
+
+	browse := func(url string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = "sage/task/0000000000000001/"
+		r.URL.RawQuery = url
+		r.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assertStatusCode(t, w.Result(), http.StatusOK)
+		return w.Body.String()
+	}
+
+	first := browse("")
+	if n := strings.Count(first, "<tr>") - 1; n != browsePageSize {
+		t.Fatalf("incorrect number of files on first page. got: %d want: %d", n, browsePageSize)
+	}
+	if n := strings.Count(first, "<img"); n != maxBrowseThumbnails {
+		t.Fatalf("incorrect number of thumbnails. got: %d want: %d", n, maxBrowseThumbnails)
+	}
+	last := fmt.Sprintf("%d-sample.jpg", 1672531200000000000+int64(browsePageSize-1))
+	if !strings.Contains(first, `href="?after=`+last+`"`) {
+		t.Fatalf("expected next page link after %s", last)
+	}
+
+	second := browse("after=" + last)
+	if n := strings.Count(second, "<tr>") - 1; n != 5 {
+		t.Fatalf("incorrect number of files on second page. got: %d want: 5", n)
+	}
+	if strings.Contains(second, "Next page") || !strings.Contains(second, "First page") {
+		t.Fatalf("incorrect page links on last page")
+	}
+}
+
+// countingLister counts the objects passed to ListObjectsAfter callbacks.
+type countingLister struct {
+	*mockStorage
+	listed int
+}
+
+func (l *countingLister) ListObjectsAfter(ctx context.Context, prefix, startAfter string, fn func(obj *s3.Object) bool) error {
+	return l.mockStorage.ListObjectsAfter(ctx, prefix, startAfter, func(obj *s3.Object) bool {
+		l.listed++
+		return fn(obj)
+	})
+}
+
+func TestHandlerBrowseScanLimit(t *testing.T) {
+	storage := &mockStorage{files: map[string][]byte{}}
+	for i := 0; i < maxBrowseScan+50; i++ {
+		storage.files[fmt.Sprintf("sage/task/0000000000000002/%d-sample.jpg", 1672531200000000000+int64(i))] = []byte("a")
+	}
+	lister := &countingLister{mockStorage: storage}
+
+	handler := &StorageHandler{
+		Storage:       storage,
+		Authenticator: &publicNodeAuthenticator{"0000000000000001"},
+		Lister:        lister,
+	}
+
+	browse := func(query string) string {
+		lister.listed = 0
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = "sage/task/0000000000000002/"
+		r.URL.RawQuery = query
+		r.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assertStatusCode(t, w.Result(), http.StatusOK)
+		return w.Body.String()
+	}
+
+	// none of the files are authorized, so the page is empty but links to continue the scan.
+	first := browse("")
+	if lister.listed != maxBrowseScan {
+		t.Fatalf("incorrect number of objects listed. got: %d want: %d", lister.listed, maxBrowseScan)
+	}
+	if strings.Contains(first, "-sample.jpg</a>") {
+		t.Fatalf("expected no files on page. got:\n%s", first)
+	}
+	last := fmt.Sprintf("%d-sample.jpg", 1672531200000000000+int64(maxBrowseScan-1))
+	if !strings.Contains(first, `href="?after=`+last+`"`) {
+		t.Fatalf("expected next page link after %s", last)
+	}
+
+	second := browse("after=" + last)
+	if lister.listed != 50 {
+		t.Fatalf("incorrect number of objects listed. got: %d want: 50", lister.listed)
+	}
+	if strings.Contains(second, "Next page") {
+		t.Fatalf("expected no next page link on last page")
+	}
+}
+
+func TestFormatByteSize(t *testing.T) {
+	testcases := map[int64]string{
+		0:                 "0 B",
+		1023:              "1023 B",
+		1536:              "1.5 KiB",
+		10 * 1024 * 1024:  "10.0 MiB",
+		3 << 40:           "3.0 TiB",
+		5 << 50:           "5.0 PiB",
+		1<<62 + 1<<61 + 0: "6144.0 PiB",
+	}
+	for n, expect := range testcases {
+		if s := formatByteSize(n); s != expect {
+			t.Fatalf("incorrect size for %d. got: %s want: %s", n, s, expect)
+		}
+	}
+}
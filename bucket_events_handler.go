@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// BucketEventsHandler accepts MinIO and S3 bucket notification webhooks and publishes the
+// ObjectCreated and ObjectRemoved events for stored files to Bus. MinIO sends the configured
+// auth_token as "Authorization: Bearer <token>", which must match Secret.
+type BucketEventsHandler struct {
+	Bus    *EventBus
+	Secret string
+	// Bucket is optional. If set, events from other buckets are ignored.
+	Bucket     string
+	RootFolder string
+	Logger     *log.Logger
+}
+
+// bucketNotification is the S3 event message format, which MinIO also uses for webhooks.
+type bucketNotification struct {
+	Records []struct {
+		EventName string    `json:"eventName"`
+		EventTime time.Time `json:"eventTime"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				// Key is url encoded.
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+func (h *BucketEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		h.log("%s %s -> %s: bucket events not authorized", r.Method, r.URL, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		respondJSONError(w, http.StatusUnauthorized, "not authorized")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	var msg bucketNotification
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&msg); err != nil {
+		respondJSONError(w, http.StatusBadRequest, "invalid notification")
+		return
+	}
+
+	root := folderPrefix(h.RootFolder)
+
+	for _, rec := range msg.Records {
+		var eventType ObjectEventType
+		switch {
+		case strings.HasPrefix(rec.EventName, "s3:ObjectCreated:"):
+			eventType = ObjectCreated
+		case strings.HasPrefix(rec.EventName, "s3:ObjectRemoved:"):
+			eventType = ObjectRemoved
+		default:
+			bucketEvents.WithLabelValues("ignored").Inc()
+			continue
+		}
+
+		if h.Bucket != "" && rec.S3.Bucket.Name != h.Bucket {
+			bucketEvents.WithLabelValues("ignored").Inc()
+			continue
+		}
+
+		key, err := url.QueryUnescape(rec.S3.Object.Key)
+		if err != nil || !strings.HasPrefix(key, root) {
+			bucketEvents.WithLabelValues("ignored").Inc()
+			continue
+		}
+
+		f, err := parseStorageFilePath(strings.TrimPrefix(key, root))
+		if err != nil {
+			h.log("ignoring bucket event for %s: %s", key, err.Error())
+			bucketEvents.WithLabelValues("ignored").Inc()
+			continue
+		}
+
+		e := &ObjectEvent{
+			Type: eventType,
+			File: f,
+			Time: rec.EventTime,
+		}
+		if eventType == ObjectCreated {
+			e.Size = rec.S3.Object.Size
+			e.ETag = strings.Trim(rec.S3.Object.ETag, `"`)
+		}
+		h.Bus.Publish(e)
+		bucketEvents.WithLabelValues(string(eventType)).Inc()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *BucketEventsHandler) authorized(r *http.Request) bool {
+	token, ok := bearerToken(r)
+	return ok && h.Secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.Secret)) == 1
+}
+
+func (h *BucketEventsHandler) log(format string, v ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Printf(format, v...)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBucketNotification = `{
+  "EventName": "s3:ObjectCreated:Put",
+  "Records": [
+    {
+      "eventName": "s3:ObjectCreated:Put",
+      "eventTime": "2023-01-01T00:00:01.000Z",
+      "s3": {
+        "bucket": {"name": "sage"},
+        "object": {"key": "node-data%2Fsage%2Fimagesampler-top%2F000048b02d15bc7c%2F1672531200000000000-top+camera.jpg", "size": 1234, "eTag": "\"abc\""}
+      }
+    },
+    {
+      "eventName": "s3:ObjectRemoved:Delete",
+      "eventTime": "2023-01-01T00:00:02.000Z",
+      "s3": {
+        "bucket": {"name": "sage"},
+        "object": {"key": "node-data/sage/imagesampler-top/000048b02d15bc7c/1672531100000000000-sample.jpg"}
+      }
+    },
+    {
+      "eventName": "s3:ObjectAccessed:Get",
+      "s3": {"bucket": {"name": "sage"}, "object": {"key": "node-data/sage/imagesampler-top/000048b02d15bc7c/1672531100000000000-sample.jpg"}}
+    },
+    {
+      "eventName": "s3:ObjectCreated:Put",
+      "s3": {"bucket": {"name": "other"}, "object": {"key": "node-data/sage/imagesampler-top/000048b02d15bc7c/1672531100000000000-sample.jpg"}}
+    },
+    {
+      "eventName": "s3:ObjectCreated:Put",
+      "s3": {"bucket": {"name": "sage"}, "object": {"key": "node-data/denylist.json"}}
+    }
+  ]
+}`
+
+func TestBucketEventsHandler(t *testing.T) {
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe(10)
+	defer cancel()
+
+	handler := &BucketEventsHandler{
+		Bus:        bus,
+		Secret:     "0123456789abcdef",
+		Bucket:     "sage",
+		RootFolder: "node-data",
+	}
+
+	do := func(method, authorization, body string) *http.Response {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assertStatusCode(t, do(http.MethodPost, "", testBucketNotification), http.StatusUnauthorized)
+	assertStatusCode(t, do(http.MethodPost, "Bearer wrong", testBucketNotification), http.StatusUnauthorized)
+	assertStatusCode(t, do(http.MethodGet, "Bearer 0123456789abcdef", ""), http.StatusMethodNotAllowed)
+	assertStatusCode(t, do(http.MethodPost, "Bearer 0123456789abcdef", "{"), http.StatusBadRequest)
+	assertStatusCode(t, do(http.MethodPost, "Bearer 0123456789abcdef", testBucketNotification), http.StatusNoContent)
+
+	created := <-events
+	if created.Type != ObjectCreated || created.Path() != "sage/imagesampler-top/000048b02d15bc7c/1672531200000000000-top camera.jpg" {
+		t.Fatalf("incorrect created event: %+v", created)
+	}
+	if created.Size != 1234 || created.ETag != "abc" || !created.File.Timestamp.Equal(time.Unix(0, 1672531200000000000)) {
+		t.Fatalf("incorrect created event: %+v", created)
+	}
+
+	removed := <-events
+	if removed.Type != ObjectRemoved || removed.File.Filename != "1672531100000000000-sample.jpg" {
+		t.Fatalf("incorrect removed event: %+v", removed)
+	}
+
+	select {
+	case e := <-events:
+		t.Fatalf("expected other records to be ignored. got: %+v", e)
+	default:
+	}
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the service config. It is read from an optional YAML file and then overridden by
+// env vars, so deployments configured only by env vars keep working.
+type Config struct {
+	Addr     string         `yaml:"addr"`
+	Server   ServerConfig   `yaml:"server"`
+	S3       S3Config       `yaml:"s3"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Policies PolicyConfig   `yaml:"policies"`
+	Denylist DenylistConfig `yaml:"denylist"`
+	Share    ShareConfig    `yaml:"share"`
+	TLS      TLSConfig      `yaml:"tls"`
+	CORS     CORSConfig     `yaml:"cors"`
+	Django   DjangoConfig   `yaml:"django"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	Quotas   QuotaConfig    `yaml:"quotas"`
+	Index    IndexConfig    `yaml:"index"`
+	Events   EventsConfig   `yaml:"events"`
+	Lookup   LookupConfig   `yaml:"lookup"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+}
+
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	DisableSSL      bool   `yaml:"disable_ssl"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	Bucket          string `yaml:"bucket"`
+	RootFolder      string `yaml:"root_folder"`
+	// PresignTTL is how long presigned download URLs are valid.
+	PresignTTL time.Duration `yaml:"presign_ttl"`
+	// UploadPresignTTL is how long presigned upload URLs are valid.
+	UploadPresignTTL time.Duration `yaml:"upload_presign_ttl"`
+}
+
+// AuthConfig uses the same formats as the corresponding env vars for credentials and embargoes.
+type AuthConfig struct {
+	// NodeTableURL is the production node table used for authorization.
+	NodeTableURL      string `yaml:"node_table_url"`
+	StaticCredentials string `yaml:"static_credentials"`
+	CredentialsFile   string `yaml:"credentials_file"`
+	AdminCredentials  string `yaml:"admin_credentials"`
+	Embargo           string `yaml:"embargo"`
+	NodeEmbargo       string `yaml:"node_embargo"`
+	TrustForwardedFor bool   `yaml:"trust_forwarded_for"`
+	JWKSURL           string `yaml:"jwks_url"`
+	JWTIssuer         string `yaml:"jwt_issuer"`
+	JWTAudience       string `yaml:"jwt_audience"`
+}
+
+// PolicyConfig uses the same formats as the corresponding env vars.
+type PolicyConfig struct {
+	RestrictedNodes          string `yaml:"restricted_nodes"`
+	RestrictedTasks          string `yaml:"restricted_tasks"`
+	RestrictedTaskSubstrings string `yaml:"restricted_task_substrings"`
+}
+
+type DenylistConfig struct {
+	S3Key string `yaml:"s3_key"`
+	File  string `yaml:"file"`
+}
+
+type ShareConfig struct {
+	Keys      string `yaml:"keys"`
+	PublicURL string `yaml:"public_url"`
+}
+
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// CORSConfig uses comma separated lists, like the corresponding env vars. Empty lists use the
+// defaults from DefaultCORSPolicy.
+type CORSConfig struct {
+	AllowedOrigins      string        `yaml:"allowed_origins"`
+	CredentialedOrigins string        `yaml:"credentialed_origins"`
+	AllowedMethods      string        `yaml:"allowed_methods"`
+	AllowedHeaders      string        `yaml:"allowed_headers"`
+	ExposedHeaders      string        `yaml:"exposed_headers"`
+	MaxAge              time.Duration `yaml:"max_age"`
+}
+
+type DjangoConfig struct {
+	// URL is the downloads endpoint which requests with other authorization are proxied to.
+	// Proxying is disabled if it is empty.
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	Retries int           `yaml:"retries"`
+}
+
+// LimitsConfig sets the request rate of each client in requests per second and the number of s3
+// requests in flight. Zero disables a limit.
+type LimitsConfig struct {
+	AnonymousRate      float64       `yaml:"anonymous_rate"`
+	AnonymousBurst     int           `yaml:"anonymous_burst"`
+	AuthenticatedRate  float64       `yaml:"authenticated_rate"`
+	AuthenticatedBurst int           `yaml:"authenticated_burst"`
+	S3MaxInFlight      int           `yaml:"s3_max_in_flight"`
+	S3MaxInFlightWait  time.Duration `yaml:"s3_max_in_flight_wait"`
+}
+
+// QuotaConfig sets download quotas, using byte sizes such as 10GiB and the principal=daily/monthly
+// format of ParseQuotas. Usage is only recorded if LedgerFile is set.
+type QuotaConfig struct {
+	LedgerFile   string `yaml:"ledger_file"`
+	DailyBytes   string `yaml:"daily_bytes"`
+	MonthlyBytes string `yaml:"monthly_bytes"`
+	Principals   string `yaml:"principals"`
+}
+
+// IndexConfig sets up the object index used by the search API. The index is disabled if File is
+// empty.
+type IndexConfig struct {
+	File string `yaml:"file"`
+	// ScanInterval is how often new objects are indexed and FullScanInterval is how often every
+	// object is listed to find deleted objects.
+	ScanInterval     time.Duration `yaml:"scan_interval"`
+	FullScanInterval time.Duration `yaml:"full_scan_interval"`
+}
+
+// EventsConfig sets up bucket notification ingestion. The webhook endpoint is disabled if
+// BucketSecret is empty.
+type EventsConfig struct {
+	BucketSecret string `yaml:"bucket_secret"`
+	// FeedMaxSubscribers limits the number of open feeds. Zero is unlimited.
+	FeedMaxSubscribers int `yaml:"feed_max_subscribers"`
+}
+
+// LookupConfig sets up latest and nearest file lookups.
+type LookupConfig struct {
+	// CacheTTL is how long lookup results are cached. Zero disables caching.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+type LoggingConfig struct {
+	AccessLog   string `yaml:"access_log"`
+	AuditLog    string `yaml:"audit_log"`
+	MaxBytes    int64  `yaml:"max_bytes"`
+	MaxBackups  int    `yaml:"max_backups"`
+	AnonymizeIP bool   `yaml:"anonymize_ip"`
+}
+
+type TracingConfig struct {
+	// Exporter is "otlp", "stdout" or empty to disable tracing.
+	Exporter string `yaml:"exporter"`
+}
+
+// DefaultConfig returns the config used for any values not set by the config file or env vars.
+func DefaultConfig() *Config {
+	return &Config{
+		Addr: "127.0.0.1:8080",
+		Server: ServerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			MaxHeaderBytes:    64 * 1024,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		S3: S3Config{
+			Region:           "us-west-2",
+			PresignTTL:       60 * time.Second,
+			UploadPresignTTL: 60 * time.Second,
+		},
+		CORS: CORSConfig{
+			MaxAge: 10 * time.Minute,
+		},
+		Django: DjangoConfig{
+			URL:     "https://auth.sagecontinuum.org/downloads/",
+			Timeout: 10 * time.Second,
+			Retries: 2,
+		},
+		Limits: LimitsConfig{
+			AnonymousRate:      5,
+			AnonymousBurst:     20,
+			AuthenticatedRate:  50,
+			AuthenticatedBurst: 100,
+			S3MaxInFlight:      256,
+			S3MaxInFlightWait:  time.Second,
+		},
+		Index: IndexConfig{
+			ScanInterval:     5 * time.Minute,
+			FullScanInterval: 24 * time.Hour,
+		},
+		Events: EventsConfig{
+			FeedMaxSubscribers: 1000,
+		},
+		Lookup: LookupConfig{
+			CacheTTL: 10 * time.Second,
+		},
+		Logging: LoggingConfig{
+			MaxBytes:   100 * 1024 * 1024,
+			MaxBackups: 5,
+		},
+	}
+}
+
+// envOverrides maps the env vars which override config values.
+func (c *Config) envOverrides() map[string]interface{} {
+	return map[string]interface{}{
+		"addr":                           &c.Addr,
+		"httpReadHeaderTimeout":          &c.Server.ReadHeaderTimeout,
+		"httpReadTimeout":                &c.Server.ReadTimeout,
+		"httpWriteTimeout":               &c.Server.WriteTimeout,
+		"httpIdleTimeout":                &c.Server.IdleTimeout,
+		"httpMaxHeaderBytes":             &c.Server.MaxHeaderBytes,
+		"httpShutdownTimeout":            &c.Server.ShutdownTimeout,
+		"s3Endpoint":                     &c.S3.Endpoint,
+		"s3Region":                       &c.S3.Region,
+		"s3DisableSSL":                   &c.S3.DisableSSL,
+		"s3accessKeyID":                  &c.S3.AccessKeyID,
+		"s3secretAccessKey":              &c.S3.SecretAccessKey,
+		"s3bucket":                       &c.S3.Bucket,
+		"s3rootFolder":                   &c.S3.RootFolder,
+		"s3PresignTTL":                   &c.S3.PresignTTL,
+		"s3UploadPresignTTL":             &c.S3.UploadPresignTTL,
+		"productionURL":                  &c.Auth.NodeTableURL,
+		"authStaticCredentials":          &c.Auth.StaticCredentials,
+		"authCredentialsFile":            &c.Auth.CredentialsFile,
+		"adminCredentials":               &c.Auth.AdminCredentials,
+		"authEmbargo":                    &c.Auth.Embargo,
+		"authNodeEmbargo":                &c.Auth.NodeEmbargo,
+		"trustForwardedFor":              &c.Auth.TrustForwardedFor,
+		"jwksURL":                        &c.Auth.JWKSURL,
+		"jwtIssuer":                      &c.Auth.JWTIssuer,
+		"jwtAudience":                    &c.Auth.JWTAudience,
+		"policyRestrictedNodes":          &c.Policies.RestrictedNodes,
+		"policyRestrictedTasks":          &c.Policies.RestrictedTasks,
+		"policyRestrictedTaskSubstrings": &c.Policies.RestrictedTaskSubstrings,
+		"denylistS3Key":                  &c.Denylist.S3Key,
+		"denylistFile":                   &c.Denylist.File,
+		"shareKeys":                      &c.Share.Keys,
+		"publicURL":                      &c.Share.PublicURL,
+		"tlsCertFile":                    &c.TLS.CertFile,
+		"tlsKeyFile":                     &c.TLS.KeyFile,
+		"tlsClientCAFile":                &c.TLS.ClientCAFile,
+		"corsAllowedOrigins":             &c.CORS.AllowedOrigins,
+		"corsCredentialedOrigins":        &c.CORS.CredentialedOrigins,
+		"corsAllowedMethods":             &c.CORS.AllowedMethods,
+		"corsAllowedHeaders":             &c.CORS.AllowedHeaders,
+		"corsExposedHeaders":             &c.CORS.ExposedHeaders,
+		"corsMaxAge":                     &c.CORS.MaxAge,
+		"djangoURL":                      &c.Django.URL,
+		"djangoTimeout":                  &c.Django.Timeout,
+		"djangoRetries":                  &c.Django.Retries,
+		"rateLimitAnonymous":             &c.Limits.AnonymousRate,
+		"rateLimitAnonymousBurst":        &c.Limits.AnonymousBurst,
+		"rateLimitAuthenticated":         &c.Limits.AuthenticatedRate,
+		"rateLimitAuthenticatedBurst":    &c.Limits.AuthenticatedBurst,
+		"s3MaxInFlight":                  &c.Limits.S3MaxInFlight,
+		"s3MaxInFlightWait":              &c.Limits.S3MaxInFlightWait,
+		"quotaLedgerFile":                &c.Quotas.LedgerFile,
+		"quotaDaily":                     &c.Quotas.DailyBytes,
+		"quotaMonthly":                   &c.Quotas.MonthlyBytes,
+		"quotaPrincipals":                &c.Quotas.Principals,
+		"indexFile":                      &c.Index.File,
+		"indexScanInterval":              &c.Index.ScanInterval,
+		"indexFullScanInterval":          &c.Index.FullScanInterval,
+		"bucketEventsSecret":             &c.Events.BucketSecret,
+		"feedMaxSubscribers":             &c.Events.FeedMaxSubscribers,
+		"lookupCacheTTL":                 &c.Lookup.CacheTTL,
+		"accessLog":                      &c.Logging.AccessLog,
+		"auditLog":                       &c.Logging.AuditLog,
+		"logMaxBytes":                    &c.Logging.MaxBytes,
+		"logMaxBackups":                  &c.Logging.MaxBackups,
+		"logAnonymizeIP":                 &c.Logging.AnonymizeIP,
+		"tracingExporter":                &c.Tracing.Exporter,
+	}
+}
+
+// LoadConfig reads the config file at path, if set, applies env var overrides and validates
+// the result.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %s", err.Error())
+		}
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (c *Config) applyEnv() error {
+	for key, value := range c.envOverrides() {
+		// empty env vars are treated as unset, as compose files often pass through unset vars.
+		s := os.Getenv(key)
+		if s == "" {
+			continue
+		}
+
+		var err error
+
+		switch value := value.(type) {
+		case *string:
+			*value = s
+		case *bool:
+			*value, err = strconv.ParseBool(s)
+		case *int:
+			*value, err = strconv.Atoi(s)
+		case *int64:
+			*value, err = strconv.ParseInt(s, 10, 64)
+		case *float64:
+			*value, err = strconv.ParseFloat(s, 64)
+		case *time.Duration:
+			*value, err = time.ParseDuration(s)
+		default:
+			panic(fmt.Sprintf("unsupported config type %T for %s", value, key))
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to parse %s env var: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// Validate checks required values are set and that values in env var formats can be parsed.
+func (c *Config) Validate() error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"s3.endpoint", c.S3.Endpoint},
+		{"s3.access_key_id", c.S3.AccessKeyID},
+		{"s3.secret_access_key", c.S3.SecretAccessKey},
+		{"s3.bucket", c.S3.Bucket},
+		{"s3.root_folder", c.S3.RootFolder},
+		{"auth.node_table_url", c.Auth.NodeTableURL},
+	}
+
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("%s is required", r.name)
+		}
+	}
+
+	if c.S3.PresignTTL <= 0 || c.S3.UploadPresignTTL <= 0 {
+		return fmt.Errorf("s3 presign ttls must be positive")
+	}
+
+	if c.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("server.shutdown_timeout must not be negative")
+	}
+
+	if _, err := c.TableAuthenticatorConfig(); err != nil {
+		return err
+	}
+
+	// security: without an issuer and audience, tokens issued for other services by the same
+	// keys would be accepted.
+	if c.Auth.JWKSURL != "" && (c.Auth.JWTIssuer == "" || c.Auth.JWTAudience == "") {
+		return fmt.Errorf("auth.jwt_issuer and auth.jwt_audience are required when auth.jwks_url is set")
+	}
+
+	if _, err := ParseStaticCredentials(c.Auth.AdminCredentials); err != nil {
+		return fmt.Errorf("invalid auth.admin_credentials: %s", err.Error())
+	}
+
+	if _, err := ParseShareKeys(c.Share.Keys); err != nil {
+		return fmt.Errorf("invalid share.keys: %s", err.Error())
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		return fmt.Errorf("tls.client_ca_file requires tls.cert_file")
+	}
+
+	if _, err := c.CORSPolicy(); err != nil {
+		return err
+	}
+
+	if c.Django.URL != "" {
+		if _, err := NewDjangoProxy(c.Django.URL, c.Django.Timeout, c.Django.Retries, nil); err != nil {
+			return fmt.Errorf("invalid django.url: %s", err.Error())
+		}
+	}
+	if c.Django.Timeout <= 0 || c.Django.Retries < 0 {
+		return fmt.Errorf("django.timeout must be positive and django.retries must not be negative")
+	}
+
+	if c.Limits.AnonymousRate < 0 || c.Limits.AuthenticatedRate < 0 || c.Limits.AnonymousBurst < 0 || c.Limits.AuthenticatedBurst < 0 {
+		return fmt.Errorf("limits rates and bursts must not be negative")
+	}
+	if c.Limits.S3MaxInFlight < 0 || c.Limits.S3MaxInFlightWait < 0 {
+		return fmt.Errorf("limits.s3_max_in_flight and limits.s3_max_in_flight_wait must not be negative")
+	}
+
+	if _, err := c.QuotaPolicy(); err != nil {
+		return err
+	}
+
+	if c.Index.ScanInterval <= 0 || c.Index.FullScanInterval <= 0 {
+		return fmt.Errorf("index.scan_interval and index.full_scan_interval must be positive")
+	}
+
+	if c.Events.BucketSecret != "" && len(c.Events.BucketSecret) < 16 {
+		return fmt.Errorf("events.bucket_secret must be at least 16 characters")
+	}
+	if c.Events.FeedMaxSubscribers < 0 {
+		return fmt.Errorf("events.feed_max_subscribers must not be negative")
+	}
+
+	if c.Lookup.CacheTTL < 0 {
+		return fmt.Errorf("lookup.cache_ttl must not be negative")
+	}
+
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		return fmt.Errorf("unknown tracing.exporter %q", c.Tracing.Exporter)
+	}
+
+	return nil
+}
+
+// TableAuthenticatorConfig returns the credentials, embargoes and task policies from the config.
+// The node table is left nil, as it is loaded separately.
+func (c *Config) TableAuthenticatorConfig() (*TableAuthenticatorConfig, error) {
+	loader := &CredentialsLoader{
+		Static: c.Auth.StaticCredentials,
+		Path:   c.Auth.CredentialsFile,
+	}
+
+	credentials, err := loader.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %s", err.Error())
+	}
+
+	var embargo time.Duration
+	if c.Auth.Embargo != "" {
+		embargo, err = ParseEmbargoDuration(c.Auth.Embargo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth.embargo: %s", err.Error())
+		}
+	}
+
+	nodeEmbargo, err := ParseNodeEmbargo(c.Auth.NodeEmbargo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth.node_embargo: %s", err.Error())
+	}
+
+	restrictedNodes := ParseNodeList(c.Policies.RestrictedNodes)
+
+	taskPolicies, err := ParseTaskPolicyRules(c.Policies.RestrictedTasks, restrictedNodes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policies.restricted_tasks: %s", err.Error())
+	}
+	taskPolicies = append(taskPolicies, ParseTaskSubstrings(c.Policies.RestrictedTaskSubstrings, restrictedNodes)...)
+
+	return &TableAuthenticatorConfig{
+		Credentials:  credentials,
+		Embargo:      embargo,
+		NodeEmbargo:  nodeEmbargo,
+		TaskPolicies: taskPolicies,
+	}, nil
+}
+
+// CORSPolicy returns the CORS policy from the config.
+func (c *Config) CORSPolicy() (*CORSPolicy, error) {
+	policy := DefaultCORSPolicy()
+
+	if c.CORS.AllowedOrigins != "" {
+		origins, err := ParseCORSOrigins(c.CORS.AllowedOrigins)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cors.allowed_origins: %s", err.Error())
+		}
+		policy.AllowedOrigins = origins
+	}
+
+	credentialedOrigins, err := ParseCORSOrigins(c.CORS.CredentialedOrigins)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cors.credentialed_origins: %s", err.Error())
+	}
+	if containsString(credentialedOrigins, "*") {
+		return nil, fmt.Errorf("invalid cors.credentialed_origins: origins must be listed explicitly")
+	}
+	policy.CredentialedOrigins = credentialedOrigins
+
+	if c.CORS.AllowedMethods != "" {
+		policy.AllowedMethods = splitList(strings.ToUpper(c.CORS.AllowedMethods))
+	}
+	if c.CORS.AllowedHeaders != "" {
+		policy.AllowedHeaders = splitList(c.CORS.AllowedHeaders)
+	}
+	if c.CORS.ExposedHeaders != "" {
+		policy.ExposedHeaders = splitList(c.CORS.ExposedHeaders)
+	}
+
+	if c.CORS.MaxAge < 0 {
+		return nil, fmt.Errorf("cors.max_age must not be negative")
+	}
+	policy.MaxAge = c.CORS.MaxAge
+
+	return policy, nil
+}
+
+// QuotaPolicy returns the download quotas from the config.
+func (c *Config) QuotaPolicy() (QuotaPolicy, error) {
+	var policy QuotaPolicy
+	var err error
+
+	if policy.Default.DailyBytes, err = ParseByteSize(c.Quotas.DailyBytes); err != nil {
+		return policy, fmt.Errorf("invalid quotas.daily_bytes: %s", err.Error())
+	}
+	if policy.Default.MonthlyBytes, err = ParseByteSize(c.Quotas.MonthlyBytes); err != nil {
+		return policy, fmt.Errorf("invalid quotas.monthly_bytes: %s", err.Error())
+	}
+	if policy.Principals, err = ParseQuotas(c.Quotas.Principals); err != nil {
+		return policy, fmt.Errorf("invalid quotas.principals: %s", err.Error())
+	}
+	return policy, nil
+}
+
+// restartRequired returns the sections which changed between c and other but can only be
+// applied by restarting.
+func (c *Config) restartRequired(other *Config) []string {
+	a, b := *c, *other
+	a.clearReloadable()
+	b.clearReloadable()
+
+	var changed []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, va.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+	return changed
+}
+
+// clearReloadable clears the values which are applied without a restart: credentials,
+// embargoes, task policies, presign TTLs, quotas and share keys. Enabling or disabling share
+// links still needs a restart.
+func (c *Config) clearReloadable() {
+	c.Auth.StaticCredentials = ""
+	c.Auth.CredentialsFile = ""
+	c.Auth.Embargo = ""
+	c.Auth.NodeEmbargo = ""
+	c.Policies = PolicyConfig{}
+	c.S3.PresignTTL = 0
+	c.S3.UploadPresignTTL = 0
+	c.Quotas = QuotaConfig{LedgerFile: c.Quotas.LedgerFile}
+	if c.Share.Keys != "" {
+		c.Share.Keys = "enabled"
+	}
+}
+
+// ConfigWatcher reloads the config when the config file or credentials file changes or a
+// value is received on its reload channel.
+type ConfigWatcher struct {
+	Path   string
+	Logger *log.Logger
+}
+
+// Watch calls apply with each newly loaded config until ctx is done. Configs which fail to
+// load are logged and skipped, so the current config stays in use.
+func (w *ConfigWatcher) Watch(ctx context.Context, config *Config, interval time.Duration, reload <-chan os.Signal, apply func(*Config)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	initial := config
+	lastModTime := w.modTime(config)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		case <-ticker.C:
+			if w.modTime(config).Equal(lastModTime) {
+				continue
+			}
+		}
+
+		newConfig, err := LoadConfig(w.Path)
+		if err != nil {
+			// keep using the current config rather than locking everyone out.
+			w.log("failed to reload config: %s", err.Error())
+			lastModTime = w.modTime(config)
+			continue
+		}
+
+		if changed := initial.restartRequired(newConfig); len(changed) > 0 {
+			w.log("config changes to %v require a restart and were not applied", changed)
+		}
+
+		config = newConfig
+		lastModTime = w.modTime(config)
+		apply(config)
+		w.log("reloaded config")
+	}
+}
+
+// modTime returns the latest modification time of the config and credentials files.
+func (w *ConfigWatcher) modTime(config *Config) time.Time {
+	var latest time.Time
+	for _, path := range []string{w.Path, config.Auth.CredentialsFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (w *ConfigWatcher) log(format string, v ...interface{}) {
+	if w.Logger == nil {
+		return
+	}
+	w.Logger.Printf(format, v...)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfigYAML = `
+addr: ":80"
+server:
+  read_timeout: 5s
+  max_header_bytes: 1024
+s3:
+  endpoint: http://minio:9000
+  region: us-east-1
+  disable_ssl: true
+  access_key_id: minio
+  secret_access_key: minio123
+  bucket: sage
+  root_folder: node-data
+  presign_ttl: 5m
+auth:
+  node_table_url: https://example.org/nodes
+  static_credentials: user:secret
+  embargo: 30d
+policies:
+  restricted_nodes: abc,bca
+  restricted_task_substrings: bottom
+`
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeTestConfig(t, testConfigYAML)
+
+	// env vars override the config file.
+	t.Setenv("s3bucket", "other-bucket")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("not expecting error but got %s", err)
+	}
+
+	if config.Addr != ":80" ||
+		config.Server.ReadTimeout != 5*time.Second ||
+		config.Server.MaxHeaderBytes != 1024 ||
+		config.Server.WriteTimeout != 60*time.Second ||
+		config.S3.Region != "us-east-1" ||
+		!config.S3.DisableSSL ||
+		config.S3.Bucket != "other-bucket" ||
+		config.S3.PresignTTL != 5*time.Minute ||
+		config.S3.UploadPresignTTL != time.Minute {
+		t.Fatalf("incorrect config: %+v", config)
+	}
+
+	authConfig, err := config.TableAuthenticatorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authConfig.Credentials) != 1 || authConfig.Embargo != 30*24*time.Hour || len(authConfig.TaskPolicies) != 1 {
+		t.Fatalf("incorrect auth config: %+v", authConfig)
+	}
+}
+
+func TestLoadConfigEnvOnly(t *testing.T) {
+	setTestConfigEnv(t)
+	t.Setenv("httpIdleTimeout", "5s")
+	t.Setenv("trustForwardedFor", "true")
+	t.Setenv("rateLimitAnonymous", "0.5")
+	t.Setenv("tokenInfoEndpoint", "ignored")
+
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("not expecting error but got %s", err)
+	}
+	if config.S3.Endpoint != "http://minio:9000" || config.S3.Region != "us-west-2" || config.Server.IdleTimeout != 5*time.Second || !config.Auth.TrustForwardedFor || config.Limits.AnonymousRate != 0.5 {
+		t.Fatalf("incorrect config: %+v", config)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	testcases := map[string]struct {
+		YAML string
+		Env  map[string]string
+		Err  string
+	}{
+		"UnknownField": {
+			YAML: "s3:\n  bukcet: sage\n",
+			Err:  "bukcet",
+		},
+		"MissingRequired": {
+			Env: map[string]string{"s3bucket": ""},
+			Err: "s3.bucket is required",
+		},
+		"InvalidEnvDuration": {
+			Env: map[string]string{"httpIdleTimeout": "forever"},
+			Err: "httpIdleTimeout",
+		},
+		"InvalidEmbargo": {
+			Env: map[string]string{"authEmbargo": "-1d"},
+			Err: "auth.embargo",
+		},
+		"InvalidTaskPolicy": {
+			YAML: "policies:\n  restricted_tasks: regex:.*\n",
+			Err:  "policies.restricted_tasks",
+		},
+		"UnknownTracingExporter": {
+			YAML: "tracing:\n  exporter: zipkin\n",
+			Err:  "tracing.exporter",
+		},
+		"CertWithoutKey": {
+			Env: map[string]string{"tlsCertFile": "/etc/tls/tls.crt"},
+			Err: "tls.cert_file and tls.key_file",
+		},
+		"InvalidCORSOrigin": {
+			Env: map[string]string{"corsAllowedOrigins": "portal.sagecontinuum.org"},
+			Err: "cors.allowed_origins",
+		},
+		"WildcardCredentialedOrigin": {
+			YAML: "cors:\n  credentialed_origins: \"*\"\n",
+			Err:  "cors.credentialed_origins",
+		},
+		"NegativeRateLimit": {
+			Env: map[string]string{"rateLimitAuthenticated": "-1"},
+			Err: "limits",
+		},
+		"InvalidQuota": {
+			YAML: "quotas:\n  principals: partner=10GiB\n",
+			Err:  "quotas.principals",
+		},
+		"NonPositiveIndexInterval": {
+			Env: map[string]string{"indexScanInterval": "0s"},
+			Err: "index.scan_interval",
+		},
+		"ShortBucketEventsSecret": {
+			Env: map[string]string{"bucketEventsSecret": "secret"},
+			Err: "events.bucket_secret",
+		},
+		"NegativeLookupCacheTTL": {
+			Env: map[string]string{"lookupCacheTTL": "-1s"},
+			Err: "lookup.cache_ttl",
+		},
+		"JWKSWithoutAudience": {
+			Env: map[string]string{"jwksURL": "https://auth.sagecontinuum.org/jwks", "jwtIssuer": "https://auth.sagecontinuum.org"},
+			Err: "auth.jwt_audience",
+		},
+		"NonPositivePresignTTL": {
+			YAML: "s3:\n  presign_ttl: 0s\n",
+			Err:  "presign",
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			setTestConfigEnv(t)
+			for k, v := range tc.Env {
+				t.Setenv(k, v)
+			}
+			var path string
+			if tc.YAML != "" {
+				path = writeTestConfig(t, tc.YAML)
+			}
+
+			_, err := LoadConfig(path)
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if !strings.Contains(err.Error(), tc.Err) {
+				t.Fatalf("expected error to mention %q. got: %s", tc.Err, err)
+			}
+		})
+	}
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	a := DefaultConfig()
+	b := DefaultConfig()
+
+	b.Auth.StaticCredentials = "user:secret"
+	b.Auth.Embargo = "30d"
+	b.Policies.RestrictedNodes = "abc"
+	b.S3.PresignTTL = time.Hour
+	b.Quotas.DailyBytes = "10GiB"
+	a.Share.Keys = "key1:" + strings.Repeat("a", 32)
+	b.Share.Keys = "key2:" + strings.Repeat("b", 32)
+
+	if changed := a.restartRequired(b); len(changed) != 0 {
+		t.Fatalf("expected reloadable changes to not require a restart. got: %v", changed)
+	}
+
+	b.S3.Bucket = "other"
+	b.Auth.JWKSURL = "https://example.org/jwks"
+	b.Share.Keys = ""
+
+	changed := a.restartRequired(b)
+	if len(changed) != 3 || changed[0] != "s3" || changed[1] != "auth" || changed[2] != "share" {
+		t.Fatalf("expected s3, auth and share changes to require a restart. got: %v", changed)
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir := t.TempDir()
+	credentialsPath := filepath.Join(dir, "credentials.json")
+	if err := os.WriteFile(credentialsPath, []byte(`[{"username": "user1", "password": "secret"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestConfigEnv(t)
+	configPath := writeTestConfig(t, "auth:\n  static_credentials: static:secret\n  credentials_file: "+credentialsPath+"\n")
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authConfig, err := config.TableAuthenticatorConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(authConfig)
+
+	if !auth.authenticated("user1", "secret", true) || !auth.authenticated("static", "secret", true) {
+		t.Fatalf("expected initial credentials to be loaded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reload := make(chan os.Signal)
+	// the invalid config below may still be loading when the valid one is written, in which case
+	// both reloads apply it. buffering keeps the watcher from blocking on the extra update.
+	updated := make(chan *Config, 1)
+
+	watcher := &ConfigWatcher{Path: configPath}
+	go watcher.Watch(ctx, config, time.Hour, reload, func(config *Config) {
+		authConfig, err := config.TableAuthenticatorConfig()
+		if err != nil {
+			t.Error(err)
+		}
+		auth.UpdateSettings(authConfig)
+		updated <- config
+	})
+
+	if err := os.WriteFile(credentialsPath, []byte(`[{"username": "user2", "password": "secret"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reload <- os.Interrupt
+	<-updated
+
+	if auth.authenticated("user1", "secret", true) {
+		t.Fatalf("expected removed credential to be rejected after reload")
+	}
+	if !auth.authenticated("user2", "secret", true) || !auth.authenticated("static", "secret", true) {
+		t.Fatalf("expected new credentials to be accepted after reload")
+	}
+
+	// an invalid config is skipped and the current config stays in use.
+	os.WriteFile(configPath, []byte("auth:\n  embargo: soon\n"), 0600)
+	reload <- os.Interrupt
+
+	os.WriteFile(configPath, []byte("s3:\n  presign_ttl: 10m\n"), 0600)
+	reload <- os.Interrupt
+	newConfig := <-updated
+
+	if newConfig.S3.PresignTTL != 10*time.Minute {
+		t.Fatalf("expected presign ttl to be reloaded. got: %s", newConfig.S3.PresignTTL)
+	}
+	if auth.authenticated("static", "secret", true) {
+		t.Fatalf("expected static credentials removed from config to be rejected after reload")
+	}
+}
+
+func setTestConfigEnv(t *testing.T) {
+	t.Setenv("s3Endpoint", "http://minio:9000")
+	t.Setenv("s3accessKeyID", "minio")
+	t.Setenv("s3secretAccessKey", "minio123")
+	t.Setenv("s3bucket", "sage")
+	t.Setenv("s3rootFolder", "node-data")
+	t.Setenv("productionURL", "https://example.org/nodes")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy controls which browser origins can access the API.
+type CORSPolicy struct {
+	// AllowedOrigins can access the API without credentials. "*" allows any origin.
+	AllowedOrigins []string
+	// CredentialedOrigins can additionally send credentials, such as basic auth or cookies.
+	// They must be listed explicitly, as any origin allowed to send credentials can act as
+	// the user.
+	CredentialedOrigins []string
+	AllowedMethods      []string
+	// AllowedHeaders are the request headers allowed in preflight requests. "*" allows any header.
+	AllowedHeaders []string
+	ExposedHeaders []string
+	// MaxAge is how long browsers may cache preflight responses.
+	MaxAge time.Duration
+}
+
+// DefaultCORSPolicy allows any origin to read the API without credentials.
+func DefaultCORSPolicy() *CORSPolicy {
+	return &CORSPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Range"},
+		ExposedHeaders: []string{"Content-Length", "Content-Disposition", "ETag", "X-Request-ID", "X-Public-After"},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+// CORSHandler sets the CORS headers of Policy on every response and answers OPTIONS requests,
+// so the handlers it wraps don't need to.
+type CORSHandler struct {
+	Handler http.Handler
+	// Policy is optional and defaults to DefaultCORSPolicy.
+	Policy *CORSPolicy
+}
+
+func (h *CORSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	policy := h.Policy
+	if policy == nil {
+		policy = DefaultCORSPolicy()
+	}
+	originAllowed := policy.setHeaders(w, r)
+
+	if r.Method == http.MethodOptions {
+		policy.handleOptions(w, r, originAllowed)
+		return
+	}
+
+	h.Handler.ServeHTTP(w, r)
+}
+
+// ParseCORSOrigins parses a comma separated list of origins, such as https://portal.sagecontinuum.org.
+func ParseCORSOrigins(s string) ([]string, error) {
+	origins := splitList(s)
+	for i, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid origin %q", origin)
+		}
+		origins[i] = strings.ToLower(u.Scheme + "://" + u.Host)
+	}
+	return origins, nil
+}
+
+// setHeaders sets the CORS headers for a response to r. It returns false if the request's
+// origin is not allowed.
+func (p *CORSPolicy) setHeaders(w http.ResponseWriter, r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+
+	// the response depends on the origin unless every origin gets the same response.
+	if len(p.CredentialedOrigins) > 0 || !p.allowsAnyOrigin() {
+		w.Header().Add("Vary", "Origin")
+	}
+
+	switch {
+	case origin != "" && containsString(p.CredentialedOrigins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	case p.allowsAnyOrigin():
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && containsString(p.AllowedOrigins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	default:
+		return false
+	}
+
+	if len(p.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+	return true
+}
+
+// handleOptions responds to an OPTIONS request. Preflight requests get the allowed methods
+// and headers if setHeaders allowed their origin.
+func (p *CORSPolicy) handleOptions(w http.ResponseWriter, r *http.Request, originAllowed bool) {
+	w.Header().Set("Allow", strings.Join(p.AllowedMethods, ", "))
+
+	requestMethod := r.Header.Get("Access-Control-Request-Method")
+
+	if originAllowed && requestMethod != "" && containsString(p.AllowedMethods, requestMethod) {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+		if headers := p.allowedRequestHeaders(r); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		if p.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *CORSPolicy) allowedRequestHeaders(r *http.Request) string {
+	// "*" is not treated as a wildcard for credentialed requests, so echo the requested headers.
+	if containsString(p.AllowedHeaders, "*") {
+		return r.Header.Get("Access-Control-Request-Headers")
+	}
+	return strings.Join(p.AllowedHeaders, ", ")
+}
+
+func (p *CORSPolicy) allowsAnyOrigin() bool {
+	return containsString(p.AllowedOrigins, "*")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORSPolicyOrigins(t *testing.T) {
+	policy := &CORSPolicy{
+		AllowedOrigins:      []string{"https://example.org"},
+		CredentialedOrigins: []string{"https://portal.sagecontinuum.org"},
+		ExposedHeaders:      []string{"ETag"},
+	}
+
+	testcases := map[string]struct {
+		Origin           string
+		Allowed          bool
+		AllowOrigin      string
+		AllowCredentials string
+	}{
+		"Allowed":              {"https://example.org", true, "https://example.org", ""},
+		"AllowedCase":          {"https://Example.org", true, "https://Example.org", ""},
+		"Credentialed":         {"https://portal.sagecontinuum.org", true, "https://portal.sagecontinuum.org", "true"},
+		"NotAllowed":           {"https://evil.example.com", false, "", ""},
+		"NotAllowedSubdomain":  {"https://evil.portal.sagecontinuum.org", false, "", ""},
+		"NotAllowedWithScheme": {"http://portal.sagecontinuum.org", false, "", ""},
+		"NoOrigin":             {"", false, "", ""},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.Origin != "" {
+				r.Header.Set("Origin", tc.Origin)
+			}
+			w := httptest.NewRecorder()
+
+			if allowed := policy.setHeaders(w, r); allowed != tc.Allowed {
+				t.Fatalf("incorrect allowed. got %v want %v", allowed, tc.Allowed)
+			}
+			if s := w.Header().Get("Access-Control-Allow-Origin"); s != tc.AllowOrigin {
+				t.Fatalf("incorrect allow origin. got %q want %q", s, tc.AllowOrigin)
+			}
+			if s := w.Header().Get("Access-Control-Allow-Credentials"); s != tc.AllowCredentials {
+				t.Fatalf("incorrect allow credentials. got %q want %q", s, tc.AllowCredentials)
+			}
+			if w.Header().Get("Vary") != "Origin" {
+				t.Fatalf("expected response to vary by origin")
+			}
+			if exposed := w.Header().Get("Access-Control-Expose-Headers"); tc.Allowed != (exposed == "ETag") {
+				t.Fatalf("incorrect exposed headers. got %q", exposed)
+			}
+		})
+	}
+}
+
+func TestCORSPolicyPreflight(t *testing.T) {
+	policy := &CORSPolicy{
+		AllowedOrigins:      []string{"https://example.org"},
+		CredentialedOrigins: []string{"https://portal.sagecontinuum.org"},
+		AllowedMethods:      []string{http.MethodGet, http.MethodOptions},
+		AllowedHeaders:      []string{"*"},
+		MaxAge:              time.Hour,
+	}
+
+	testcases := map[string]struct {
+		Origin       string
+		Method       string
+		AllowMethods string
+		AllowHeaders string
+		MaxAge       string
+	}{
+		"Allowed":          {"https://example.org", http.MethodGet, "GET, OPTIONS", "Authorization", "3600"},
+		"Credentialed":     {"https://portal.sagecontinuum.org", http.MethodGet, "GET, OPTIONS", "Authorization", "3600"},
+		"MethodNotAllowed": {"https://example.org", http.MethodDelete, "", "", ""},
+		"OriginNotAllowed": {"https://evil.example.com", http.MethodGet, "", "", ""},
+		"NotPreflight":     {"https://example.org", "", "", "", ""},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodOptions, "/", nil)
+			r.Header.Set("Origin", tc.Origin)
+			if tc.Method != "" {
+				r.Header.Set("Access-Control-Request-Method", tc.Method)
+			}
+			r.Header.Set("Access-Control-Request-Headers", "Authorization")
+			w := httptest.NewRecorder()
+
+			policy.handleOptions(w, r, policy.setHeaders(w, r))
+			resp := w.Result()
+
+			assertStatusCode(t, resp, http.StatusNoContent)
+			if s := resp.Header.Get("Allow"); s != "GET, OPTIONS" {
+				t.Fatalf("incorrect allow. got %q", s)
+			}
+			if s := resp.Header.Get("Access-Control-Allow-Methods"); s != tc.AllowMethods {
+				t.Fatalf("incorrect allow methods. got %q want %q", s, tc.AllowMethods)
+			}
+			if s := resp.Header.Get("Access-Control-Allow-Headers"); s != tc.AllowHeaders {
+				t.Fatalf("incorrect allow headers. got %q want %q", s, tc.AllowHeaders)
+			}
+			if s := resp.Header.Get("Access-Control-Max-Age"); s != tc.MaxAge {
+				t.Fatalf("incorrect max age. got %q want %q", s, tc.MaxAge)
+			}
+		})
+	}
+}
+
+func TestCORSHandlerHeaders(t *testing.T) {
+	handler := &CORSHandler{
+		Handler: &StorageHandler{
+			Storage:       &mockStorage{},
+			Authenticator: &mockAuthenticator{true},
+		},
+	}
+
+	for _, method := range testMethods {
+		resp := getResponse(t, handler, method, randomURL())
+
+		allowOrigin := resp.Header.Get("Access-Control-Allow-Origin")
+		if allowOrigin != "*" {
+			t.Fatalf("Access-Control-Allow-Origin must be *. got %q", allowOrigin)
+		}
+
+		exposeHeaders := resp.Header.Get("Access-Control-Expose-Headers")
+		if !strings.Contains(exposeHeaders, "Content-Disposition") {
+			t.Fatalf("Content-Disposition must be exposed. got %q", exposeHeaders)
+		}
+	}
+
+	r, _ := http.NewRequest(http.MethodOptions, randomURL(), nil)
+	r.Header.Set("Origin", "https://example.org")
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	resp := w.Result()
+
+	assertStatusCode(t, resp, http.StatusNoContent)
+
+	methods := strings.Split(resp.Header.Get("Access-Control-Allow-Methods"), ", ")
+	sort.Strings(methods)
+	if strings.Join(methods, ",") != "GET,HEAD,OPTIONS,PUT" {
+		t.Fatalf("allow methods must be GET, HEAD, OPTIONS and PUT. got %v", methods)
+	}
+	if resp.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("incorrect max age. got %q", resp.Header.Get("Access-Control-Max-Age"))
+	}
+}
+
+func TestCORSHandlerCredentials(t *testing.T) {
+	handler := &CORSHandler{
+		Handler: &StorageHandler{
+			Storage:       &mockStorage{files: map[string][]byte{"job/task/node/1643842551600000000-sample.jpg": randomContent()}},
+			Authenticator: &mockAuthenticator{true},
+		},
+		Policy: &CORSPolicy{
+			AllowedOrigins:      []string{"*"},
+			CredentialedOrigins: []string{"https://portal.sagecontinuum.org"},
+			AllowedMethods:      []string{http.MethodGet, http.MethodHead, http.MethodOptions},
+		},
+	}
+
+	testcases := map[string]struct {
+		Origin           string
+		AllowOrigin      string
+		AllowCredentials string
+	}{
+		"Credentialed": {"https://portal.sagecontinuum.org", "https://portal.sagecontinuum.org", "true"},
+		"Other":        {"https://example.org", "*", ""},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "job/task/node/1643842551600000000-sample.jpg", nil)
+			r.Header.Set("Origin", tc.Origin)
+			r.SetBasicAuth("user", "secret")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			resp := w.Result()
+
+			assertStatusCode(t, resp, http.StatusTemporaryRedirect)
+			if s := resp.Header.Get("Access-Control-Allow-Origin"); s != tc.AllowOrigin {
+				t.Fatalf("incorrect allow origin. got %q want %q", s, tc.AllowOrigin)
+			}
+			if s := resp.Header.Get("Access-Control-Allow-Credentials"); s != tc.AllowCredentials {
+				t.Fatalf("incorrect allow credentials. got %q want %q", s, tc.AllowCredentials)
+			}
+			if resp.Header.Get("Vary") != "Origin" {
+				t.Fatalf("expected response to vary by origin")
+			}
+		})
+	}
+}
+
+func TestParseCORSOrigins(t *testing.T) {
+	origins, err := ParseCORSOrigins("https://Portal.sagecontinuum.org/, *, http://localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(origins) != 3 || origins[0] != "https://portal.sagecontinuum.org" || origins[1] != "*" || origins[2] != "http://localhost:3000" {
+		t.Fatalf("incorrect origins: %v", origins)
+	}
+
+	for _, s := range []string{"portal.sagecontinuum.org", "ftp://example.org", "https://example.org/path", "https://"} {
+		if _, err := ParseCORSOrigins(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// isPasswordHash returns whether s is a bcrypt or argon2id hash rather than a plaintext password.
+func isPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$") || strings.HasPrefix(s, "$argon2id$")
+}
+
+// verifyPasswordHash checks password against a bcrypt or argon2id hash in PHC string format.
+func verifyPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2idHash(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// argon2id parameter limits. Hashes outside them are rejected when credentials are loaded, as
+// verifying a password would panic, use excessive memory or accept any password.
+const (
+	maxArgon2Memory     = 256 * 1024 // KiB
+	maxArgon2Iterations = 16
+	minArgon2KeyLength  = 16
+)
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// parseArgon2idHash parses an argon2id hash in PHC string format and checks its parameters.
+func parseArgon2idHash(hash string) (*argon2idHash, error) {
+	// format is $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("invalid argon2id hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version")
+	}
+
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	switch {
+	case h.memory < 1 || h.memory > maxArgon2Memory:
+		return nil, fmt.Errorf("argon2id memory must be between 1 and %d KiB", maxArgon2Memory)
+	case h.iterations < 1 || h.iterations > maxArgon2Iterations:
+		return nil, fmt.Errorf("argon2id iterations must be between 1 and %d", maxArgon2Iterations)
+	case h.parallelism < 1:
+		return nil, fmt.Errorf("argon2id parallelism must be at least 1")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id key")
+	}
+	if len(h.key) < minArgon2KeyLength {
+		return nil, fmt.Errorf("argon2id key must be at least %d bytes", minArgon2KeyLength)
+	}
+	return h, nil
+}
+
+func verifyArgon2idHash(hash, password string) bool {
+	h, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(h.key, other) == 1
+}
+
+// validatePasswordHash checks that a bcrypt or argon2id hash is well formed, so bad hashes are
+// rejected when credentials are loaded rather than when they are used.
+func validatePasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, err := parseArgon2idHash(hash)
+		return err
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+// ReadCredentialsFile reads credentials from a JSON file containing a list of objects with
+// username, password or hash, and optional label and expires fields.
+func ReadCredentialsFile(path string) ([]*Credential, error) {
+	type fileItem struct {
+		Username string     `json:"username"`
+		Password string     `json:"password"`
+		Hash     string     `json:"hash"`
+		Label    string     `json:"label"`
+		Expires  *time.Time `json:"expires"`
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []fileItem
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&items); err != nil {
+		return nil, fmt.Errorf("error when reading credentials file: %s", err)
+	}
+
+	credentials := []*Credential{}
+
+	for i, item := range items {
+		if item.Username == "" {
+			return nil, fmt.Errorf("credential %d: username must be nonempty", i)
+		}
+		if (item.Password == "") == (item.Hash == "") {
+			return nil, fmt.Errorf("credential %d: exactly one of password or hash must be set", i)
+		}
+		if item.Hash != "" && !isPasswordHash(item.Hash) {
+			return nil, fmt.Errorf("credential %d: hash must be bcrypt or argon2id", i)
+		}
+		if item.Hash != "" {
+			if err := validatePasswordHash(item.Hash); err != nil {
+				return nil, fmt.Errorf("credential %d: %s", i, err)
+			}
+		}
+		credentials = append(credentials, &Credential{
+			Username: item.Username,
+			Password: item.Password,
+			Hash:     item.Hash,
+			Label:    item.Label,
+			Expires:  item.Expires,
+		})
+	}
+
+	return credentials, nil
+}
+
+// CredentialsLoader loads static credentials, in the authStaticCredentials format, and an
+// optional credentials file.
+type CredentialsLoader struct {
+	Static string
+	Path   string
+}
+
+// Load returns the combined static and file credentials.
+func (l *CredentialsLoader) Load() ([]*Credential, error) {
+	credentials, err := ParseStaticCredentials(l.Static)
+	if err != nil {
+		return nil, err
+	}
+	if l.Path == "" {
+		return credentials, nil
+	}
+	fileCredentials, err := ReadCredentialsFile(l.Path)
+	if err != nil {
+		return nil, err
+	}
+	return append(credentials, fileCredentials...), nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPasswordHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to generate bcrypt hash: %s", err)
+	}
+
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32)
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	for _, hash := range []string{string(bcryptHash), argon2Hash} {
+		if !isPasswordHash(hash) {
+			t.Fatalf("expected %q to be recognized as a hash", hash)
+		}
+		if !verifyPasswordHash(hash, "secret") {
+			t.Fatalf("expected %q to verify correct password", hash)
+		}
+		if verifyPasswordHash(hash, "wrong") {
+			t.Fatalf("expected %q to reject incorrect password", hash)
+		}
+	}
+
+	if verifyPasswordHash("$argon2id$v=19$m=1024,t=1,p=1$invalid", "secret") {
+		t.Fatalf("expected malformed argon2id hash to be rejected")
+	}
+}
+
+func TestMatchCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to generate bcrypt hash: %s", err)
+	}
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	credentials := []*Credential{
+		{Username: "plain", Password: "secret"},
+		{Username: "hashed", Hash: string(hash)},
+		{Username: "expired", Password: "secret", Expires: &past},
+		{Username: "unexpired", Password: "secret", Expires: &future},
+	}
+
+	testcases := map[string]struct {
+		Username string
+		Password string
+		Match    bool
+	}{
+		"plain":            {"plain", "secret", true},
+		"plainWrong":       {"plain", "wrong", false},
+		"hashed":           {"hashed", "hashed-secret", true},
+		"hashedWrong":      {"hashed", "wrong", false},
+		"hashedAsPassword": {"hashed", string(hash), false},
+		"expired":          {"expired", "secret", false},
+		"unexpired":        {"unexpired", "secret", true},
+		"unknown":          {"unknown", "secret", false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if matchCredentials(credentials, tc.Username, tc.Password) != tc.Match {
+				t.Fatalf("incorrect match for %s. want: %v", tc.Username, tc.Match)
+			}
+		})
+	}
+}
+
+func TestParseStaticCredentialsHash(t *testing.T) {
+	credentials, err := ParseStaticCredentials("user:$2a$10$usN0cdgiTDCebAAjltrDJOyTFYhC0iln3tYgy4yQSw.H1JYVr/IiK")
+	if err != nil {
+		t.Fatalf("not expecting error but got %s", err)
+	}
+	if credentials[0].Password != "" || credentials[0].Hash == "" {
+		t.Fatalf("expected credential to be parsed as hash. got: %+v", credentials[0])
+	}
+
+	if _, err := ParseStaticCredentials("user:$argon2id$v=19$m=65536,t=0,p=4$MDEyMzQ1Njc4OWFiY2RlZg$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"); err == nil {
+		t.Fatalf("expected invalid argon2id parameters to be rejected")
+	}
+}
+
+func TestReadCredentialsFile(t *testing.T) {
+	testcases := map[string]struct {
+		Content     string
+		ExpectError bool
+		ExpectCount int
+	}{
+		"valid": {
+			Content: `[
+				{"username": "user1", "hash": "$2a$10$usN0cdgiTDCebAAjltrDJOyTFYhC0iln3tYgy4yQSw.H1JYVr/IiK", "label": "partner", "expires": "2030-01-01T00:00:00Z"},
+				{"username": "user2", "password": "secret"}
+			]`,
+			ExpectCount: 2,
+		},
+		"missingUsername": {Content: `[{"password": "secret"}]`, ExpectError: true},
+		"passwordAndHash": {Content: `[{"username": "user", "password": "secret", "hash": "$2a$10$abc"}]`, ExpectError: true},
+		"neitherSecret":   {Content: `[{"username": "user"}]`, ExpectError: true},
+		"unsupportedHash": {Content: `[{"username": "user", "hash": "md5:abc"}]`, ExpectError: true},
+		"unknownField":    {Content: `[{"username": "user", "password": "secret", "role": "admin"}]`, ExpectError: true},
+		"argon2id":        {Content: `[{"username": "user", "hash": "$argon2id$v=19$m=65536,t=3,p=4$MDEyMzQ1Njc4OWFiY2RlZg$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}]`, ExpectCount: 1},
+		"zeroIterations":  {Content: `[{"username": "user", "hash": "$argon2id$v=19$m=65536,t=0,p=4$MDEyMzQ1Njc4OWFiY2RlZg$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}]`, ExpectError: true},
+		"zeroParallelism": {Content: `[{"username": "user", "hash": "$argon2id$v=19$m=65536,t=3,p=0$MDEyMzQ1Njc4OWFiY2RlZg$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}]`, ExpectError: true},
+		"hugeMemory":      {Content: `[{"username": "user", "hash": "$argon2id$v=19$m=4294967295,t=3,p=4$MDEyMzQ1Njc4OWFiY2RlZg$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}]`, ExpectError: true},
+		"emptyKey":        {Content: `[{"username": "user", "hash": "$argon2id$v=19$m=65536,t=3,p=4$MDEyMzQ1Njc4OWFiY2RlZg$"}]`, ExpectError: true},
+		"malformedBcrypt": {Content: `[{"username": "user", "hash": "$2a$10$abc"}]`, ExpectError: true},
+		"invalidJSON":     {Content: `user:secret`, ExpectError: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials.json")
+			if err := os.WriteFile(path, []byte(tc.Content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			credentials, err := ReadCredentialsFile(path)
+			if tc.ExpectError && err == nil {
+				t.Fatalf("expecting error but got none")
+			}
+			if !tc.ExpectError && err != nil {
+				t.Fatalf("not expecting error but got %s", err)
+			}
+			if len(credentials) != tc.ExpectCount {
+				t.Fatalf("incorrect number of credentials. got: %d want: %d", len(credentials), tc.ExpectCount)
+			}
+		})
+	}
+}
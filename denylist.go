@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// DenylistEntry blocks access to all files matching every nonempty field. Blocked files are
+// unavailable to everyone, including users with credentials.
+type DenylistEntry struct {
+	ID string `json:"id"`
+	// Prefix matches the start of the file path {job}/{task}/{node}/{filename}.
+	Prefix string `json:"prefix,omitempty"`
+	NodeID string `json:"node_id,omitempty"`
+	// Start and End match file timestamps in the range [Start, End).
+	Start     *time.Time `json:"start,omitempty"`
+	End       *time.Time `json:"end,omitempty"`
+	Reason    string     `json:"reason"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Matches returns whether the entry blocks the given file.
+func (e *DenylistEntry) Matches(f *StorageFile) bool {
+	if e.Prefix != "" && !strings.HasPrefix(storageFilePath(f), e.Prefix) {
+		return false
+	}
+	if e.NodeID != "" && e.NodeID != f.NodeID {
+		return false
+	}
+	if e.Start != nil && f.Timestamp.Before(*e.Start) {
+		return false
+	}
+	if e.End != nil && !f.Timestamp.Before(*e.End) {
+		return false
+	}
+	return true
+}
+
+func (e *DenylistEntry) validate() error {
+	if e.Prefix == "" && e.NodeID == "" && e.Start == nil && e.End == nil {
+		return fmt.Errorf("entry must set at least one of prefix, node_id, start or end")
+	}
+	if e.Start != nil && e.End != nil && !e.Start.Before(*e.End) {
+		return fmt.Errorf("start must be before end")
+	}
+	if e.Reason == "" {
+		return fmt.Errorf("reason must be nonempty")
+	}
+	return nil
+}
+
+// DenylistAuditRecord records a change made to the denylist.
+type DenylistAuditRecord struct {
+	Time   time.Time      `json:"time"`
+	Action string         `json:"action"`
+	Actor  string         `json:"actor"`
+	Entry  *DenylistEntry `json:"entry"`
+}
+
+type denylistDocument struct {
+	Entries []*DenylistEntry       `json:"entries"`
+	Audit   []*DenylistAuditRecord `json:"audit"`
+}
+
+// maxDenylistAudit is the number of audit records kept in the denylist document. Older records
+// are dropped, but every change is also written to the service log.
+const maxDenylistAudit = 1000
+
+// maxDenylistWriteAttempts is how often an update is retried when another replica changed the
+// document at the same time.
+const maxDenylistWriteAttempts = 5
+
+// DenylistStore persists the denylist document. Read returns the document and an opaque version
+// of it, and must return an error wrapping fs.ErrNotExist if nothing has been stored yet. Write
+// must fail with errDenylistConflict unless the stored document is still at version, where an
+// empty version means nothing has been stored yet.
+type DenylistStore interface {
+	Read(ctx context.Context) ([]byte, string, error)
+	Write(ctx context.Context, b []byte, version string) error
+}
+
+var errDenylistConflict = errors.New("denylist was changed concurrently")
+
+// Denylist holds the set of blocked files. It is kept in sync with a DenylistStore so
+// changes made on one replica are picked up by the others.
+type Denylist struct {
+	Store  DenylistStore
+	Logger *log.Logger
+
+	doc *denylistDocument
+	mu  sync.RWMutex
+	// writeMu serializes read-modify-write updates to the store.
+	writeMu sync.Mutex
+}
+
+// NewDenylist creates a Denylist backed by store. Call Reload to load its initial contents.
+func NewDenylist(store DenylistStore, logger *log.Logger) *Denylist {
+	return &Denylist{
+		Store:  store,
+		Logger: logger,
+		doc:    &denylistDocument{},
+	}
+}
+
+// Blocked returns the first entry blocking f, if any.
+func (d *Denylist) Blocked(f *StorageFile) (*DenylistEntry, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, e := range d.doc.Entries {
+		if e.Matches(f) {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Entries returns the current entries and audit trail.
+func (d *Denylist) Entries() ([]*DenylistEntry, []*DenylistAuditRecord) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]*DenylistEntry{}, d.doc.Entries...), append([]*DenylistAuditRecord{}, d.doc.Audit...)
+}
+
+// Reload replaces the in-memory denylist with the stored one.
+func (d *Denylist) Reload(ctx context.Context) error {
+	doc, _, err := d.read(ctx)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.doc = doc
+	d.mu.Unlock()
+	return nil
+}
+
+// Watch periodically reloads the denylist until ctx is done.
+func (d *Denylist) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := d.Reload(ctx); err != nil {
+			d.log("failed to reload denylist: %s", err.Error())
+		}
+	}
+}
+
+// Add validates and adds an entry, persisting it before it takes effect.
+func (d *Denylist) Add(ctx context.Context, e *DenylistEntry, actor string) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	id, err := newDenylistID()
+	if err != nil {
+		return err
+	}
+	e.ID = id
+	e.CreatedBy = actor
+	e.CreatedAt = time.Now()
+
+	err = d.update(ctx, func(doc *denylistDocument) error {
+		doc.Entries = append(doc.Entries, e)
+		doc.Audit = append(doc.Audit, &DenylistAuditRecord{Time: e.CreatedAt, Action: "add", Actor: actor, Entry: e})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.log("denylist: %s added entry %s: prefix=%q node=%q reason=%q", actor, e.ID, e.Prefix, e.NodeID, e.Reason)
+	return nil
+}
+
+// Remove deletes an entry by ID.
+func (d *Denylist) Remove(ctx context.Context, id string, actor string) error {
+	err := d.update(ctx, func(doc *denylistDocument) error {
+		for i, e := range doc.Entries {
+			if e.ID == id {
+				doc.Entries = append(doc.Entries[:i], doc.Entries[i+1:]...)
+				doc.Audit = append(doc.Audit, &DenylistAuditRecord{Time: time.Now(), Action: "remove", Actor: actor, Entry: e})
+				return nil
+			}
+		}
+		return errDenylistEntryNotFound
+	})
+	if err != nil {
+		return err
+	}
+	d.log("denylist: %s removed entry %s", actor, id)
+	return nil
+}
+
+var errDenylistEntryNotFound = errors.New("denylist entry not found")
+
+// update applies fn to the latest stored document, writes it back and then makes it active. If
+// another replica wrote the document in the meantime, fn is applied again to its version.
+func (d *Denylist) update(ctx context.Context, fn func(doc *denylistDocument) error) error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		doc, version, err := d.read(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+		if n := len(doc.Audit); n > maxDenylistAudit {
+			doc.Audit = doc.Audit[n-maxDenylistAudit:]
+		}
+		b, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = d.Store.Write(ctx, b, version)
+		if errors.Is(err, errDenylistConflict) && attempt < maxDenylistWriteAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write denylist: %s", err.Error())
+		}
+
+		d.mu.Lock()
+		d.doc = doc
+		d.mu.Unlock()
+		return nil
+	}
+}
+
+func (d *Denylist) read(ctx context.Context) (*denylistDocument, string, error) {
+	doc := &denylistDocument{}
+	b, version, err := d.Store.Read(ctx)
+	if errors.Is(err, fs.ErrNotExist) {
+		return doc, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read denylist: %s", err.Error())
+	}
+	if err := json.Unmarshal(b, doc); err != nil {
+		return nil, "", fmt.Errorf("failed to parse denylist: %s", err.Error())
+	}
+	return doc, version, nil
+}
+
+func (d *Denylist) log(format string, v ...interface{}) {
+	if d.Logger == nil {
+		return
+	}
+	d.Logger.Printf(format, v...)
+}
+
+func newDenylistID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func storageFilePath(f *StorageFile) string {
+	return strings.Join([]string{f.JobID, f.TaskID, f.NodeID, f.Filename}, "/")
+}
+
+// FileDenylistStore stores the denylist in a local file. Writers hold the lock file Path.lock
+// while they check the version and replace the file. The version is a hash of the contents.
+type FileDenylistStore struct {
+	Path string
+}
+
+// staleDenylistLock is the age after which a lock file is assumed to be left behind by a writer
+// which exited without removing it.
+const staleDenylistLock = 30 * time.Second
+
+func (s *FileDenylistStore) Read(ctx context.Context) ([]byte, string, error) {
+	b, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, fileDenylistVersion(b), nil
+}
+
+func (s *FileDenylistStore) Write(ctx context.Context, b []byte, version string) error {
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := os.ReadFile(s.Path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if version != "" {
+			return errDenylistConflict
+		}
+	case err != nil:
+		return err
+	case fileDenylistVersion(current) != version:
+		return errDenylistConflict
+	}
+
+	// write to a temp file and rename, so readers never see a partial file.
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".denylist-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// lock creates the lock file, waiting for other writers to release it.
+func (s *FileDenylistStore) lock(ctx context.Context) (func(), error) {
+	path := s.Path + ".lock"
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleDenylistLock {
+			os.Remove(path)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func fileDenylistVersion(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// S3DenylistStore stores the denylist as an S3 object. Writes are conditional on the object's
+// ETag, so concurrent updates from other replicas are not lost.
+type S3DenylistStore struct {
+	S3     s3iface.S3API
+	Bucket string
+	Key    string
+}
+
+func (s *S3DenylistStore) Read(ctx context.Context) ([]byte, string, error) {
+	resp, err := s.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", fs.ErrNotExist
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, aws.StringValue(resp.ETag), nil
+}
+
+func (s *S3DenylistStore) Write(ctx context.Context, b []byte, version string) error {
+	// the SDK predates conditional writes, so the headers are set directly.
+	condition := map[string]string{"If-Match": version}
+	if version == "" {
+		condition = map[string]string{"If-None-Match": "*"}
+	}
+	_, err := s.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.Key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	}, request.WithSetRequestHeaders(condition))
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		// 409 is returned when a concurrent conditional write is in progress.
+		if rerr.StatusCode() == http.StatusPreconditionFailed || rerr.StatusCode() == http.StatusConflict {
+			return errDenylistConflict
+		}
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// DenylistHandler serves the admin API for managing the denylist. Requests are expected
+// to have the /api/v1/admin/denylist prefix stripped, so the path is either empty or an entry ID.
+type DenylistHandler struct {
+	Denylist         *Denylist
+	AdminCredentials []*Credential
+	// LoginLimiter is optional and locks out clients after repeated failed logins.
+	LoginLimiter *LoginLimiter
+	Logger       *log.Logger
+}
+
+func (h *DenylistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := checkBasicAuth(w, r, h.LoginLimiter, func(username, password string) bool {
+		return matchCredentials(h.AdminCredentials, username, password)
+	})
+	if !ok {
+		h.log("%s %s -> %s: admin not authorized", r.Method, r.URL, r.RemoteAddr)
+		return
+	}
+
+	id := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		h.handleList(w, r)
+	case id == "" && r.Method == http.MethodPost:
+		h.handleAdd(w, r, username)
+	case id != "" && r.Method == http.MethodDelete:
+		h.handleRemove(w, r, id, username)
+	default:
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
+
+func (h *DenylistHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Entries []*DenylistEntry       `json:"entries"`
+		Audit   []*DenylistAuditRecord `json:"audit"`
+	}
+
+	entries, audit := h.Denylist.Entries()
+
+	respondJSON(w, http.StatusOK, &response{
+		Entries: entries,
+		Audit:   audit,
+	})
+}
+
+func (h *DenylistHandler) handleAdd(w http.ResponseWriter, r *http.Request, actor string) {
+	var entry DenylistEntry
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entry); err != nil {
+		respondJSONError(w, http.StatusBadRequest, "invalid denylist entry: %s", err.Error())
+		return
+	}
+
+	if err := entry.validate(); err != nil {
+		respondJSONError(w, http.StatusBadRequest, "invalid denylist entry: %s", err.Error())
+		return
+	}
+
+	if err := h.Denylist.Add(r.Context(), &entry, actor); err != nil {
+		h.log("%s %s -> %s: failed to add denylist entry: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "failed to add denylist entry")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, &entry)
+}
+
+func (h *DenylistHandler) handleRemove(w http.ResponseWriter, r *http.Request, id string, actor string) {
+	err := h.Denylist.Remove(r.Context(), id, actor)
+	if err == errDenylistEntryNotFound {
+		respondJSONError(w, http.StatusNotFound, "denylist entry not found")
+		return
+	}
+	if err != nil {
+		h.log("%s %s -> %s: failed to remove denylist entry: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "failed to remove denylist entry")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *DenylistHandler) log(format string, v ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Printf(format, v...)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDenylistHandler(t *testing.T) {
+	denylist := NewDenylist(&FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}, nil)
+	handler := &DenylistHandler{
+		Denylist:         denylist,
+		AdminCredentials: []*Credential{{Username: "admin", Password: "secret"}},
+	}
+
+	do := func(method, url, body, username, password string) *http.Response {
+		r := httptest.NewRequest(method, "/"+url, strings.NewReader(body))
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assertStatusCode(t, do(http.MethodGet, "", "", "", ""), http.StatusUnauthorized)
+	assertStatusCode(t, do(http.MethodGet, "", "", "admin", "wrong"), http.StatusUnauthorized)
+
+	assertStatusCode(t, do(http.MethodPost, "", `{"node_id": "node"}`, "admin", "secret"), http.StatusBadRequest)
+	assertStatusCode(t, do(http.MethodPost, "", `{"unknown": "field"}`, "admin", "secret"), http.StatusBadRequest)
+
+	resp := do(http.MethodPost, "", `{"prefix": "sage/imagesampler-bottom/", "reason": "faces captured"}`, "admin", "secret")
+	assertStatusCode(t, resp, http.StatusCreated)
+
+	var entry DenylistEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		t.Fatalf("failed to decode entry: %s", err)
+	}
+	if entry.ID == "" || entry.CreatedBy != "admin" {
+		t.Fatalf("entry must have an id and creator. got: %+v", entry)
+	}
+
+	storageHandler := &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: &mockAuthenticator{true},
+		Denylist:      denylist,
+	}
+	for _, method := range testMethods {
+		resp := getResponse(t, storageHandler, method, "sage/imagesampler-bottom/node/1643842551600000001-sample.jpg")
+		assertStatusCode(t, resp, http.StatusUnavailableForLegalReasons)
+	}
+
+	assertStatusCode(t, do(http.MethodDelete, "missing", "", "admin", "secret"), http.StatusNotFound)
+	assertStatusCode(t, do(http.MethodDelete, entry.ID, "", "admin", "secret"), http.StatusNoContent)
+
+	resp = getResponse(t, storageHandler, http.MethodGet, "sage/imagesampler-bottom/node/1643842551600000001-sample.jpg")
+	assertStatusCode(t, resp, http.StatusTemporaryRedirect)
+
+	// failed logins count towards the lockout.
+	handler.LoginLimiter = NewLoginLimiter()
+	for i := 0; i < handler.LoginLimiter.Threshold; i++ {
+		assertStatusCode(t, do(http.MethodGet, "", "", "admin", "wrong"), http.StatusUnauthorized)
+	}
+	assertStatusCode(t, do(http.MethodGet, "", "", "admin", "secret"), http.StatusTooManyRequests)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDenylistEntryMatches(t *testing.T) {
+	start := time.Unix(0, 1643842551600000000)
+	end := start.Add(time.Hour)
+
+	file := &StorageFile{
+		JobID:     "sage",
+		TaskID:    "imagesampler-bottom",
+		NodeID:    "000048b02d15bc7c",
+		Filename:  "1643842551600000001-sample.jpg",
+		Timestamp: time.Unix(0, 1643842551600000001),
+	}
+
+	testcases := map[string]struct {
+		Entry   *DenylistEntry
+		Matches bool
+	}{
+		"exactFile":      {&DenylistEntry{Prefix: "sage/imagesampler-bottom/000048b02d15bc7c/1643842551600000001-sample.jpg"}, true},
+		"otherFile":      {&DenylistEntry{Prefix: "sage/imagesampler-bottom/000048b02d15bc7c/1643842551600000002-sample.jpg"}, false},
+		"taskPrefix":     {&DenylistEntry{Prefix: "sage/imagesampler-"}, true},
+		"otherTask":      {&DenylistEntry{Prefix: "sage/imagesampler-top/"}, false},
+		"node":           {&DenylistEntry{NodeID: "000048b02d15bc7c"}, true},
+		"otherNode":      {&DenylistEntry{NodeID: "000048b02d05a0a4"}, false},
+		"inRange":        {&DenylistEntry{NodeID: "000048b02d15bc7c", Start: &start, End: &end}, true},
+		"afterRange":     {&DenylistEntry{Start: &end}, false},
+		"beforeRange":    {&DenylistEntry{End: &start}, false},
+		"startInclusive": {&DenylistEntry{Start: &file.Timestamp}, true},
+		"endExclusive":   {&DenylistEntry{End: &file.Timestamp}, false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if tc.Entry.Matches(file) != tc.Matches {
+				t.Fatalf("incorrect match for %+v. want: %v", tc.Entry, tc.Matches)
+			}
+		})
+	}
+}
+
+func TestDenylistAddRemove(t *testing.T) {
+	ctx := context.Background()
+	store := &FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}
+
+	denylist := NewDenylist(store, nil)
+	if err := denylist.Reload(ctx); err != nil {
+		t.Fatalf("reload of missing denylist should succeed. got: %s", err)
+	}
+
+	file := &StorageFile{JobID: "sage", TaskID: "imagesampler-bottom", NodeID: "node", Filename: "1-sample.jpg", Timestamp: time.Unix(0, 1)}
+
+	if _, blocked := denylist.Blocked(file); blocked {
+		t.Fatalf("empty denylist should not block files")
+	}
+
+	entry := &DenylistEntry{Prefix: "sage/imagesampler-bottom/", Reason: "faces captured"}
+	if err := denylist.Add(ctx, entry, "admin"); err != nil {
+		t.Fatalf("failed to add entry: %s", err)
+	}
+
+	if _, blocked := denylist.Blocked(file); !blocked {
+		t.Fatalf("file should be blocked immediately after add")
+	}
+
+	// another replica sharing the store should see the entry after reloading.
+	replica := NewDenylist(store, nil)
+	if err := replica.Reload(ctx); err != nil {
+		t.Fatalf("failed to reload: %s", err)
+	}
+	if _, blocked := replica.Blocked(file); !blocked {
+		t.Fatalf("file should be blocked on replica after reload")
+	}
+
+	if err := denylist.Remove(ctx, "missing", "admin"); err != errDenylistEntryNotFound {
+		t.Fatalf("expected not found error. got: %v", err)
+	}
+	if err := denylist.Remove(ctx, entry.ID, "admin"); err != nil {
+		t.Fatalf("failed to remove entry: %s", err)
+	}
+	if _, blocked := denylist.Blocked(file); blocked {
+		t.Fatalf("file should not be blocked after remove")
+	}
+
+	_, audit := denylist.Entries()
+	if len(audit) != 2 || audit[0].Action != "add" || audit[1].Action != "remove" || audit[1].Actor != "admin" {
+		t.Fatalf("incorrect audit trail: %+v", audit)
+	}
+}
+
+func TestDenylistAddInvalid(t *testing.T) {
+	denylist := NewDenylist(&FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}, nil)
+	if err := denylist.Add(context.Background(), &DenylistEntry{Reason: "blocks everything"}, "admin"); err == nil {
+		t.Fatalf("expected error for entry without constraints")
+	}
+	if err := denylist.Add(context.Background(), &DenylistEntry{NodeID: "node"}, "admin"); err == nil {
+		t.Fatalf("expected error for entry without reason")
+	}
+}
+
+func TestDenylistAuditCapped(t *testing.T) {
+	ctx := context.Background()
+	store := &FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}
+
+	doc := &denylistDocument{}
+	for i := 0; i < maxDenylistAudit; i++ {
+		doc.Audit = append(doc.Audit, &DenylistAuditRecord{Action: "add", Actor: fmt.Sprintf("admin%d", i)})
+	}
+	b, _ := json.Marshal(doc)
+	if err := os.WriteFile(store.Path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	denylist := NewDenylist(store, nil)
+	if err := denylist.Add(ctx, &DenylistEntry{NodeID: "node", Reason: "test"}, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, audit := denylist.Entries()
+	if len(audit) != maxDenylistAudit || audit[0].Actor != "admin1" || audit[len(audit)-1].Actor != "latest" {
+		t.Fatalf("expected the oldest audit record to be dropped. got %d records", len(audit))
+	}
+}
+
+func TestDenylistConcurrentReplicas(t *testing.T) {
+	ctx := context.Background()
+	store := &FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// each replica has its own Denylist, so only the store keeps them from racing.
+			replica := NewDenylist(store, nil)
+			if err := replica.Add(ctx, &DenylistEntry{NodeID: fmt.Sprintf("node%d", i), Reason: "test"}, "admin"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	denylist := NewDenylist(store, nil)
+	if err := denylist.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := denylist.Entries(); len(entries) != 5 {
+		t.Fatalf("expected all entries to be kept. got: %d", len(entries))
+	}
+}
+
+func TestFileDenylistStoreConflict(t *testing.T) {
+	ctx := context.Background()
+	store := &FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}
+
+	if err := store.Write(ctx, []byte("{}"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, []byte("{}"), ""); err != errDenylistConflict {
+		t.Fatalf("expected conflict creating an existing denylist. got: %v", err)
+	}
+
+	_, version, err := store.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, []byte(`{"entries": []}`), version); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(ctx, []byte(`{}`), version); err != errDenylistConflict {
+		t.Fatalf("expected conflict writing a stale version. got: %v", err)
+	}
+}
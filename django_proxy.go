@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DjangoProxy forwards requests with authorization which can't be checked locally to the
+// Django downloads endpoint. The method, request headers, status, response headers and body are
+// passed through, so the client sees Django's response. Bodies are streamed in both directions.
+type DjangoProxy struct {
+	// URL is the downloads endpoint. The request path is appended to it.
+	URL *url.URL
+	// Timeout limits how long to wait for the response headers of each attempt. Response bodies
+	// are streamed without a time limit.
+	Timeout time.Duration
+	// Retries is the number of times requests without a body are retried after connection errors
+	// or 502, 503 and 504 responses.
+	Retries int
+	// RetryBackoff is the delay before the first retry. It doubles with each retry.
+	RetryBackoff time.Duration
+	// Transport is optional and defaults to a clone of http.DefaultTransport.
+	Transport http.RoundTripper
+	Logger    *log.Logger
+
+	proxy    *httputil.ReverseProxy
+	initOnce sync.Once
+}
+
+// proxyOutcome records how a proxied request failed, if it did.
+type proxyOutcome struct {
+	result string
+}
+
+type proxyOutcomeKey struct{}
+
+// NewDjangoProxy creates a DjangoProxy forwarding requests to rawURL.
+func NewDjangoProxy(rawURL string, timeout time.Duration, retries int, logger *log.Logger) (*DjangoProxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url must be http or https")
+	}
+	return &DjangoProxy{
+		URL:          u,
+		Timeout:      timeout,
+		Retries:      retries,
+		RetryBackoff: 100 * time.Millisecond,
+		Logger:       logger,
+	}, nil
+}
+
+func (p *DjangoProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.initOnce.Do(p.init)
+
+	ctx, span := tracer.Start(r.Context(), "DjangoProxy.ServeHTTP", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	outcome := &proxyOutcome{}
+	ctx = context.WithValue(ctx, proxyOutcomeKey{}, outcome)
+
+	start := time.Now()
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	p.proxy.ServeHTTP(lw, r.WithContext(ctx))
+
+	result := outcome.result
+	if result == "" {
+		result = strconv.Itoa(lw.status)
+	}
+	djangoProxyRequests.WithLabelValues(result).Inc()
+	djangoProxyDuration.Observe(time.Since(start).Seconds())
+
+	span.SetAttributes(semconv.HTTPStatusCode(lw.status))
+	if lw.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(lw.status))
+	}
+}
+
+func (p *DjangoProxy) init() {
+	transport := p.Transport
+	if transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = p.Timeout
+		transport = t
+	}
+
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: p.rewrite,
+		Transport: &retryTransport{
+			Transport: transport,
+			Retries:   p.Retries,
+			Backoff:   p.RetryBackoff,
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// these headers are set by the object store itself.
+			for key := range resp.Header {
+				if strings.HasPrefix(key, "Access-Control-") {
+					resp.Header.Del(key)
+				}
+			}
+			resp.Header.Del("X-Request-ID")
+			return nil
+		},
+		ErrorHandler: p.handleError,
+		// flush immediately so streamed bodies aren't held back.
+		FlushInterval: -1,
+	}
+}
+
+func (p *DjangoProxy) rewrite(pr *httputil.ProxyRequest) {
+	pr.Out.URL.Scheme = p.URL.Scheme
+	pr.Out.URL.Host = p.URL.Host
+	pr.Out.URL.Path = strings.TrimSuffix(p.URL.Path, "/") + "/" + strings.TrimPrefix(pr.In.URL.Path, "/")
+	pr.Out.URL.RawPath = ""
+	pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+	pr.Out.Host = ""
+
+	pr.SetXForwarded()
+	pr.Out.Header.Set("X-Request-ID", requestID(pr.In.Context()))
+	otel.GetTextMapPropagator().Inject(pr.Out.Context(), propagation.HeaderCarrier(pr.Out.Header))
+}
+
+func (p *DjangoProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	trace.SpanFromContext(r.Context()).RecordError(err)
+	outcome, _ := r.Context().Value(proxyOutcomeKey{}).(*proxyOutcome)
+	if outcome == nil {
+		outcome = &proxyOutcome{}
+	}
+
+	// the client went away, so there is nobody to respond to.
+	if r.Context().Err() != nil {
+		p.log("%s %s -> %s: proxy request canceled: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		outcome.result = "canceled"
+		return
+	}
+
+	p.log("%s %s -> %s: proxy request failed: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+	outcome.result = "error"
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		respondJSONError(w, http.StatusGatewayTimeout, "")
+		return
+	}
+	respondJSONError(w, http.StatusBadGateway, "")
+}
+
+func (p *DjangoProxy) log(format string, v ...interface{}) {
+	if p.Logger == nil {
+		return
+	}
+	p.Logger.Printf(format, v...)
+}
+
+// retryTransport retries requests without a body after connection errors or 502, 503 and 504
+// responses. Requests with a body are sent once, as the body can't be replayed.
+type retryTransport struct {
+	Transport http.RoundTripper
+	Retries   int
+	Backoff   time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := t.Retries
+	if (req.Body != nil && req.Body != http.NoBody) || !isIdempotent(req.Method) {
+		retries = 0
+	}
+
+	backoff := t.Backoff
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.Transport.RoundTrip(req)
+
+		if attempt >= retries || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+		djangoProxyRetries.Inc()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		// don't retry once the client has gone away.
+		return !errors.Is(err, context.Canceled)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
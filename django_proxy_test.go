@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDjangoProxy(t *testing.T, upstream *httptest.Server) *DjangoProxy {
+	proxy, err := NewDjangoProxy(upstream.URL+"/downloads/", time.Second, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.RetryBackoff = time.Millisecond
+	return proxy
+}
+
+func TestDjangoProxyForwardsRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/downloads/job/task/node/1643842551600000000-sample.jpg" {
+			t.Errorf("incorrect upstream path: %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Sage token" || r.Header.Get("Range") != "bytes=0-9" {
+			t.Errorf("expected request headers to be forwarded. got: %v", r.Header)
+		}
+		if r.Header.Get("X-Forwarded-For") == "" {
+			t.Errorf("expected X-Forwarded-For to be set")
+		}
+		w.Header().Set("Location", "https://storage/sample.jpg")
+		w.Header().Set("X-Upstream", "django")
+		w.Header().Set("Access-Control-Allow-Origin", "https://django")
+		w.WriteHeader(http.StatusFound)
+		if r.Method != http.MethodHead {
+			io.WriteString(w, "redirecting")
+		}
+	}))
+	defer upstream.Close()
+
+	handler := &CORSHandler{
+		Handler: &StorageHandler{
+			Storage:       &mockStorage{},
+			Authenticator: &mockAuthenticator{true},
+			Proxy:         newTestDjangoProxy(t, upstream),
+		},
+	}
+
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			r, _ := http.NewRequest(method, "job/task/node/1643842551600000000-sample.jpg", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			r.Header.Set("Authorization", "Sage token")
+			r.Header.Set("Range", "bytes=0-9")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			resp := w.Result()
+
+			assertStatusCode(t, resp, http.StatusFound)
+			if resp.Header.Get("Location") != "https://storage/sample.jpg" || resp.Header.Get("X-Upstream") != "django" {
+				t.Fatalf("expected response headers to be forwarded. got: %v", resp.Header)
+			}
+			if values := resp.Header.Values("Access-Control-Allow-Origin"); len(values) != 1 || values[0] != "*" {
+				t.Fatalf("expected only the object store's cors headers. got: %v", values)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if method == http.MethodGet && string(body) != "redirecting" {
+				t.Fatalf("expected body to be forwarded. got: %q", body)
+			}
+			if method == http.MethodHead && len(body) != 0 {
+				t.Fatalf("expected empty body for head. got: %q", body)
+			}
+		})
+	}
+}
+
+func TestDjangoProxyRetries(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+
+	proxy := newTestDjangoProxy(t, upstream)
+
+	resp := getResponse(t, proxy, http.MethodGet, "/sample.jpg")
+	assertStatusCode(t, resp, http.StatusOK)
+	if requests.Load() != 3 {
+		t.Fatalf("expected 3 upstream requests. got: %d", requests.Load())
+	}
+
+	// requests with a body are not retried, as the body can't be replayed.
+	requests.Store(0)
+	r := httptest.NewRequest(http.MethodPut, "/sample.jpg", strings.NewReader("content"))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusServiceUnavailable)
+	if requests.Load() != 1 {
+		t.Fatalf("expected 1 upstream request. got: %d", requests.Load())
+	}
+}
+
+func TestDjangoProxyErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	proxy := newTestDjangoProxy(t, slow)
+	proxy.Timeout = 50 * time.Millisecond
+	proxy.Retries = 0
+	assertStatusCode(t, getResponse(t, proxy, http.MethodGet, "/sample.jpg"), http.StatusGatewayTimeout)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	assertStatusCode(t, getResponse(t, newTestDjangoProxy(t, closed), http.MethodGet, "/sample.jpg"), http.StatusBadGateway)
+}
+
+func TestHandlerUnsupportedAuthorizationWithoutProxy(t *testing.T) {
+	handler := &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: &mockAuthenticator{true},
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, randomURL(), nil)
+	r.Header.Set("Authorization", "Sage token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusUnauthorized)
+}
+
+func TestDjangoProxyDenylisted(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer upstream.Close()
+
+	denylist := NewDenylist(&FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}, nil)
+	if err := denylist.Add(context.Background(), &DenylistEntry{Prefix: "sage/imagesampler-bottom/", Reason: "faces captured"}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: &mockAuthenticator{true},
+		Denylist:      denylist,
+		Proxy:         newTestDjangoProxy(t, upstream),
+	}
+
+	for _, method := range testMethods {
+		r, _ := http.NewRequest(method, "sage/imagesampler-bottom/node/1643842551600000001-sample.jpg", nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assertStatusCode(t, w.Result(), http.StatusUnavailableForLegalReasons)
+	}
+	if requests.Load() != 0 {
+		t.Fatalf("expected blocked files not to be proxied. got: %d upstream requests", requests.Load())
+	}
+}
+
+func TestDjangoProxyBasicAuthFallback(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if username, password, _ := r.BasicAuth(); username != "django" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Location", "https://storage/sample.jpg")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer upstream.Close()
+
+	auth := newTestNodesAuthenticator()
+	auth.UpdateCredentials([]*Credential{{Username: "user", Password: "secret"}})
+
+	handler := &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: auth,
+		LoginLimiter:  NewLoginLimiter(),
+		Proxy:         newTestDjangoProxy(t, upstream),
+	}
+
+	do := func(username, password string) *http.Response {
+		r, _ := http.NewRequest(http.MethodGet, "sage/imagesampler-top/0000000000000002/1643842551600000000-sample.jpg", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// local credentials are checked here.
+	assertStatusCode(t, do("user", "secret"), http.StatusTemporaryRedirect)
+	if requests.Load() != 0 {
+		t.Fatalf("expected local credentials not to be proxied")
+	}
+
+	// other credentials may be for a django account.
+	assertStatusCode(t, do("django", "secret"), http.StatusFound)
+	if requests.Load() != 1 {
+		t.Fatalf("expected other credentials to be proxied")
+	}
+
+	// logins rejected by django count towards the lockout.
+	for i := 0; i < 5; i++ {
+		assertStatusCode(t, do("django", "wrong"), http.StatusUnauthorized)
+	}
+	assertStatusCode(t, do("django", "wrong"), http.StatusTooManyRequests)
+	if requests.Load() != 6 {
+		t.Fatalf("expected locked out clients not to be proxied. got: %d upstream requests", requests.Load())
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path"
+	"sync"
+	"time"
+)
+
+// ObjectEventType is whether an object was created or removed.
+type ObjectEventType string
+
+const (
+	ObjectCreated ObjectEventType = "created"
+	ObjectRemoved ObjectEventType = "removed"
+)
+
+// ObjectEvent is a change to a stored file.
+type ObjectEvent struct {
+	Type ObjectEventType
+	File *StorageFile
+	// Size and ETag are only set for created objects.
+	Size int64
+	ETag string
+	// Time is when storage reported the change.
+	Time time.Time
+}
+
+// Path returns the {job}/{task}/{node}/{filename} path of the object relative to the root folder.
+func (e *ObjectEvent) Path() string {
+	return path.Join(e.File.JobID, e.File.TaskID, e.File.NodeID, e.File.Filename)
+}
+
+// EventBus delivers object events to subscribers. Publishing never blocks. Events are dropped
+// for subscribers whose buffer is full, so slow subscribers can't hold up ingestion.
+type EventBus struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]chan *ObjectEvent
+}
+
+// NewEventBus creates an event bus with no subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[int]chan *ObjectEvent),
+	}
+}
+
+// Subscribe returns a channel receiving events published from now on, buffering up to buffer
+// events. Calling cancel unsubscribes and closes the channel.
+func (b *EventBus) Subscribe(buffer int) (events <-chan *ObjectEvent, cancel func()) {
+	ch := make(chan *ObjectEvent, buffer)
+
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = ch
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends e to every subscriber with room in its buffer.
+func (b *EventBus) Publish(e *ObjectEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			objectEventsDropped.Inc()
+		}
+	}
+}
+
+// Len returns the number of subscribers.
+func (b *EventBus) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
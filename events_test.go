@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+
+	fast, cancelFast := bus.Subscribe(2)
+	slow, cancelSlow := bus.Subscribe(1)
+	defer cancelSlow()
+
+	f := &StorageFile{JobID: "sage", TaskID: "imagesampler-top", NodeID: "000048b02d15bc7c", Filename: "1-sample.jpg"}
+	bus.Publish(&ObjectEvent{Type: ObjectCreated, File: f})
+	bus.Publish(&ObjectEvent{Type: ObjectRemoved, File: f})
+
+	if e := <-fast; e.Type != ObjectCreated || e.Path() != "sage/imagesampler-top/000048b02d15bc7c/1-sample.jpg" {
+		t.Fatalf("incorrect event: %+v", e)
+	}
+	if e := <-fast; e.Type != ObjectRemoved {
+		t.Fatalf("incorrect event: %+v", e)
+	}
+
+	// the slow subscriber's buffer was full, so the second event was dropped.
+	<-slow
+	select {
+	case e := <-slow:
+		t.Fatalf("expected event to be dropped. got: %+v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancelFast()
+	cancelFast()
+	if _, ok := <-fast; ok {
+		t.Fatalf("expected channel to be closed")
+	}
+	if bus.Len() != 1 {
+		t.Fatalf("incorrect number of subscribers. got: %d want: 1", bus.Len())
+	}
+}
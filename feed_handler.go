@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FeedHandler streams newly created files as Server-Sent Events. Clients subscribe with optional
+// job, task and node glob patterns and only receive files they are authorized to download.
+type FeedHandler struct {
+	Bus           *EventBus
+	Authenticator Authenticator
+	// Denylist is optional. Blocked files are not sent.
+	Denylist *Denylist
+	// LoginLimiter is optional and rejects basic auth from clients which are locked out.
+	LoginLimiter *LoginLimiter
+	// MaxSubscribers limits the number of open feeds. Zero is unlimited.
+	MaxSubscribers int
+	// Heartbeat is how often a comment is sent to keep idle connections open and credentials are
+	// checked again. It defaults to 30s.
+	Heartbeat time.Duration
+	// Done is optional and ends open feeds when closed, so they don't hold up shutdown.
+	Done   <-chan struct{}
+	Logger *log.Logger
+
+	subscribers atomic.Int64
+}
+
+// feedFilter matches files against the job, task and node patterns of a feed. Empty patterns
+// match everything.
+type feedFilter struct {
+	Job  string
+	Task string
+	Node string
+}
+
+func (p *feedFilter) matches(f *StorageFile) bool {
+	for _, m := range []struct {
+		pattern string
+		value   string
+	}{
+		{p.Job, f.JobID},
+		{p.Task, f.TaskID},
+		{p.Node, strings.ToLower(f.NodeID)},
+	} {
+		if m.pattern == "" {
+			continue
+		}
+		if ok, _ := path.Match(m.pattern, m.value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type feedItem struct {
+	Path      string    `json:"path"`
+	JobID     string    `json:"job_id"`
+	TaskID    string    `json:"task_id"`
+	NodeID    string    `json:"node_id"`
+	Filename  string    `json:"filename"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+}
+
+func (h *FeedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	values := r.URL.Query()
+	filter := &feedFilter{
+		Job:  values.Get("job"),
+		Task: values.Get("task"),
+		Node: strings.ToLower(values.Get("node")),
+	}
+	for _, pattern := range []string{filter.Job, filter.Task, filter.Node} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			respondJSONError(w, http.StatusBadRequest, "invalid pattern %q", pattern)
+			return
+		}
+	}
+
+	authorized, err := authorizeRequestFiles(w, r, h.Authenticator, h.LoginLimiter)
+	if err != nil {
+		h.log("%s %s -> %s: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		return
+	}
+
+	if n := h.subscribers.Add(1); h.MaxSubscribers > 0 && n > int64(h.MaxSubscribers) {
+		h.subscribers.Add(-1)
+		setRetryAfter(w, 10*time.Second)
+		respondProblem(w, http.StatusServiceUnavailable, "too_many_subscribers", "too many feed subscribers")
+		return
+	}
+	defer h.subscribers.Add(-1)
+
+	events, cancel := h.Bus.Subscribe(100)
+	defer cancel()
+
+	heartbeat := h.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = 30 * time.Second
+	}
+
+	rc := http.NewResponseController(w)
+	// feeds outlive the server write timeout, so the deadline is extended as the feed is
+	// written. servers without a write deadline ignore this.
+	extendDeadline := func() {
+		rc.SetWriteDeadline(time.Now().Add(2 * heartbeat))
+	}
+	extendDeadline()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		h.log("%s %s -> %s: feed not supported: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		return
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.Done:
+			return
+		case <-ticker.C:
+			// credentials can expire or be revoked while the feed is open.
+			if err := recheckRequestCredentials(r, h.Authenticator); err != nil {
+				h.log("%s %s -> %s: ending feed: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+				return
+			}
+			extendDeadline()
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !h.allowed(e, filter, authorized) {
+				continue
+			}
+			extendDeadline()
+			if err := writeFeedEvent(w, e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// allowed reports whether e should be sent to a feed.
+func (h *FeedHandler) allowed(e *ObjectEvent, filter *feedFilter, authorized fileAuthorizer) bool {
+	if e.Type != ObjectCreated || !filter.matches(e.File) {
+		return false
+	}
+	if h.Denylist != nil {
+		if _, blocked := h.Denylist.Blocked(e.File); blocked {
+			return false
+		}
+	}
+	return authorized(e.File)
+}
+
+func writeFeedEvent(w http.ResponseWriter, e *ObjectEvent) error {
+	b, err := json.Marshal(&feedItem{
+		Path:      e.Path(),
+		JobID:     e.File.JobID,
+		TaskID:    e.File.TaskID,
+		NodeID:    e.File.NodeID,
+		Filename:  e.File.Filename,
+		Timestamp: e.File.Timestamp.UTC(),
+		Size:      e.Size,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: created\ndata: %s\n\n", b); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// Subscribers returns the number of open feeds.
+func (h *FeedHandler) Subscribers() int {
+	return int(h.subscribers.Load())
+}
+
+func (h *FeedHandler) log(format string, v ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Printf(format, v...)
+}
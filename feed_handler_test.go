@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedHandler(t *testing.T) {
+	bus := NewEventBus()
+
+	auth := newTestNodesAuthenticator()
+	auth.UpdateSettings(&TableAuthenticatorConfig{
+		Credentials: []*Credential{{Username: "user", Password: "secret"}},
+	})
+
+	handler := &FeedHandler{
+		Bus:            bus,
+		Authenticator:  auth,
+		MaxSubscribers: 2,
+		Heartbeat:      time.Hour,
+	}
+	server := httptest.NewServer(handler)
+	// registered before the response cleanups, so open feeds are closed before the server.
+	t.Cleanup(server.Close)
+
+	subscribe := func(query, username, password string) (*http.Response, *bufio.Reader) {
+		r, err := http.NewRequest(http.MethodGet, server.URL+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	readEvent := func(r *bufio.Reader) *feedItem {
+		var item feedItem
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: "); ok {
+				if err := json.Unmarshal([]byte(data), &item); err != nil {
+					t.Fatal(err)
+				}
+				return &item
+			}
+		}
+	}
+
+	resp, _ := subscribe("?task=[", "", "")
+	assertStatusCode(t, resp, http.StatusBadRequest)
+
+	resp, _ = subscribe("", "user", "wrong")
+	assertStatusCode(t, resp, http.StatusUnauthorized)
+
+	resp, anonymous := subscribe("?task=imagesampler-*", "", "")
+	assertStatusCode(t, resp, http.StatusOK)
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("incorrect content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	resp, user := subscribe("?node=0000000000000002", "user", "secret")
+	assertStatusCode(t, resp, http.StatusOK)
+
+	resp, _ = subscribe("", "", "")
+	assertStatusCode(t, resp, http.StatusServiceUnavailable)
+
+	for bus.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	now := time.Now()
+	publish := func(task, node string, eventType ObjectEventType) {
+		bus.Publish(&ObjectEvent{
+			Type: eventType,
+			File: &StorageFile{
+				JobID:     "sage",
+				TaskID:    task,
+				NodeID:    node,
+				Filename:  "1-sample.jpg",
+				Timestamp: now,
+			},
+			Size: 10,
+		})
+	}
+
+	publish("imagesampler-top", "0000000000000002", ObjectCreated)
+	publish("imagesampler-top", "0000000000000001", ObjectRemoved)
+	publish("audiosampler", "0000000000000001", ObjectCreated)
+	publish("imagesampler-top", "0000000000000001", ObjectCreated)
+
+	// anonymous subscribers only see created files from public nodes which match their patterns.
+	if item := readEvent(anonymous); item.Path != "sage/imagesampler-top/0000000000000001/1-sample.jpg" || item.Size != 10 {
+		t.Fatalf("incorrect event: %+v", item)
+	}
+	if item := readEvent(user); item.Path != "sage/imagesampler-top/0000000000000002/1-sample.jpg" || !item.Timestamp.Equal(now) {
+		t.Fatalf("incorrect event: %+v", item)
+	}
+}
+
+func TestFeedHandlerRechecksCredentials(t *testing.T) {
+	key := newTestECKey(t, "key")
+
+	table := newTestNodesAuthenticator()
+	table.UpdateSettings(&TableAuthenticatorConfig{
+		Credentials: []*Credential{{Username: "user", Password: "secret"}},
+	})
+
+	handler := &FeedHandler{
+		Bus: NewEventBus(),
+		Authenticator: &JWTAuthenticator{
+			TableAuthenticator: table,
+			Validator:          newTestJWTValidator(t, key),
+		},
+		Heartbeat: 10 * time.Millisecond,
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	subscribe := func(setAuth func(r *http.Request)) *http.Response {
+		r, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setAuth(r)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		assertStatusCode(t, resp, http.StatusOK)
+		return resp
+	}
+
+	// waitEnded reads heartbeats until the server ends the feed.
+	waitEnded := func(resp *http.Response) {
+		done := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, resp.Body)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected feed to end")
+		}
+	}
+
+	claims := validTestClaims()
+	claims["exp"] = time.Now().Add(2 * time.Second).Unix()
+	token := key.sign(t, claims)
+	waitEnded(subscribe(func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}))
+
+	resp := subscribe(func(r *http.Request) {
+		r.SetBasicAuth("user", "secret")
+	})
+	table.UpdateCredentials(nil)
+	waitEnded(resp)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fileAuthorizer reports whether a client may download a file.
+type fileAuthorizer func(f *StorageFile) bool
+
+// authorizeRequestFiles returns a fileAuthorizer for requests which cover many files, such as
+// searches and feeds, using the same node certificate, bearer token, basic auth and public
+// access rules as the data endpoint. Credentials are checked once, rather than for every file. It
+// writes a response and returns an error if the client's credentials are rejected outright.
+func authorizeRequestFiles(w http.ResponseWriter, r *http.Request, auth Authenticator, limiter *LoginLimiter) (fileAuthorizer, error) {
+	nodeID, hasNode := clientNodeID(r)
+
+	ownNode := func(f *StorageFile) bool {
+		return hasNode && strings.EqualFold(nodeID, f.NodeID)
+	}
+
+	if token, ok := bearerToken(r); ok {
+		tokenAuth, ok := auth.(TokenAuthenticator)
+		if !ok {
+			respondProblem(w, http.StatusUnauthorized, "unsupported_authorization", "authorization scheme is not supported")
+			return nil, fmt.Errorf("unsupported authorization")
+		}
+		authorized, err := tokenAuth.ValidateToken(r.Context(), token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			respondProblem(w, http.StatusUnauthorized, "invalid_token", "invalid token")
+			return nil, fmt.Errorf("invalid token: %s", err.Error())
+		}
+		return func(f *StorageFile) bool {
+			return ownNode(f) || authorized(f)
+		}, nil
+	}
+
+	username, password, hasAuth := r.BasicAuth()
+
+	if hasAuth {
+		if limiter != nil {
+			if wait := limiter.Check(r, username); wait > 0 {
+				authFailures.WithLabelValues("locked_out").Inc()
+				setRetryAfter(w, wait)
+				respondProblem(w, http.StatusTooManyRequests, "locked_out", "too many failed login attempts")
+				return nil, fmt.Errorf("locked out")
+			}
+		}
+		if checker, ok := auth.(CredentialChecker); ok {
+			if !checker.Authenticated(username, password) {
+				authFailures.WithLabelValues("invalid_credentials").Inc()
+				if limiter != nil {
+					limiter.Failure(r, username)
+				}
+				w.Header().Set("WWW-Authenticate", "Basic domain=storage.sagecontinuum.org")
+				respondJSONError(w, http.StatusUnauthorized, "not authorized")
+				return nil, fmt.Errorf("not authorized")
+			}
+			if limiter != nil {
+				limiter.Success(r, username)
+			}
+			requestLogInfoFromContext(r.Context()).Principal = username
+			return func(f *StorageFile) bool {
+				return true
+			}, nil
+		}
+	}
+
+	return func(f *StorageFile) bool {
+		return ownNode(f) || auth.Authorized(f, username, password, hasAuth)
+	}, nil
+}
+
+// recheckRequestCredentials checks that the credentials accepted by authorizeRequestFiles are
+// still valid, for requests which stay open such as feeds. Bearer tokens are validated again, so
+// expired or revoked tokens are rejected, and basic auth credentials are checked again if auth
+// is a CredentialChecker. Other credentials are already checked for each file.
+func recheckRequestCredentials(r *http.Request, auth Authenticator) error {
+	if token, ok := bearerToken(r); ok {
+		tokenAuth, ok := auth.(TokenAuthenticator)
+		if !ok {
+			return fmt.Errorf("unsupported authorization")
+		}
+		if _, err := tokenAuth.ValidateToken(r.Context(), token); err != nil {
+			return fmt.Errorf("invalid token: %s", err.Error())
+		}
+		return nil
+	}
+
+	if username, password, hasAuth := r.BasicAuth(); hasAuth {
+		if checker, ok := auth.(CredentialChecker); ok && !checker.Authenticated(username, password) {
+			return fmt.Errorf("not authorized")
+		}
+	}
+	return nil
+}
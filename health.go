@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// HealthCheck is a named check reported by a HealthHandler. Check returns nil if healthy.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// HealthHandler runs its checks and reports each one's status as JSON. It responds with 503 if
+// any check fails. A handler with no checks only reports that the process is serving requests.
+type HealthHandler struct {
+	Checks []HealthCheck
+}
+
+type healthCheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status string                        `json:"status"`
+		Checks map[string]*healthCheckStatus `json:"checks,omitempty"`
+	}
+
+	resp := &response{
+		Status: "ok",
+		Checks: make(map[string]*healthCheckStatus),
+	}
+	statusCode := http.StatusOK
+
+	for _, check := range h.Checks {
+		if err := check.Check(r.Context()); err != nil {
+			resp.Checks[check.Name] = &healthCheckStatus{Status: "fail", Error: err.Error()}
+			resp.Status = "fail"
+			statusCode = http.StatusServiceUnavailable
+		} else {
+			resp.Checks[check.Name] = &healthCheckStatus{Status: "ok"}
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondJSON(w, statusCode, resp)
+}
+
+// NodeTableHealthCheck fails until the node table has been loaded at least once.
+func NodeTableHealthCheck(nodes NodeTable) HealthCheck {
+	return HealthCheck{
+		Name: "node_table",
+		Check: func(ctx context.Context) error {
+			if _, updated := nodes.Nodes(); updated.IsZero() {
+				return fmt.Errorf("node table has not been loaded")
+			}
+			return nil
+		},
+	}
+}
+
+// BucketChecker checks that the storage bucket is reachable with the configured credentials.
+type BucketChecker interface {
+	CheckBucket(ctx context.Context) error
+}
+
+// CheckBucket checks the bucket exists and is accessible.
+func (s *S3Storage) CheckBucket(ctx context.Context) error {
+	_, err := s.S3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.Bucket),
+	})
+	return err
+}
+
+// StorageProbe periodically checks the storage bucket in the background, so readiness checks
+// can report its status without calling S3 on every request.
+type StorageProbe struct {
+	Storage BucketChecker
+	// MaxAge is how long a successful probe counts as healthy.
+	MaxAge time.Duration
+	// Timeout limits how long each probe can take.
+	Timeout time.Duration
+	// Logger is optional and logs probe errors, which are not reported by the health check as
+	// they may include internal details.
+	Logger *log.Logger
+
+	lastSuccess time.Time
+	mu          sync.Mutex
+}
+
+// NewStorageProbe creates a StorageProbe for storage. Call Watch to start probing.
+func NewStorageProbe(storage BucketChecker) *StorageProbe {
+	return &StorageProbe{
+		Storage: storage,
+		MaxAge:  time.Minute,
+		Timeout: 5 * time.Second,
+	}
+}
+
+// Probe checks the bucket once and records the result.
+func (p *StorageProbe) Probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	err := p.Storage.CheckBucket(ctx)
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Printf("s3 probe failed: %s", err.Error())
+		}
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSuccess = time.Now()
+	return nil
+}
+
+// Watch probes the bucket every interval until ctx is done.
+func (p *StorageProbe) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.Probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// HealthCheck returns a check which fails unless a probe succeeded within MaxAge.
+func (p *StorageProbe) HealthCheck() HealthCheck {
+	return HealthCheck{
+		Name: "s3",
+		Check: func(ctx context.Context) error {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			// security: probe errors may include internal details, so they are only logged.
+			if p.lastSuccess.IsZero() || time.Since(p.lastSuccess) > p.MaxAge {
+				return fmt.Errorf("s3 probe failing")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	resp := getResponse(t, &HealthHandler{}, "GET", "/healthz")
+	assertStatusCode(t, resp, http.StatusOK)
+}
+
+func TestReadyzNodeTableNotLoaded(t *testing.T) {
+	probe := NewStorageProbe(&mockBucketChecker{})
+	probe.Probe(context.Background())
+
+	handler := &HealthHandler{
+		Checks: []HealthCheck{
+			NodeTableHealthCheck(NewTableAuthenticator()),
+			probe.HealthCheck(),
+		},
+	}
+
+	resp := getResponse(t, handler, "GET", "/readyz")
+	assertStatusCode(t, resp, http.StatusServiceUnavailable)
+
+	checks := decodeHealthChecks(t, resp)
+	if checks["node_table"].Status != "fail" {
+		t.Fatalf("expected node_table check to fail. got: %+v", checks["node_table"])
+	}
+	if checks["s3"].Status != "ok" {
+		t.Fatalf("expected s3 check to pass. got: %+v", checks["s3"])
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	auth := NewTableAuthenticator()
+	auth.UpdateNodes(map[string]*TableAuthenticatorNode{})
+
+	bucket := &mockBucketChecker{}
+	probe := NewStorageProbe(bucket)
+
+	handler := &HealthHandler{
+		Checks: []HealthCheck{
+			NodeTableHealthCheck(auth),
+			probe.HealthCheck(),
+		},
+	}
+
+	// not ready until the first probe succeeds
+	assertStatusCode(t, getResponse(t, handler, "GET", "/readyz"), http.StatusServiceUnavailable)
+
+	probe.Probe(context.Background())
+	assertStatusCode(t, getResponse(t, handler, "GET", "/readyz"), http.StatusOK)
+
+	// a failed probe is tolerated until the last success is older than MaxAge
+	bucket.err = fmt.Errorf("access denied")
+	probe.Probe(context.Background())
+	assertStatusCode(t, getResponse(t, handler, "GET", "/readyz"), http.StatusOK)
+
+	probe.MaxAge = time.Nanosecond
+	resp := getResponse(t, handler, "GET", "/readyz")
+	assertStatusCode(t, resp, http.StatusServiceUnavailable)
+
+	checks := decodeHealthChecks(t, resp)
+	if checks["s3"].Status != "fail" || checks["s3"].Error != "s3 probe failing" {
+		t.Fatalf("expected s3 check to fail with a generic error. got: %+v", checks["s3"])
+	}
+}
+
+type mockBucketChecker struct {
+	err error
+}
+
+func (c *mockBucketChecker) CheckBucket(ctx context.Context) error {
+	return c.err
+}
+
+func decodeHealthChecks(t *testing.T, resp *http.Response) map[string]*healthCheckStatus {
+	var body struct {
+		Checks map[string]*healthCheckStatus `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Checks
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// IndexedObject is the metadata of a stored file kept in the ObjectIndex.
+type IndexedObject struct {
+	JobID     string    `json:"job_id"`
+	TaskID    string    `json:"task_id"`
+	NodeID    string    `json:"node_id"`
+	Filename  string    `json:"filename"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	ETag      string    `json:"etag"`
+}
+
+// Path returns the {job}/{task}/{node}/{filename} path of the object relative to the root folder.
+func (o *IndexedObject) Path() string {
+	return path.Join(o.JobID, o.TaskID, o.NodeID, o.Filename)
+}
+
+// File returns the StorageFile used to authorize access to the object.
+func (o *IndexedObject) File() *StorageFile {
+	return &StorageFile{
+		JobID:     o.JobID,
+		TaskID:    o.TaskID,
+		NodeID:    o.NodeID,
+		Filename:  o.Filename,
+		Timestamp: o.Timestamp,
+	}
+}
+
+// SearchQuery filters objects in the ObjectIndex. Empty fields match everything.
+type SearchQuery struct {
+	JobID  string
+	TaskID string
+	NodeID string
+	// After and Before limit the file timestamp to [After, Before).
+	After  time.Time
+	Before time.Time
+	// FilenameGlob is matched against the filename using path.Match.
+	FilenameGlob string
+	// Cursor continues a previous search after the last object it returned.
+	Cursor string
+}
+
+func (q *SearchQuery) matches(o *IndexedObject) bool {
+	if q.JobID != "" && q.JobID != o.JobID {
+		return false
+	}
+	if q.TaskID != "" && q.TaskID != o.TaskID {
+		return false
+	}
+	if q.NodeID != "" && !strings.EqualFold(q.NodeID, o.NodeID) {
+		return false
+	}
+	if q.FilenameGlob != "" {
+		if ok, _ := path.Match(q.FilenameGlob, o.Filename); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ObjectIndex is a local bbolt index of stored objects. Objects are keyed by path and also
+// indexed by timestamp, so searches over a time range don't need to scan every object.
+type ObjectIndex struct {
+	db *bolt.DB
+}
+
+var (
+	indexObjectsBucket = []byte("objects")
+	indexTimeBucket    = []byte("by_time")
+)
+
+// OpenObjectIndex opens or creates the index database at path.
+func OpenObjectIndex(path string) (*ObjectIndex, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexObjectsBucket, indexTimeBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ObjectIndex{db: db}, nil
+}
+
+// Close closes the database.
+func (x *ObjectIndex) Close() error {
+	return x.db.Close()
+}
+
+// Put adds or updates objs.
+func (x *ObjectIndex) Put(objs ...*IndexedObject) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		byTime := tx.Bucket(indexTimeBucket)
+		for _, o := range objs {
+			key := []byte(o.Path())
+			if old := objects.Get(key); old != nil {
+				var prev IndexedObject
+				if err := json.Unmarshal(old, &prev); err == nil {
+					byTime.Delete(timeKey(prev.Timestamp, prev.Path()))
+				}
+			}
+			v, err := json.Marshal(o)
+			if err != nil {
+				return err
+			}
+			if err := objects.Put(key, v); err != nil {
+				return err
+			}
+			if err := byTime.Put(timeKey(o.Timestamp, o.Path()), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes the objects with the given paths, if they are indexed.
+func (x *ObjectIndex) Delete(paths ...string) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		byTime := tx.Bucket(indexTimeBucket)
+		for _, p := range paths {
+			v := objects.Get([]byte(p))
+			if v == nil {
+				continue
+			}
+			var o IndexedObject
+			if err := json.Unmarshal(v, &o); err != nil {
+				return err
+			}
+			if err := byTime.Delete(timeKey(o.Timestamp, p)); err != nil {
+				return err
+			}
+			if err := objects.Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get returns the object with the given path.
+func (x *ObjectIndex) Get(p string) (*IndexedObject, bool, error) {
+	var o *IndexedObject
+	err := x.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(indexObjectsBucket).Get([]byte(p))
+		if v == nil {
+			return nil
+		}
+		o = &IndexedObject{}
+		return json.Unmarshal(v, o)
+	})
+	return o, o != nil, err
+}
+
+// Len returns the number of indexed objects.
+func (x *ObjectIndex) Len() int {
+	var n int
+	x.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(indexObjectsBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// Paths calls fn with the path of each object under prefix, in order.
+func (x *ObjectIndex) Paths(prefix string, fn func(p string)) error {
+	return x.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexObjectsBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			fn(string(k))
+		}
+		return nil
+	})
+}
+
+// Objects calls fn with each object under prefix, in path order.
+func (x *ObjectIndex) Objects(prefix string, fn func(o *IndexedObject)) error {
+	return x.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexObjectsBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var o IndexedObject
+			if err := json.Unmarshal(v, &o); err != nil {
+				return err
+			}
+			fn(&o)
+		}
+		return nil
+	})
+}
+
+// LastPath returns the last path under prefix in lexical order, which is the order storage
+// lists objects in.
+func (x *ObjectIndex) LastPath(prefix string) (string, bool, error) {
+	var last string
+	err := x.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexObjectsBucket).Cursor()
+		// "\xff" sorts after every path under prefix, as paths are valid utf-8.
+		k, _ := c.Seek([]byte(prefix + "\xff"))
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		if k != nil && bytes.HasPrefix(k, []byte(prefix)) {
+			last = string(k)
+		}
+		return nil
+	})
+	return last, last != "", err
+}
+
+// Neighbors returns the last object under prefix sorted before key and the first object sorted
+// at or after key. It implements FileLocator.
+func (x *ObjectIndex) Neighbors(ctx context.Context, prefix, key string) (before, after *IndexedObject, err error) {
+	err = x.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexObjectsBucket).Cursor()
+
+		decode := func(k, v []byte) (*IndexedObject, error) {
+			if k == nil || !bytes.HasPrefix(k, []byte(prefix)) {
+				return nil, nil
+			}
+			o := &IndexedObject{}
+			return o, json.Unmarshal(v, o)
+		}
+
+		k, v := c.Seek([]byte(key))
+		if after, err = decode(k, v); err != nil {
+			return err
+		}
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		before, err = decode(k, v)
+		return err
+	})
+	return before, after, err
+}
+
+// NodePrefixes returns the distinct {job}/{task}/{node}/ prefixes of indexed objects.
+func (x *ObjectIndex) NodePrefixes() ([]string, error) {
+	var prefixes []string
+	err := x.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexObjectsBucket).Cursor()
+		for k, _ := c.First(); k != nil; {
+			parts := strings.SplitN(string(k), "/", 4)
+			if len(parts) != 4 {
+				k, _ = c.Next()
+				continue
+			}
+			prefix := strings.Join(parts[:3], "/") + "/"
+			prefixes = append(prefixes, prefix)
+			// skip the rest of this prefix. "/" + 1 sorts after every path under it.
+			k, _ = c.Seek([]byte(strings.TrimSuffix(prefix, "/") + "0"))
+		}
+		return nil
+	})
+	return prefixes, err
+}
+
+// errInvalidCursor is returned by Search for cursors it did not create.
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Search calls fn with each object matching q in timestamp order until fn returns false or
+// maxScan objects have been examined. It returns a cursor to continue after the last object
+// examined, or an empty cursor if there are no more objects.
+func (x *ObjectIndex) Search(q *SearchQuery, maxScan int, fn func(o *IndexedObject) bool) (string, error) {
+	var start []byte
+	if q.Cursor != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || len(cursor) < 8 {
+			return "", errInvalidCursor
+		}
+		// continue strictly after the cursor.
+		start = append(cursor, 0)
+	} else if !q.After.IsZero() {
+		start = timeKey(q.After, "")
+	}
+
+	var end []byte
+	if !q.Before.IsZero() {
+		end = timeKey(q.Before, "")
+	}
+
+	var next string
+
+	err := x.db.View(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(indexObjectsBucket)
+		c := tx.Bucket(indexTimeBucket).Cursor()
+
+		var k []byte
+		if start != nil {
+			k, _ = c.Seek(start)
+		} else {
+			k, _ = c.First()
+		}
+
+		for scanned := 0; k != nil; k, _ = c.Next() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				return nil
+			}
+			if scanned >= maxScan {
+				next = base64.RawURLEncoding.EncodeToString(prevKey(c))
+				return nil
+			}
+			scanned++
+
+			v := objects.Get(k[8:])
+			if v == nil {
+				continue
+			}
+			var o IndexedObject
+			if err := json.Unmarshal(v, &o); err != nil {
+				return err
+			}
+			if !q.matches(&o) {
+				continue
+			}
+			if !fn(&o) {
+				next = base64.RawURLEncoding.EncodeToString(k)
+				return nil
+			}
+		}
+		return nil
+	})
+
+	return next, err
+}
+
+// prevKey returns the key before the cursor's current position and leaves the cursor there.
+func prevKey(c *bolt.Cursor) []byte {
+	k, _ := c.Prev()
+	return append([]byte(nil), k...)
+}
+
+// timeKey orders objects by timestamp and then path.
+func timeKey(t time.Time, p string) []byte {
+	key := make([]byte, 8, 8+len(p))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return append(key, p...)
+}
+
+// Follow applies object events from bus to the index until ctx is done, so new and removed
+// files show up without waiting for the next scan.
+func (x *ObjectIndex) Follow(ctx context.Context, bus *EventBus, logger *log.Logger) {
+	events, cancel := bus.Subscribe(1000)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			var err error
+			switch e.Type {
+			case ObjectCreated:
+				err = x.Put(&IndexedObject{
+					JobID:     e.File.JobID,
+					TaskID:    e.File.TaskID,
+					NodeID:    e.File.NodeID,
+					Filename:  e.File.Filename,
+					Timestamp: e.File.Timestamp.UTC(),
+					Size:      e.Size,
+					ETag:      e.ETag,
+				})
+			case ObjectRemoved:
+				err = x.Delete(e.Path())
+			}
+			if err != nil && logger != nil {
+				logger.Printf("failed to apply %s event for %s to index: %s", e.Type, e.Path(), err.Error())
+			}
+		}
+	}
+}
+
+// IndexCrawler keeps an ObjectIndex in sync with storage. Incremental scans list only objects
+// after the last indexed object under each {job}/{task}/{node}/ prefix, which finds new files as
+// their names start with a timestamp. Full scans also remove deleted objects.
+type IndexCrawler struct {
+	Index      *ObjectIndex
+	Lister     ObjectListerAfter
+	RootFolder string
+	Logger     *log.Logger
+}
+
+// Scan updates the index from storage. Full scans list every object.
+func (c *IndexCrawler) Scan(ctx context.Context, full bool) error {
+	scanType := "incremental"
+	if full {
+		scanType = "full"
+	}
+	start := time.Now()
+
+	err := c.scan(ctx, full)
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	indexScans.WithLabelValues(scanType, result).Inc()
+	indexScanDuration.WithLabelValues(scanType).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (c *IndexCrawler) scan(ctx context.Context, full bool) error {
+	prefixes, err := c.nodePrefixes(ctx)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool)
+
+	for _, prefix := range prefixes {
+		listed[prefix] = true
+		if err := c.scanPrefix(ctx, prefix, full); err != nil {
+			return fmt.Errorf("failed to scan %s: %s", prefix, err.Error())
+		}
+	}
+
+	if !full {
+		return nil
+	}
+
+	// remove objects under prefixes which no longer exist.
+	indexed, err := c.Index.NodePrefixes()
+	if err != nil {
+		return err
+	}
+	for _, prefix := range indexed {
+		if listed[prefix] {
+			continue
+		}
+		var paths []string
+		c.Index.Paths(prefix, func(p string) {
+			paths = append(paths, p)
+		})
+		if err := c.Index.Delete(paths...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanPrefix indexes the objects under a {job}/{task}/{node}/ prefix relative to the root folder.
+func (c *IndexCrawler) scanPrefix(ctx context.Context, prefix string, full bool) error {
+	root := folderPrefix(c.RootFolder)
+
+	var startAfter string
+	if !full {
+		last, ok, err := c.Index.LastPath(prefix)
+		if err != nil {
+			return err
+		}
+		if ok {
+			startAfter = root + last
+		}
+	}
+
+	seen := make(map[string]bool)
+	var batch []*IndexedObject
+
+	var putErr error
+	err := c.Lister.ListObjectsAfter(ctx, root+prefix, startAfter, func(obj *s3.Object) bool {
+		o, ok := indexedObjectFromS3(strings.TrimPrefix(aws.StringValue(obj.Key), root), obj)
+		if !ok {
+			return true
+		}
+		seen[o.Path()] = true
+		batch = append(batch, o)
+		if len(batch) >= 1000 {
+			putErr = c.Index.Put(batch...)
+			batch = batch[:0]
+		}
+		return putErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if putErr != nil {
+		return putErr
+	}
+	if err := c.Index.Put(batch...); err != nil {
+		return err
+	}
+
+	if !full {
+		return nil
+	}
+
+	var deleted []string
+	c.Index.Paths(prefix, func(p string) {
+		if !seen[p] {
+			deleted = append(deleted, p)
+		}
+	})
+	return c.Index.Delete(deleted...)
+}
+
+// nodePrefixes lists the {job}/{task}/{node}/ prefixes relative to the root folder.
+func (c *IndexCrawler) nodePrefixes(ctx context.Context) ([]string, error) {
+	root := folderPrefix(c.RootFolder)
+	prefixes := []string{root}
+	for depth := 0; depth < 3; depth++ {
+		var next []string
+		for _, prefix := range prefixes {
+			children, err := c.Lister.ListPrefixes(ctx, prefix)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, children...)
+		}
+		prefixes = next
+	}
+	for i := range prefixes {
+		prefixes[i] = strings.TrimPrefix(prefixes[i], root)
+	}
+	return prefixes, nil
+}
+
+// Watch runs an incremental scan every interval and a full scan every fullInterval until ctx
+// is done. The first scan is a full scan.
+func (c *IndexCrawler) Watch(ctx context.Context, interval, fullInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastFull time.Time
+
+	for {
+		full := time.Since(lastFull) >= fullInterval
+		if err := c.Scan(ctx, full); err != nil {
+			c.log("failed to scan index: %s", err.Error())
+		} else if full {
+			lastFull = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *IndexCrawler) log(format string, v ...interface{}) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Printf(format, v...)
+}
+
+// indexedObjectFromS3 returns the indexed object for obj, where p is its key relative to the
+// root folder. It returns false for keys which are not stored files.
+func indexedObjectFromS3(p string, obj *s3.Object) (*IndexedObject, bool) {
+	f, err := parseStorageFilePath(p)
+	if err != nil {
+		return nil, false
+	}
+	return &IndexedObject{
+		JobID:     f.JobID,
+		TaskID:    f.TaskID,
+		NodeID:    f.NodeID,
+		Filename:  f.Filename,
+		Timestamp: f.Timestamp.UTC(),
+		Size:      aws.Int64Value(obj.Size),
+		ETag:      strings.Trim(aws.StringValue(obj.ETag), `"`),
+	}, true
+}
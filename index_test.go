@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestObjectIndex(t *testing.T) *ObjectIndex {
+	index, err := OpenObjectIndex(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { index.Close() })
+	return index
+}
+
+func testIndexedObject(job, task, node string, ts time.Time, name string) *IndexedObject {
+	return &IndexedObject{
+		JobID:     job,
+		TaskID:    task,
+		NodeID:    node,
+		Filename:  fmt.Sprintf("%d-%s", ts.UnixNano(), name),
+		Timestamp: ts.UTC(),
+		Size:      10,
+	}
+}
+
+func searchPaths(t *testing.T, index *ObjectIndex, q *SearchQuery, maxScan, limit int) ([]string, string) {
+	var paths []string
+	next, err := index.Search(q, maxScan, func(o *IndexedObject) bool {
+		paths = append(paths, o.Path())
+		return len(paths) < limit
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths, next
+}
+
+func TestObjectIndexSearch(t *testing.T) {
+	index := newTestObjectIndex(t)
+
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	objs := []*IndexedObject{
+		testIndexedObject("sage", "imagesampler-top", "000048b02d15bc7c", t0, "sample.jpg"),
+		testIndexedObject("sage", "imagesampler-top", "000048b02d15bc7d", t0.Add(time.Hour), "sample.jpg"),
+		testIndexedObject("sage", "audiosampler", "000048b02d15bc7c", t0.Add(2*time.Hour), "sample.flac"),
+		testIndexedObject("sage", "imagesampler-top", "000048b02d15bc7c", t0.Add(3*time.Hour), "sample.jpg"),
+		testIndexedObject("other", "imagesampler-top", "000048b02d15bc7c", t0.Add(4*time.Hour), "sample.jpg"),
+	}
+	if err := index.Put(objs...); err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != len(objs) {
+		t.Fatalf("incorrect length. got: %d want: %d", index.Len(), len(objs))
+	}
+
+	testcases := map[string]struct {
+		Query  SearchQuery
+		Expect []*IndexedObject
+	}{
+		"All": {
+			Query:  SearchQuery{},
+			Expect: objs,
+		},
+		"Task": {
+			Query:  SearchQuery{TaskID: "imagesampler-top"},
+			Expect: []*IndexedObject{objs[0], objs[1], objs[3], objs[4]},
+		},
+		"TaskAndNode": {
+			Query:  SearchQuery{JobID: "sage", TaskID: "imagesampler-top", NodeID: "000048B02D15BC7C"},
+			Expect: []*IndexedObject{objs[0], objs[3]},
+		},
+		"TimeRange": {
+			Query:  SearchQuery{After: t0.Add(time.Hour), Before: t0.Add(3 * time.Hour)},
+			Expect: []*IndexedObject{objs[1], objs[2]},
+		},
+		"FilenameGlob": {
+			Query:  SearchQuery{FilenameGlob: "*.flac"},
+			Expect: []*IndexedObject{objs[2]},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			paths, next := searchPaths(t, index, &tc.Query, 100, 100)
+			if next != "" {
+				t.Fatalf("expected no cursor. got: %q", next)
+			}
+			if len(paths) != len(tc.Expect) {
+				t.Fatalf("incorrect results. got: %v", paths)
+			}
+			for i := range paths {
+				if paths[i] != tc.Expect[i].Path() {
+					t.Fatalf("incorrect result %d. got: %s want: %s", i, paths[i], tc.Expect[i].Path())
+				}
+			}
+		})
+	}
+
+	t.Run("Cursor", func(t *testing.T) {
+		q := &SearchQuery{TaskID: "imagesampler-top"}
+		var all []string
+		for i := 0; i < 10; i++ {
+			paths, next := searchPaths(t, index, q, 100, 2)
+			all = append(all, paths...)
+			if next == "" {
+				break
+			}
+			q.Cursor = next
+		}
+		if len(all) != 4 || all[0] != objs[0].Path() || all[3] != objs[4].Path() {
+			t.Fatalf("incorrect paged results: %v", all)
+		}
+	})
+
+	t.Run("MaxScan", func(t *testing.T) {
+		q := &SearchQuery{FilenameGlob: "*.flac"}
+		paths, next := searchPaths(t, index, q, 2, 100)
+		if len(paths) != 0 || next == "" {
+			t.Fatalf("expected scan to stop with a cursor. got: %v %q", paths, next)
+		}
+		q.Cursor = next
+		paths, _ = searchPaths(t, index, q, 2, 100)
+		if len(paths) != 1 || paths[0] != objs[2].Path() {
+			t.Fatalf("expected search to continue from cursor. got: %v", paths)
+		}
+	})
+
+	t.Run("InvalidCursor", func(t *testing.T) {
+		_, err := index.Search(&SearchQuery{Cursor: "!"}, 100, func(o *IndexedObject) bool { return true })
+		if err != errInvalidCursor {
+			t.Fatalf("expected invalid cursor error. got: %v", err)
+		}
+	})
+}
+
+func TestObjectIndexPutReplacesTimestamp(t *testing.T) {
+	index := newTestObjectIndex(t)
+
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	o := testIndexedObject("sage", "imagesampler-top", "000048b02d15bc7c", t0, "sample.jpg")
+	index.Put(o)
+
+	updated := *o
+	updated.Timestamp = t0.Add(time.Hour)
+	updated.Size = 20
+	index.Put(&updated)
+
+	paths, _ := searchPaths(t, index, &SearchQuery{}, 100, 100)
+	if len(paths) != 1 {
+		t.Fatalf("expected old time index entry to be removed. got: %v", paths)
+	}
+
+	if err := index.Delete(o.Path()); err != nil {
+		t.Fatal(err)
+	}
+	if paths, _ := searchPaths(t, index, &SearchQuery{}, 100, 100); len(paths) != 0 {
+		t.Fatalf("expected object to be deleted. got: %v", paths)
+	}
+}
+
+func TestObjectIndexLastPath(t *testing.T) {
+	index := newTestObjectIndex(t)
+
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := testIndexedObject("sage", "imagesampler-top", "000048b02d15bc7c", t0, "sample.jpg")
+	last := testIndexedObject("sage", "imagesampler-top", "000048b02d15bc7c", t0.Add(time.Hour), "sample.jpg")
+	index.Put(
+		first,
+		last,
+		testIndexedObject("sage", "imagesampler-top", "000048b02d15bc7d", t0, "sample.jpg"),
+		testIndexedObject("sage", "imagesampler-bottom", "000048b02d15bc7c", t0, "sample.jpg"),
+	)
+
+	testcases := map[string]struct {
+		Prefix string
+		Path   string
+		OK     bool
+	}{
+		"Middle":   {"sage/imagesampler-top/000048b02d15bc7c/", last.Path(), true},
+		"End":      {"sage/imagesampler-top/000048b02d15bc7d/", "sage/imagesampler-top/000048b02d15bc7d/" + first.Filename, true},
+		"Start":    {"sage/imagesampler-bottom/", "sage/imagesampler-bottom/000048b02d15bc7c/" + first.Filename, true},
+		"Missing":  {"sage/imagesampler-top/000048b02d15bc7e/", "", false},
+		"AfterAll": {"zzz/", "", false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			p, ok, err := index.LastPath(tc.Prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tc.Path || ok != tc.OK {
+				t.Fatalf("incorrect last path. got: %q %v want: %q %v", p, ok, tc.Path, tc.OK)
+			}
+		})
+	}
+}
+
+func TestIndexCrawler(t *testing.T) {
+	index := newTestObjectIndex(t)
+
+	storage := &mockStorage{files: map[string][]byte{
+		"node-data/sage/imagesampler-top/000048b02d15bc7c/1672531200000000000-sample.jpg": []byte("a"),
+		"node-data/sage/imagesampler-top/000048b02d15bc7d/1672531200000000000-sample.jpg": []byte("bb"),
+		"node-data/sage/imagesampler-top/000048b02d15bc7d/not-a-file":                     []byte("c"),
+	}}
+
+	crawler := &IndexCrawler{
+		Index:      index,
+		Lister:     storage,
+		RootFolder: "node-data",
+	}
+
+	if err := crawler.Scan(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 2 {
+		t.Fatalf("incorrect number of indexed objects. got: %d want: 2", index.Len())
+	}
+
+	o, ok, err := index.Get("sage/imagesampler-top/000048b02d15bc7d/1672531200000000000-sample.jpg")
+	if err != nil || !ok {
+		t.Fatalf("expected object to be indexed: %v", err)
+	}
+	if o.Size != 2 || !o.Timestamp.Equal(time.Unix(0, 1672531200000000000)) {
+		t.Fatalf("incorrect indexed object: %+v", o)
+	}
+
+	storage.files["node-data/sage/imagesampler-top/000048b02d15bc7c/1672617600000000000-sample.jpg"] = []byte("d")
+	delete(storage.files, "node-data/sage/imagesampler-top/000048b02d15bc7d/1672531200000000000-sample.jpg")
+
+	// incremental scans only add new objects.
+	if err := crawler.Scan(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 3 {
+		t.Fatalf("incorrect number of indexed objects. got: %d want: 3", index.Len())
+	}
+
+	// full scans also remove deleted objects, including prefixes which no longer exist.
+	if err := crawler.Scan(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 2 {
+		t.Fatalf("incorrect number of indexed objects. got: %d want: 2", index.Len())
+	}
+	if _, ok, _ := index.Get("sage/imagesampler-top/000048b02d15bc7d/1672531200000000000-sample.jpg"); ok {
+		t.Fatalf("expected deleted object to be removed")
+	}
+}
+
+func TestObjectIndexFollow(t *testing.T) {
+	index := newTestObjectIndex(t)
+	bus := NewEventBus()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go index.Follow(ctx, bus, nil)
+
+	for bus.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	f := &StorageFile{
+		JobID:     "sage",
+		TaskID:    "imagesampler-top",
+		NodeID:    "000048b02d15bc7c",
+		Filename:  "1672531200000000000-sample.jpg",
+		Timestamp: time.Unix(0, 1672531200000000000),
+	}
+
+	waitForLen := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for index.Len() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("incorrect number of indexed objects. got: %d want: %d", index.Len(), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	bus.Publish(&ObjectEvent{Type: ObjectCreated, File: f, Size: 10})
+	waitForLen(1)
+	bus.Publish(&ObjectEvent{Type: ObjectRemoved, File: f})
+	waitForLen(0)
+}
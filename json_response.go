@@ -17,14 +17,68 @@ func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	e.Encode(data)
 }
 
-func respondJSONError(w http.ResponseWriter, statusCode int, msg string, args ...interface{}) {
-	type response struct {
-		Error string `json:"error,omitempty"`
+// problem is an RFC 7807 problem details error response. Code is a stable, machine readable
+// error code and RequestID matches the X-Request-ID response header.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorCodes are the default error codes for each status code.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:                 "bad_request",
+	http.StatusUnauthorized:               "unauthorized",
+	http.StatusForbidden:                  "forbidden",
+	http.StatusNotFound:                   "not_found",
+	http.StatusMethodNotAllowed:           "method_not_allowed",
+	http.StatusConflict:                   "conflict",
+	http.StatusRequestEntityTooLarge:      "request_too_large",
+	http.StatusTooManyRequests:            "too_many_requests",
+	http.StatusUnavailableForLegalReasons: "unavailable_for_legal_reasons",
+	http.StatusInternalServerError:        "internal_error",
+	http.StatusNotImplemented:             "not_implemented",
+	http.StatusBadGateway:                 "bad_gateway",
+	http.StatusServiceUnavailable:         "unavailable",
+	http.StatusGatewayTimeout:             "gateway_timeout",
+}
+
+// errorCode returns the default error code for statusCode.
+func errorCode(statusCode int) string {
+	if code, ok := errorCodes[statusCode]; ok {
+		return code
+	}
+	if statusCode >= 500 {
+		return "internal_error"
 	}
-	if msg == "" {
-		respondJSON(w, statusCode, nil)
+	return "error"
+}
+
+// respondJSONError responds with a problem using the default error code for statusCode. The
+// detail is formatted from msg and args and omitted if msg is empty.
+func respondJSONError(w http.ResponseWriter, statusCode int, msg string, args ...interface{}) {
+	detail := msg
+	if len(args) > 0 {
+		detail = fmt.Sprintf(msg, args...)
 	}
-	respondJSON(w, statusCode, &response{
-		Error: fmt.Sprintf(msg, args...),
+	respondProblem(w, statusCode, errorCode(statusCode), detail)
+}
+
+// respondProblem responds with a problem using a specific error code.
+func respondProblem(w http.ResponseWriter, statusCode int, code string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(statusCode)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(&problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(statusCode),
+		Status:    statusCode,
+		Code:      code,
+		Detail:    detail,
+		RequestID: w.Header().Get("X-Request-ID"),
 	})
 }
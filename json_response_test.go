@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRespondJSONError(t *testing.T) {
+	testcases := map[string]struct {
+		Status int
+		Msg    string
+		Args   []interface{}
+		Want   problem
+	}{
+		"Empty": {
+			Status: http.StatusInternalServerError,
+			Want:   problem{Type: "about:blank", Title: "Internal Server Error", Status: 500, Code: "internal_error"},
+		},
+		"Format": {
+			Status: http.StatusBadRequest,
+			Msg:    "invalid ttl: %s",
+			Args:   []interface{}{"1x"},
+			Want:   problem{Type: "about:blank", Title: "Bad Request", Status: 400, Code: "bad_request", Detail: "invalid ttl: 1x"},
+		},
+		"LiteralPercent": {
+			Status: http.StatusBadRequest,
+			Msg:    `invalid path: "100%"`,
+			Want:   problem{Type: "about:blank", Title: "Bad Request", Status: 400, Code: "bad_request", Detail: `invalid path: "100%"`},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			respondJSONError(w, tc.Status, tc.Msg, tc.Args...)
+
+			if w.Code != tc.Status {
+				t.Fatalf("incorrect status code. got: %d want: %d", w.Code, tc.Status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Fatalf("incorrect content type: %s", ct)
+			}
+
+			// the body must be a single json object.
+			dec := json.NewDecoder(w.Body)
+			var got problem
+			if err := dec.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if dec.More() {
+				t.Fatalf("expected a single response body")
+			}
+			if got != tc.Want {
+				t.Fatalf("incorrect problem. got: %+v want: %+v", got, tc.Want)
+			}
+		})
+	}
+}
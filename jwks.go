@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWKSCache caches the public keys from a JSON Web Key Set, read from a URL or local file.
+// Keys are refreshed periodically and when a token references an unknown key ID.
+type JWKSCache struct {
+	// Source is an http(s) URL or a local file path.
+	Source string
+	// MinRefreshInterval limits how often unknown key IDs can trigger a refresh.
+	MinRefreshInterval time.Duration
+	Client             *http.Client
+	Logger             *log.Logger
+
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+	mu          sync.RWMutex
+	refreshMu   sync.Mutex
+}
+
+// NewJWKSCache creates a JWKSCache for source. Call Refresh to load the initial keys.
+func NewJWKSCache(source string, logger *log.Logger) *JWKSCache {
+	return &JWKSCache{
+		Source:             source,
+		MinRefreshInterval: time.Minute,
+		Client:             &http.Client{Timeout: 10 * time.Second},
+		Logger:             logger,
+		keys:               map[string]crypto.PublicKey{},
+	}
+}
+
+// Key returns the public key with the given ID, refreshing the key set if it is unknown.
+func (c *JWKSCache) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	lastRefresh := c.lastRefresh
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if time.Since(lastRefresh) >= c.MinRefreshInterval {
+		if err := c.Refresh(ctx); err != nil {
+			c.log("failed to refresh jwks: %s", err.Error())
+		}
+		c.mu.RLock()
+		key, ok = c.keys[kid]
+		c.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// Refresh reloads the key set from its source.
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	b, err := c.read(ctx)
+
+	c.mu.Lock()
+	c.lastRefresh = time.Now()
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+// Watch periodically refreshes the key set until ctx is done.
+func (c *JWKSCache) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.Refresh(ctx); err != nil {
+			c.log("failed to refresh jwks: %s", err.Error())
+		}
+	}
+}
+
+func (c *JWKSCache) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(c.Source, "http://") && !strings.HasPrefix(c.Source, "https://") {
+		return os.ReadFile(c.Source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jwks: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get jwks: %s", http.StatusText(resp.StatusCode))
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func (c *JWKSCache) log(format string, v ...interface{}) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Printf(format, v...)
+}
+
+// parseJWKS parses the RSA, EC and OKP signing keys from a JSON Web Key Set. Keys of other
+// types or uses are skipped.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	type jwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("error when reading jwks: %s", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		var err error
+
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			key, err = parseECJWK(k.Crv, k.X, k.Y)
+		case "OKP":
+			key, err = parseOKPJWK(k.Crv, k.X)
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %q: %s", k.Kid, err.Error())
+		}
+
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func parseRSAJWK(n, e string) (crypto.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid rsa exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: int(exp.Int64()),
+	}, nil
+}
+
+func parseECJWK(crv, x, y string) (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(xb),
+		Y:     new(big.Int).SetBytes(yb),
+	}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point is not on curve")
+	}
+	return key, nil
+}
+
+func parseOKPJWK(crv, x string) (crypto.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(xb) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 key size")
+	}
+	return ed25519.PublicKey(xb), nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWTClaims are the claims used from a validated token. Nodes, Projects and Jobs grant access
+// to files from matching nodes, nodes in matching projects and matching jobs. The value "*"
+// matches everything.
+type JWTClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	Expires   int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	Nodes     []string    `json:"nodes"`
+	Projects  []string    `json:"projects"`
+	Jobs      []string    `json:"jobs"`
+}
+
+// jwtAudience accepts either a single string or a list of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("aud must be a string or list of strings")
+	}
+	*a = list
+	return nil
+}
+
+// JWTValidator validates signed JWTs against a JWKS and checks their issuer, audience and expiry.
+type JWTValidator struct {
+	Keys     *JWKSCache
+	Issuer   string
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// isJWT returns whether token is structured as a JWT, with a JSON header and three segments.
+// It doesn't validate the token.
+func isJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && json.Valid(headerJSON)
+}
+
+// Validate checks the token signature and standard claims and returns its claims.
+func (v *JWTValidator) Validate(ctx context.Context, token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+
+	key, err := v.Keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+
+	var claims JWTClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %s", err.Error())
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Expires == 0:
+		return nil, fmt.Errorf("token has no expiry")
+	case !now.Before(time.Unix(claims.Expires, 0).Add(v.Leeway)):
+		return nil, fmt.Errorf("token expired")
+	case claims.NotBefore != 0 && now.Add(v.Leeway).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, fmt.Errorf("token not yet valid")
+	case v.Issuer != "" && claims.Issuer != v.Issuer:
+		return nil, fmt.Errorf("token issuer %q is not trusted", claims.Issuer)
+	case v.Audience != "" && !containsString(claims.Audience, v.Audience):
+		return nil, fmt.Errorf("token audience does not include %q", v.Audience)
+	}
+
+	return &claims, nil
+}
+
+var jwtCurveBits = map[string]int{
+	"ES256": 256,
+	"ES384": 384,
+	"ES512": 521,
+}
+
+// verifyJWTSignature checks the signature using the algorithm from the token header. The
+// algorithm must match the key type, so a token cannot choose a weaker check.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var h hash.Hash
+	var hashType crypto.Hash
+
+	switch alg {
+	case "RS256", "ES256":
+		h, hashType = sha256.New(), crypto.SHA256
+	case "RS384", "ES384":
+		h, hashType = sha512.New384(), crypto.SHA384
+	case "RS512", "ES512":
+		h, hashType = sha512.New(), crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		h.Write(signed)
+		if err := rsa.VerifyPKCS1v15(key, hashType, h.Sum(nil), signature); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") || jwtCurveBits[alg] != key.Curve.Params().BitSize {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid token signature")
+		}
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(key, signed, signature) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("token algorithm %q does not match key", alg)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// JWTAuthenticator extends TableAuthenticator to authorize JWT bearer tokens using the
+// node, project and job permissions in their claims.
+type JWTAuthenticator struct {
+	*TableAuthenticator
+	Validator *JWTValidator
+}
+
+// ValidateToken validates the token and returns a func reporting whether it grants access to a
+// file. Public files are authorized for any valid token.
+func (a *JWTAuthenticator) ValidateToken(ctx context.Context, token string) (func(f *StorageFile) bool, error) {
+	claims, err := a.Validator.Validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	requestLogInfoFromContext(ctx).Principal = claims.Subject
+	return func(f *StorageFile) bool {
+		return a.claimsAllow(claims, f) || a.allowed(f)
+	}, nil
+}
+
+func (a *JWTAuthenticator) claimsAllow(claims *JWTClaims, f *StorageFile) bool {
+	if matchPermission(claims.Jobs, f.JobID) || matchPermission(claims.Nodes, strings.ToLower(f.NodeID)) {
+		return true
+	}
+	if len(claims.Projects) == 0 {
+		return false
+	}
+	node, _, ok := a.Node(strings.ToLower(f.NodeID))
+	return ok && node.Project != "" && matchPermission(claims.Projects, node.Project)
+}
+
+func matchPermission(granted []string, s string) bool {
+	for _, g := range granted {
+		if g == "*" || strings.EqualFold(g, s) {
+			return true
+		}
+	}
+	return false
+}
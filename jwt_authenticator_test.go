@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJWTAuthenticator(t *testing.T) {
+	key := newTestECKey(t, "key")
+	commissionDate := time.Now().AddDate(-1, 0, 0)
+
+	table := NewTableAuthenticator()
+	table.UpdateConfig(&TableAuthenticatorConfig{
+		Nodes: map[string]*TableAuthenticatorNode{
+			"0000000000000001": {Project: "SAGE", CommissionDate: &commissionDate},
+			"0000000000000002": {Project: "OTHER", CommissionDate: &commissionDate},
+			"0000000000000003": {Project: "OTHER", CommissionDate: &commissionDate, Public: true},
+		},
+	})
+
+	auth := &JWTAuthenticator{
+		TableAuthenticator: table,
+		Validator:          newTestJWTValidator(t, key),
+	}
+
+	token := func(claims map[string]interface{}) string {
+		c := validTestClaims()
+		for k, v := range claims {
+			c[k] = v
+		}
+		return key.sign(t, c)
+	}
+
+	file := func(job, node string) *StorageFile {
+		return &StorageFile{JobID: job, TaskID: "task", NodeID: node, Timestamp: time.Now()}
+	}
+
+	testcases := map[string]struct {
+		Token      string
+		File       *StorageFile
+		Authorized bool
+	}{
+		"node":          {token(map[string]interface{}{"nodes": []string{"0000000000000002"}}), file("sage", "0000000000000002"), true},
+		"otherNode":     {token(map[string]interface{}{"nodes": []string{"0000000000000002"}}), file("sage", "0000000000000001"), false},
+		"project":       {token(map[string]interface{}{"projects": []string{"sage"}}), file("sage", "0000000000000001"), true},
+		"otherProject":  {token(map[string]interface{}{"projects": []string{"sage"}}), file("sage", "0000000000000002"), false},
+		"job":           {token(map[string]interface{}{"jobs": []string{"plugin-job"}}), file("plugin-job", "0000000000000002"), true},
+		"otherJob":      {token(map[string]interface{}{"jobs": []string{"plugin-job"}}), file("sage", "0000000000000002"), false},
+		"wildcard":      {token(map[string]interface{}{"nodes": []string{"*"}}), file("sage", "0000000000000002"), true},
+		"publicNode":    {token(nil), file("sage", "0000000000000003"), true},
+		"noPermissions": {token(nil), file("sage", "0000000000000001"), false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			authorized, err := auth.ValidateToken(context.Background(), tc.Token)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if authorized(tc.File) != tc.Authorized {
+				t.Fatalf("incorrect authorization. got: %v want: %v", !tc.Authorized, tc.Authorized)
+			}
+		})
+	}
+}
+
+func TestHandlerBearerToken(t *testing.T) {
+	key := newTestECKey(t, "key")
+
+	table := NewTableAuthenticator()
+	handler := &StorageHandler{
+		Storage: &mockStorage{},
+		Authenticator: &JWTAuthenticator{
+			TableAuthenticator: table,
+			Validator:          newTestJWTValidator(t, key),
+		},
+	}
+
+	do := func(authorization string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = "job/task/0000000000000001/1643842551600000001-sample.jpg"
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	claims := validTestClaims()
+	claims["nodes"] = []string{"0000000000000001"}
+	assertStatusCode(t, do("Bearer "+key.sign(t, claims)), http.StatusTemporaryRedirect)
+
+	claims["nodes"] = []string{"0000000000000002"}
+	assertStatusCode(t, do("Bearer "+key.sign(t, claims)), http.StatusForbidden)
+
+	resp := do("Bearer invalid")
+	assertStatusCode(t, resp, http.StatusUnauthorized)
+	if resp.Header.Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+		t.Fatalf("incorrect WWW-Authenticate header: %q", resp.Header.Get("WWW-Authenticate"))
+	}
+
+	// with a proxy, tokens which aren't JWTs are passed on to Django. JWTs are still checked here.
+	handler.Proxy = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	assertStatusCode(t, do("Bearer invalid"), http.StatusTeapot)
+	assertStatusCode(t, do("Bearer "+newTestECKey(t, "other").sign(t, validTestClaims())), http.StatusUnauthorized)
+	claims["nodes"] = []string{"0000000000000001"}
+	assertStatusCode(t, do("Bearer "+key.sign(t, claims)), http.StatusTemporaryRedirect)
+}
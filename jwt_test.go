@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJWTKey holds a private signing key and its JWK representation.
+type testJWTKey struct {
+	kid  string
+	alg  string
+	priv crypto.Signer
+}
+
+func newTestRSAKey(t *testing.T, kid string) *testJWTKey {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testJWTKey{kid: kid, alg: "RS256", priv: priv}
+}
+
+func newTestECKey(t *testing.T, kid string) *testJWTKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testJWTKey{kid: kid, alg: "ES256", priv: priv}
+}
+
+func newTestEdKey(t *testing.T, kid string) *testJWTKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testJWTKey{kid: kid, alg: "EdDSA", priv: priv}
+}
+
+func (k *testJWTKey) jwk() map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := k.priv.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kid": k.kid, "kty": "RSA", "use": "sig", "n": enc(pub.N.Bytes()), "e": enc(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kid": k.kid, "kty": "EC", "crv": "P-256", "x": enc(pub.X.FillBytes(make([]byte, 32))), "y": enc(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kid": k.kid, "kty": "OKP", "crv": "Ed25519", "x": enc(pub)}
+	}
+	panic("unsupported key")
+}
+
+func (k *testJWTKey) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	switch priv := k.priv.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, priv, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(priv, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeTestJWKS(t *testing.T, path string, keys ...*testJWTKey) {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.jwk())
+	}
+	b, _ := json.Marshal(set)
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestJWTValidator(t *testing.T, keys ...*testJWTKey) *JWTValidator {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, path, keys...)
+	cache := NewJWKSCache(path, nil)
+	if err := cache.Refresh(context.Background()); err != nil {
+		t.Fatalf("failed to load jwks: %s", err)
+	}
+	return &JWTValidator{
+		Keys:     cache,
+		Issuer:   "https://auth.example.org",
+		Audience: "object-store",
+	}
+}
+
+func validTestClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "user",
+		"iss": "https://auth.example.org",
+		"aud": []string{"object-store", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTValidate(t *testing.T) {
+	rsaKey := newTestRSAKey(t, "rsa")
+	ecKey := newTestECKey(t, "ec")
+	edKey := newTestEdKey(t, "ed")
+	unknownKey := newTestECKey(t, "unknown")
+
+	validator := newTestJWTValidator(t, rsaKey, ecKey, edKey)
+
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := validTestClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	testcases := map[string]struct {
+		Token string
+		Valid bool
+	}{
+		"rsa":            {rsaKey.sign(t, validTestClaims()), true},
+		"ec":             {ecKey.sign(t, validTestClaims()), true},
+		"ed25519":        {edKey.sign(t, validTestClaims()), true},
+		"audienceString": {rsaKey.sign(t, with("aud", "object-store")), true},
+		"unknownKey":     {unknownKey.sign(t, validTestClaims()), false},
+		"expired":        {rsaKey.sign(t, with("exp", time.Now().Add(-time.Hour).Unix())), false},
+		"noExpiry":       {rsaKey.sign(t, with("exp", nil)), false},
+		"notYetValid":    {rsaKey.sign(t, with("nbf", time.Now().Add(time.Hour).Unix())), false},
+		"wrongIssuer":    {rsaKey.sign(t, with("iss", "https://evil.example.org")), false},
+		"wrongAudience":  {rsaKey.sign(t, with("aud", "other")), false},
+		"malformed":      {"not.a.token", false},
+		"tooFewParts":    {"abc.def", false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, err := validator.Validate(context.Background(), tc.Token)
+			if tc.Valid && err != nil {
+				t.Fatalf("expected valid token but got %s", err)
+			}
+			if !tc.Valid && err == nil {
+				t.Fatalf("expected invalid token")
+			}
+		})
+	}
+}
+
+func TestJWTValidateAlgorithmMismatch(t *testing.T) {
+	rsaKey := newTestRSAKey(t, "rsa")
+	validator := newTestJWTValidator(t, rsaKey)
+
+	for _, alg := range []string{"none", "HS256", "ES256", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			forged := &testJWTKey{kid: "rsa", alg: alg, priv: rsaKey.priv}
+			if _, err := validator.Validate(context.Background(), forged.sign(t, validTestClaims())); err == nil {
+				t.Fatalf("expected %s token for rsa key to be rejected", alg)
+			}
+		})
+	}
+
+	// tampering with the payload invalidates the signature.
+	token := rsaKey.sign(t, validTestClaims())
+	other := rsaKey.sign(t, map[string]interface{}{"sub": "admin", "exp": time.Now().Add(time.Hour).Unix()})
+	parts, otherParts := strings.Split(token, "."), strings.Split(other, ".")
+	if _, err := validator.Validate(context.Background(), parts[0]+"."+otherParts[1]+"."+parts[2]); err == nil {
+		t.Fatalf("expected tampered token to be rejected")
+	}
+}
+
+func TestJWKSCacheRotation(t *testing.T) {
+	oldKey := newTestECKey(t, "old")
+	newKey := newTestECKey(t, "new")
+
+	var mu sync.Mutex
+	served := []*testJWTKey{oldKey}
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		var set struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		for _, k := range served {
+			set.Keys = append(set.Keys, k.jwk())
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer server.Close()
+
+	cache := NewJWKSCache(server.URL, nil)
+	cache.MinRefreshInterval = 0
+	validator := &JWTValidator{Keys: cache}
+
+	if _, err := validator.Validate(context.Background(), oldKey.sign(t, validTestClaims())); err != nil {
+		t.Fatalf("expected token to be valid after initial fetch: %s", err)
+	}
+
+	mu.Lock()
+	served = []*testJWTKey{newKey}
+	mu.Unlock()
+
+	// an unknown key id triggers a refresh.
+	if _, err := validator.Validate(context.Background(), newKey.sign(t, validTestClaims())); err != nil {
+		t.Fatalf("expected token signed by rotated key to be valid: %s", err)
+	}
+	if _, err := validator.Validate(context.Background(), oldKey.sign(t, validTestClaims())); err == nil {
+		t.Fatalf("expected token signed by removed key to be rejected")
+	}
+
+	// unknown key ids do not trigger refreshes within the minimum refresh interval.
+	cache.MinRefreshInterval = time.Hour
+	mu.Lock()
+	before := requests
+	mu.Unlock()
+	validator.Validate(context.Background(), newTestECKey(t, "other").sign(t, validTestClaims()))
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != before {
+		t.Fatalf("expected no refresh within minimum refresh interval")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// JSONLogger writes records to Out as one JSON object per line. It is safe for concurrent use.
+type JSONLogger struct {
+	Out io.Writer
+	mu  sync.Mutex
+}
+
+// NewJSONLogger creates a JSONLogger writing to out.
+func NewJSONLogger(out io.Writer) *JSONLogger {
+	return &JSONLogger{Out: out}
+}
+
+// Log writes record as a single line of JSON.
+func (l *JSONLogger) Log(record interface{}) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.Out.Write(b)
+	return err
+}
+
+// RotatingFile is a log file which is rotated once it reaches MaxBytes. Rotated files are
+// renamed with a numeric suffix, path.1 being the most recent, and at most MaxBackups are kept.
+type RotatingFile struct {
+	Path       string
+	MaxBytes   int64
+	MaxBackups int
+
+	file *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+// OpenRotatingFile opens path for appending, rotating it once it reaches maxBytes.
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		Path:       path,
+		MaxBytes:   maxBytes,
+		MaxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.MaxBytes > 0 && f.size > 0 && f.size+int64(len(b)) > f.MaxBytes {
+		if err := f.rotate(); err != nil {
+			// keep writing to the current file rather than dropping records. rotation is tried
+			// again once another MaxBytes has been written.
+			log.Printf("failed to rotate log file %s: %s", f.Path, err.Error())
+			f.size = 0
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// openLogFile opens log files. It is replaced in tests to simulate failures.
+var openLogFile = os.OpenFile
+
+func (f *RotatingFile) open() error {
+	file, err := openLogFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file aside and opens a new one. The current file stays open until
+// the new one is, so it can still be written to if rotation fails. Without backups the current
+// file is truncated in place.
+func (f *RotatingFile) rotate() error {
+	if f.MaxBackups <= 0 {
+		if err := f.file.Truncate(0); err != nil {
+			return err
+		}
+		f.size = 0
+		return nil
+	}
+
+	os.Remove(f.backupPath(f.MaxBackups))
+	for i := f.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(f.backupPath(i), f.backupPath(i+1))
+	}
+	if err := os.Rename(f.Path, f.backupPath(1)); err != nil {
+		return err
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		// move the current file back so records keep going to Path.
+		if rerr := os.Rename(f.backupPath(1), f.Path); rerr != nil {
+			log.Printf("failed to restore log file %s: %s", f.Path, rerr.Error())
+		}
+		return err
+	}
+	return old.Close()
+}
+
+func (f *RotatingFile) backupPath(i int) string {
+	return f.Path + "." + strconv.Itoa(i)
+}
+
+// OpenLogSink opens the destination for a log stream. The destination is either "stdout",
+// "stderr" or a file path, which is rotated once it reaches maxBytes.
+func OpenLogSink(dest string, maxBytes int64, maxBackups int) (io.Writer, error) {
+	switch dest {
+	case "":
+		return nil, fmt.Errorf("log destination must be nonempty")
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return OpenRotatingFile(dest, maxBytes, maxBackups)
+}
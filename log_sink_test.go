@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertFileContent := func(path, want string) {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("incorrect content in %s. got: %q want: %q", path, b, want)
+		}
+	}
+
+	// each line is 6 bytes, so each write after the first one into a file rotates it.
+	assertFileContent(path, "line4\n")
+	assertFileContent(path+".1", "line3\n")
+	assertFileContent(path+".2", "line2\n")
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups to be kept")
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	os.WriteFile(path, []byte("existing\n"), 0600)
+
+	f, err := OpenRotatingFile(path, 1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new\n"))
+	f.Close()
+
+	b, _ := os.ReadFile(path)
+	if string(b) != "existing\nnew\n" {
+		t.Fatalf("expected log to be appended. got: %q", b)
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	// a non-empty directory in place of the backup makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"line1\n", "line2\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("expected write to succeed when rotation fails: %s", err)
+		}
+	}
+
+	b, _ := os.ReadFile(path)
+	if string(b) != "line1\nline2\n" {
+		t.Fatalf("expected records to be kept in the current file. got: %q", b)
+	}
+
+	// rotation is tried again once the file fills up again.
+	os.RemoveAll(path + ".1")
+	if _, err := f.Write([]byte("line3\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ = os.ReadFile(path)
+	if string(b) != "line3\n" {
+		t.Fatalf("expected file to be rotated. got: %q", b)
+	}
+	b, _ = os.ReadFile(path + ".1")
+	if string(b) != "line1\nline2\n" {
+		t.Fatalf("incorrect backup. got: %q", b)
+	}
+}
+
+func TestRotatingFileOpenFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	openLogFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		return nil, os.ErrPermission
+	}
+	defer func() { openLogFile = os.OpenFile }()
+
+	for _, line := range []string{"line1\n", "line2\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("expected write to succeed when rotation fails: %s", err)
+		}
+	}
+
+	b, _ := os.ReadFile(path)
+	if string(b) != "line1\nline2\n" {
+		t.Fatalf("expected records to be kept in the current file. got: %q", b)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("expected backup to be moved back. got: %v", err)
+	}
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := OpenRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"line1\n", "line2\n", "line3\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, _ := os.ReadFile(path)
+	if string(b) != "line3\n" {
+		t.Fatalf("expected file to be truncated. got: %q", b)
+	}
+}
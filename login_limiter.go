@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LoginFailures tracks failed login attempts for a single key.
+type LoginFailures struct {
+	Count int
+	Last  time.Time
+}
+
+// LoginFailureStore records failed login attempts. Implementations backed by a shared
+// database can be used to share lockouts across replicas.
+type LoginFailureStore interface {
+	Get(ctx context.Context, key string) (LoginFailures, error)
+	AddFailure(ctx context.Context, key string, now time.Time) (LoginFailures, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// LoginLimiter locks out remote addresses and usernames after repeated failed logins. The
+// lockout doubles with each failure past the threshold.
+type LoginLimiter struct {
+	Store       LoginFailureStore
+	Threshold   int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	// TrustForwardedFor uses the last X-Forwarded-For address as the remote address. Only enable
+	// this behind a proxy which appends to the header, otherwise clients can choose their own
+	// address.
+	TrustForwardedFor bool
+}
+
+// NewLoginLimiter creates a LoginLimiter with an in-memory store and default settings.
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		Store:       NewMemoryLoginFailureStore(100000, time.Hour),
+		Threshold:   5,
+		BaseLockout: time.Second,
+		MaxLockout:  15 * time.Minute,
+	}
+}
+
+// Check returns how long until r may attempt to log in as username. It returns zero if
+// the attempt may proceed.
+func (l *LoginLimiter) Check(r *http.Request, username string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range l.keys(r, username) {
+		failures, err := l.Store.Get(r.Context(), key)
+		if err != nil {
+			// fail open so an unavailable store does not lock everyone out.
+			continue
+		}
+		if d := l.lockedUntil(failures).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// Failure records a failed login attempt by r as username.
+func (l *LoginLimiter) Failure(r *http.Request, username string) {
+	now := time.Now()
+	for _, key := range l.keys(r, username) {
+		failures, err := l.Store.AddFailure(r.Context(), key, now)
+		if err == nil && failures.Count == l.Threshold {
+			authLockouts.Inc()
+		}
+	}
+}
+
+// Success clears failed login attempts by r as username.
+func (l *LoginLimiter) Success(r *http.Request, username string) {
+	for _, key := range l.keys(r, username) {
+		l.Store.Reset(r.Context(), key)
+	}
+}
+
+func (l *LoginLimiter) keys(r *http.Request, username string) []string {
+	return []string{
+		"addr:" + clientIP(r, l.TrustForwardedFor),
+		"user:" + username,
+	}
+}
+
+func (l *LoginLimiter) lockedUntil(failures LoginFailures) time.Time {
+	if failures.Count < l.Threshold {
+		return time.Time{}
+	}
+	lockout := l.BaseLockout
+	for i := l.Threshold; i < failures.Count && lockout < l.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > l.MaxLockout {
+		lockout = l.MaxLockout
+	}
+	return failures.Last.Add(lockout)
+}
+
+// MemoryLoginFailureStore is an in-memory LoginFailureStore. It holds at most maxEntries keys,
+// evicting the least recently failed first, and forgets keys with no failures for ttl.
+type MemoryLoginFailureStore struct {
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+	mu         sync.Mutex
+}
+
+type memoryLoginFailureEntry struct {
+	key      string
+	failures LoginFailures
+}
+
+func NewMemoryLoginFailureStore(maxEntries int, ttl time.Duration) *MemoryLoginFailureStore {
+	return &MemoryLoginFailureStore{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func (s *MemoryLoginFailureStore) Get(ctx context.Context, key string) (LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return LoginFailures{}, nil
+	}
+	entry := elem.Value.(*memoryLoginFailureEntry)
+	if time.Since(entry.failures.Last) > s.ttl {
+		s.remove(elem)
+		return LoginFailures{}, nil
+	}
+	return entry.failures, nil
+}
+
+func (s *MemoryLoginFailureStore) AddFailure(ctx context.Context, key string, now time.Time) (LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		for s.order.Len() >= s.maxEntries {
+			s.remove(s.order.Back())
+		}
+		elem = s.order.PushFront(&memoryLoginFailureEntry{key: key})
+		s.entries[key] = elem
+	}
+
+	entry := elem.Value.(*memoryLoginFailureEntry)
+	if now.Sub(entry.failures.Last) > s.ttl {
+		entry.failures.Count = 0
+	}
+	entry.failures.Count++
+	entry.failures.Last = now
+	s.order.MoveToFront(elem)
+	return entry.failures, nil
+}
+
+func (s *MemoryLoginFailureStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	return nil
+}
+
+func (s *MemoryLoginFailureStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(*memoryLoginFailureEntry).key)
+}
+
+// checkBasicAuth checks the basic auth credentials of r with authenticated. Clients are locked
+// out after repeated failures if limiter is not nil. It writes a response and returns false if
+// the client is locked out or not authorized.
+func checkBasicAuth(w http.ResponseWriter, r *http.Request, limiter *LoginLimiter, authenticated func(username, password string) bool) (string, bool) {
+	username, password, hasAuth := r.BasicAuth()
+
+	if hasAuth && limiter != nil {
+		if wait := limiter.Check(r, username); wait > 0 {
+			authFailures.WithLabelValues("locked_out").Inc()
+			setRetryAfter(w, wait)
+			respondProblem(w, http.StatusTooManyRequests, "locked_out", "too many failed login attempts")
+			return "", false
+		}
+	}
+
+	if !hasAuth || !authenticated(username, password) {
+		if hasAuth {
+			authFailures.WithLabelValues("invalid_credentials").Inc()
+			if limiter != nil {
+				limiter.Failure(r, username)
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Basic domain=storage.sagecontinuum.org")
+		respondJSONError(w, http.StatusUnauthorized, "not authorized")
+		return "", false
+	}
+
+	if limiter != nil {
+		limiter.Success(r, username)
+	}
+	return username, true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterLockedUntil(t *testing.T) {
+	limiter := &LoginLimiter{
+		Threshold:   3,
+		BaseLockout: time.Second,
+		MaxLockout:  10 * time.Second,
+	}
+	last := time.Unix(1000, 0)
+
+	testcases := []struct {
+		Count   int
+		Lockout time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, tc := range testcases {
+		until := limiter.lockedUntil(LoginFailures{Count: tc.Count, Last: last})
+		if tc.Lockout == 0 {
+			if !until.IsZero() {
+				t.Fatalf("expected no lockout for %d failures. got: %s", tc.Count, until)
+			}
+			continue
+		}
+		if got := until.Sub(last); got != tc.Lockout {
+			t.Fatalf("incorrect lockout for %d failures. got: %s want: %s", tc.Count, got, tc.Lockout)
+		}
+	}
+}
+
+func TestMemoryLoginFailureStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryLoginFailureStore(2, time.Minute)
+	now := time.Now()
+
+	store.AddFailure(ctx, "a", now)
+	store.AddFailure(ctx, "a", now)
+	store.AddFailure(ctx, "b", now)
+
+	if f, _ := store.Get(ctx, "a"); f.Count != 2 {
+		t.Fatalf("incorrect failure count for a. got: %d want: 2", f.Count)
+	}
+
+	// adding a third key evicts the least recently failed key.
+	store.AddFailure(ctx, "a", now)
+	store.AddFailure(ctx, "c", now)
+	if f, _ := store.Get(ctx, "b"); f.Count != 0 {
+		t.Fatalf("expected b to be evicted. got: %d failures", f.Count)
+	}
+	if f, _ := store.Get(ctx, "a"); f.Count != 3 {
+		t.Fatalf("expected a to be kept. got: %d failures", f.Count)
+	}
+
+	// failures older than the ttl are forgotten.
+	if f, _ := store.AddFailure(ctx, "c", now.Add(2*time.Minute)); f.Count != 1 {
+		t.Fatalf("expected stale failures to be reset. got: %d failures", f.Count)
+	}
+
+	store.Reset(ctx, "a")
+	if f, _ := store.Get(ctx, "a"); f.Count != 0 {
+		t.Fatalf("expected a to be reset. got: %d failures", f.Count)
+	}
+}
+
+func TestHandlerLoginLockout(t *testing.T) {
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Credentials: []*Credential{{Username: "user", Password: "secret"}},
+	})
+
+	limiter := NewLoginLimiter()
+	limiter.Threshold = 3
+	limiter.BaseLockout = time.Hour
+
+	handler := &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: auth,
+		LoginLimiter:  limiter,
+	}
+
+	do := func(remoteAddr, username, password string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = "job/task/node/1643842551600000001-sample.jpg"
+		r.RemoteAddr = remoteAddr
+		r.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// a successful login resets earlier failures.
+	assertStatusCode(t, do("10.0.0.1:1234", "user", "wrong"), http.StatusUnauthorized)
+	assertStatusCode(t, do("10.0.0.1:1234", "user", "wrong"), http.StatusUnauthorized)
+	assertStatusCode(t, do("10.0.0.1:1234", "user", "secret"), http.StatusTemporaryRedirect)
+
+	for i := 0; i < 3; i++ {
+		assertStatusCode(t, do("10.0.0.1:1234", "guess", "wrong"), http.StatusUnauthorized)
+	}
+
+	// locked out by address, even with the correct password.
+	resp := do("10.0.0.1:5678", "user", "secret")
+	assertStatusCode(t, resp, http.StatusTooManyRequests)
+	if retry, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || retry <= 0 {
+		t.Fatalf("expected positive Retry-After header. got: %q", resp.Header.Get("Retry-After"))
+	}
+
+	// locked out by username from another address.
+	assertStatusCode(t, do("10.0.0.2:1234", "guess", "wrong"), http.StatusTooManyRequests)
+
+	// other clients are unaffected.
+	assertStatusCode(t, do("10.0.0.2:1234", "user", "secret"), http.StatusTemporaryRedirect)
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "172.16.0.1, 192.168.1.1")
+
+	if ip := clientIP(r, false); ip != "10.0.0.1" {
+		t.Fatalf("incorrect client ip. got: %s want: 10.0.0.1", ip)
+	}
+	// the client controls all but the address appended by the proxy.
+	if ip := clientIP(r, true); ip != "192.168.1.1" {
+		t.Fatalf("incorrect forwarded client ip. got: %s want: 192.168.1.1", ip)
+	}
+	r.Header.Add("X-Forwarded-For", "192.168.1.2")
+	if ip := clientIP(r, true); ip != "192.168.1.2" {
+		t.Fatalf("incorrect forwarded client ip. got: %s want: 192.168.1.2", ip)
+	}
+}
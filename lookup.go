@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FileLocator finds stored files by position under a {job}/{task}/{node}/ prefix. Filenames start
+// with a fixed width nanosecond timestamp, so files sort by time within a prefix.
+type FileLocator interface {
+	// Neighbors returns the last file under prefix sorted before key and the first file sorted at
+	// or after key. Keys are relative to the root folder. Either file is nil if there is none.
+	Neighbors(ctx context.Context, prefix, key string) (before, after *IndexedObject, err error)
+}
+
+// CachingLocator caches the results of another FileLocator for TTL.
+type CachingLocator struct {
+	Locator FileLocator
+	TTL     time.Duration
+	// MaxEntries bounds the cache size. The cache is cleared when it is full.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*locatorCacheEntry
+}
+
+type locatorCacheEntry struct {
+	before  *IndexedObject
+	after   *IndexedObject
+	expires time.Time
+}
+
+func (c *CachingLocator) Neighbors(ctx context.Context, prefix, key string) (*IndexedObject, *IndexedObject, error) {
+	now := time.Now()
+	cacheKey := prefix + "\x00" + key
+
+	c.mu.Lock()
+	if e, ok := c.entries[cacheKey]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		return e.before, e.after, nil
+	}
+	c.mu.Unlock()
+
+	before, after, err := c.Locator.Neighbors(ctx, prefix, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	if c.entries == nil || (c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries) {
+		c.entries = make(map[string]*locatorCacheEntry)
+	}
+	c.entries[cacheKey] = &locatorCacheEntry{
+		before:  before,
+		after:   after,
+		expires: now.Add(c.TTL),
+	}
+	c.mu.Unlock()
+
+	return before, after, nil
+}
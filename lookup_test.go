@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestLookupStorage() *mockStorage {
+	return &mockStorage{files: map[string][]byte{
+		"node-data/sage/imagesampler-top/0000000000000001/1672531200000000000-sample.jpg": []byte("a"),
+		"node-data/sage/imagesampler-top/0000000000000001/1672531260000000000-sample.jpg": []byte("b"),
+		"node-data/sage/imagesampler-top/0000000000000001/1672531320000000000-sample.jpg": []byte("c"),
+		"node-data/sage/imagesampler-top/0000000000000002/1672531230000000000-sample.jpg": []byte("d"),
+	}}
+}
+
+// newTestLookupIndex creates an index of the files in storage.
+func newTestLookupIndex(t *testing.T, storage *mockStorage) *ObjectIndex {
+	index := newTestObjectIndex(t)
+	crawler := &IndexCrawler{Index: index, Lister: storage, RootFolder: "node-data"}
+	if err := crawler.Scan(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestFileLocators(t *testing.T) {
+	index := newTestLookupIndex(t, newTestLookupStorage())
+
+	locators := map[string]FileLocator{
+		"Index":   index,
+		"Caching": &CachingLocator{Locator: index, TTL: time.Minute},
+	}
+
+	prefix := "sage/imagesampler-top/0000000000000001/"
+
+	testcases := map[string]struct {
+		Key    string
+		Before string
+		After  string
+	}{
+		"Start":  {prefix, "", "1672531200000000000-sample.jpg"},
+		"Middle": {prefix + "1672531261", "1672531260000000000-sample.jpg", "1672531320000000000-sample.jpg"},
+		"Exact":  {prefix + "1672531260000000000-sample.jpg", "1672531200000000000-sample.jpg", "1672531260000000000-sample.jpg"},
+		"End":    {prefix + "\xff", "1672531320000000000-sample.jpg", ""},
+	}
+
+	filename := func(o *IndexedObject) string {
+		if o == nil {
+			return ""
+		}
+		return o.Filename
+	}
+
+	for name, locator := range locators {
+		for tcName, tc := range testcases {
+			t.Run(name+tcName, func(t *testing.T) {
+				before, after, err := locator.Neighbors(context.Background(), prefix, tc.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if filename(before) != tc.Before || filename(after) != tc.After {
+					t.Fatalf("incorrect neighbors. got: %q %q want: %q %q", filename(before), filename(after), tc.Before, tc.After)
+				}
+			})
+		}
+	}
+}
+
+func TestCachingLocator(t *testing.T) {
+	index := newTestLookupIndex(t, newTestLookupStorage())
+	locator := &CachingLocator{
+		Locator: index,
+		TTL:     50 * time.Millisecond,
+	}
+
+	prefix := "sage/imagesampler-top/0000000000000001/"
+
+	latest, _, _ := locator.Neighbors(context.Background(), prefix, prefix+"\xff")
+	index.Put(testIndexedObject("sage", "imagesampler-top", "0000000000000001", time.Unix(0, 1672531380000000000), "sample.jpg"))
+	cached, _, _ := locator.Neighbors(context.Background(), prefix, prefix+"\xff")
+	if cached.Path() != latest.Path() {
+		t.Fatalf("expected cached result. got: %s want: %s", cached.Path(), latest.Path())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	updated, _, _ := locator.Neighbors(context.Background(), prefix, prefix+"\xff")
+	if updated.Filename != "1672531380000000000-sample.jpg" {
+		t.Fatalf("expected expired result to be refreshed. got: %s", updated.Filename)
+	}
+}
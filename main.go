@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,47 +20,350 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
-	addr := flag.String("addr", "127.0.0.1:8080", "address to listen on")
+	addr := flag.String("addr", "", "address to listen on. overrides the config file and addr env var")
+	configPath := flag.String("config", os.Getenv("configFile"), "path to yaml config file")
+	checkConfig := flag.Bool("check-config", false, "validate the config and exit")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its bcrypt hash and exit")
 	flag.Parse()
 
+	if *hashPassword {
+		password, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("failed to read password: %s", err.Error())
+		}
+		hash, err := bcrypt.GenerateFromPassword(bytes.TrimRight(password, "\r\n"), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("failed to hash password: %s", err.Error())
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("invalid config: %s", err.Error())
+	}
+	if *addr != "" {
+		config.Addr = *addr
+	}
+
+	if *checkConfig {
+		fmt.Println("config ok")
+		return
+	}
+
 	log.Printf("starting sage-object-store version %s", ReleaseVersion)
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if config.Tracing.Exporter != "" {
+		provider, err := NewTracerProvider(ctx, config.Tracing.Exporter, os.Stdout)
+		if err != nil {
+			log.Fatalf("failed to set up tracing: %s", err.Error())
+		}
+		setupTracing(provider)
+		defer provider.Shutdown(context.Background())
+	}
+
 	router := http.NewServeMux()
 
-	authStaticCredentials, err := ParseStaticCredentials(os.Getenv("authStaticCredentials"))
+	authConfig, err := config.TableAuthenticatorConfig()
 	if err != nil {
-		log.Fatalf("failed to parse authStaticCredentials env var")
+		log.Fatal(err)
 	}
 
 	auth := NewTableAuthenticator()
+	auth.UpdateConfig(authConfig)
 
-	go periodicallyUpdateAuthConfig(authStaticCredentials, auth)
+	registerNodeTableAge(auth)
+	go periodicallyUpdateAuthConfig(ctx, auth, config.Auth.NodeTableURL)
 
-	credentials := credentials.NewStaticCredentials(mustGetenv("s3accessKeyID"), mustGetenv("s3secretAccessKey"), "")
+	var dataAuth Authenticator = auth
+
+	if config.Auth.JWKSURL != "" {
+		keys := NewJWKSCache(config.Auth.JWKSURL, log.Default())
+		if err := keys.Refresh(ctx); err != nil {
+			log.Printf("failed to load jwks: %s", err.Error())
+		}
+		go keys.Watch(ctx, 10*time.Minute)
+
+		dataAuth = &JWTAuthenticator{
+			TableAuthenticator: auth,
+			Validator: &JWTValidator{
+				Keys:     keys,
+				Issuer:   config.Auth.JWTIssuer,
+				Audience: config.Auth.JWTAudience,
+				Leeway:   30 * time.Second,
+			},
+		}
+	}
+
+	credentials := credentials.NewStaticCredentials(config.S3.AccessKeyID, config.S3.SecretAccessKey, "")
 
 	session := session.Must(session.NewSession(&aws.Config{
 		Credentials:      credentials,
-		Endpoint:         aws.String(mustGetenv("s3Endpoint")),
-		Region:           aws.String("us-west-2"),
-		DisableSSL:       aws.Bool(false),
+		Endpoint:         aws.String(config.S3.Endpoint),
+		Region:           aws.String(config.S3.Region),
+		DisableSSL:       aws.Bool(config.S3.DisableSSL),
 		S3ForcePathStyle: aws.Bool(true),
 	}))
+	instrumentS3Handlers(&session.Handlers)
 
-	router.Handle("/api/v1/data/", http.StripPrefix("/api/v1/data/", &StorageHandler{
-		Storage: &S3Storage{
-			S3:     s3.New(session),
-			Bucket: mustGetenv("s3bucket"),
-		},
-		RootFolder:    mustGetenv("s3rootFolder"),
-		Authenticator: auth,
-		Logger:        log.Default(),
-	}))
+	var s3InFlight *ConcurrencyLimiter
+	if config.Limits.S3MaxInFlight > 0 {
+		s3InFlight = NewConcurrencyLimiter(config.Limits.S3MaxInFlight, config.Limits.S3MaxInFlightWait)
+	}
+
+	storage := &S3Storage{
+		S3:       s3.New(session),
+		Bucket:   config.S3.Bucket,
+		InFlight: s3InFlight,
+	}
+	storage.SetPresignTTLs(config.S3.PresignTTL, config.S3.UploadPresignTTL)
+
+	rootFolder := config.S3.RootFolder
+
+	var usage *UsageLedger
+	if config.Quotas.LedgerFile != "" {
+		quotas, err := config.QuotaPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		usage, err = OpenUsageLedger(config.Quotas.LedgerFile, quotas)
+		if err != nil {
+			log.Fatalf("failed to open usage ledger: %s", err.Error())
+		}
+		defer usage.Close()
+	}
+
+	var index *ObjectIndex
+	if config.Index.File != "" {
+		index, err = OpenObjectIndex(config.Index.File)
+		if err != nil {
+			log.Fatalf("failed to open object index: %s", err.Error())
+		}
+		defer index.Close()
+		registerIndexSize(index)
+
+		crawler := &IndexCrawler{
+			Index:      index,
+			Lister:     storage,
+			RootFolder: rootFolder,
+			Logger:     log.Default(),
+		}
+		go crawler.Watch(ctx, config.Index.ScanInterval, config.Index.FullScanInterval)
+	}
+
+	// bucket notifications are published to the event bus to keep the index up to date between
+	// scans.
+	events := NewEventBus()
+	if index != nil {
+		go index.Follow(ctx, events, log.Default())
+	}
+
+	shareKeys, err := ParseShareKeys(config.Share.Keys)
+	if err != nil {
+		log.Fatalf("invalid share keys: %s", err.Error())
+	}
+
+	var shareSigner *ShareSigner
+	if len(shareKeys) > 0 {
+		shareSigner = &ShareSigner{
+			Keys:   shareKeys,
+			MaxTTL: 7 * 24 * time.Hour,
+		}
+	}
+
+	// credentials, embargoes, task policies, presign ttls, quotas and share keys are reloaded when
+	// the config or credentials file changes or on SIGHUP. other changes require a restart.
+	reloadConfig := make(chan os.Signal, 1)
+	signal.Notify(reloadConfig, syscall.SIGHUP)
+	configWatcher := &ConfigWatcher{
+		Path:   *configPath,
+		Logger: log.Default(),
+	}
+	go configWatcher.Watch(ctx, config, 10*time.Second, reloadConfig, func(config *Config) {
+		authConfig, err := config.TableAuthenticatorConfig()
+		if err != nil {
+			log.Printf("failed to apply config: %s", err.Error())
+			return
+		}
+		auth.UpdateSettings(authConfig)
+		storage.SetPresignTTLs(config.S3.PresignTTL, config.S3.UploadPresignTTL)
+		if usage != nil {
+			quotas, err := config.QuotaPolicy()
+			if err != nil {
+				log.Printf("failed to apply config: %s", err.Error())
+				return
+			}
+			usage.SetQuotas(quotas)
+		}
+		if shareSigner != nil {
+			// keys were validated when the config was loaded.
+			shareKeys, _ := ParseShareKeys(config.Share.Keys)
+			shareSigner.SetKeys(shareKeys)
+		}
+	})
+
+	denylist := newDenylist(ctx, &config.Denylist, storage)
+
+	trustForwardedFor := config.Auth.TrustForwardedFor
+	anonymizeIP := config.Logging.AnonymizeIP
+
+	loginLimiter := NewLoginLimiter()
+	loginLimiter.TrustForwardedFor = trustForwardedFor
+
+	rateLimiter := NewRateLimiter(
+		RateTier{Rate: config.Limits.AnonymousRate, Burst: config.Limits.AnonymousBurst},
+		RateTier{Rate: config.Limits.AuthenticatedRate, Burst: config.Limits.AuthenticatedBurst},
+		100000,
+	)
+	rateLimiter.TrustForwardedFor = trustForwardedFor
+	registerLimiterState(rateLimiter, s3InFlight)
+
+	var audit *AuditLogger
+	if auditLogger := newJSONLogger(config.Logging.AuditLog, &config.Logging); auditLogger != nil {
+		audit = &AuditLogger{
+			Logger:            auditLogger,
+			AnonymizeIP:       anonymizeIP,
+			TrustForwardedFor: trustForwardedFor,
+		}
+	}
+
+	cors, err := config.CORSPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	adminCredentials, err := ParseStaticCredentials(config.Auth.AdminCredentials)
+	if err != nil {
+		log.Fatalf("invalid admin credentials: %s", err.Error())
+	}
+
+	var djangoProxy http.Handler
+	if config.Django.URL != "" {
+		proxy, err := NewDjangoProxy(config.Django.URL, config.Django.Timeout, config.Django.Retries, log.Default())
+		if err != nil {
+			log.Fatalf("invalid django url: %s", err.Error())
+		}
+		djangoProxy = proxy
+	}
+
+	if shareSigner != nil {
+		var dataURL string
+		if publicURL := config.Share.PublicURL; publicURL != "" {
+			dataURL = strings.TrimSuffix(publicURL, "/") + "/api/v1/data/"
+		}
+		router.Handle("/api/v1/share", instrumentRoute("share", &ShareHandler{
+			Signer:       shareSigner,
+			Credentials:  auth,
+			LoginLimiter: loginLimiter,
+			DataURL:      dataURL,
+			Logger:       log.Default(),
+		}))
+	}
+
+	// lookups require the index, as otherwise they would list every file of the node.
+	var locator FileLocator
+	if index != nil {
+		locator = index
+	}
+	if locator != nil && config.Lookup.CacheTTL > 0 {
+		locator = &CachingLocator{
+			Locator:    locator,
+			TTL:        config.Lookup.CacheTTL,
+			MaxEntries: 10000,
+		}
+	}
+
+	router.Handle("/api/v1/data/", instrumentRoute("data", http.StripPrefix("/api/v1/data/", &StorageHandler{
+		Storage:        storage,
+		RootFolder:     rootFolder,
+		Authenticator:  dataAuth,
+		Denylist:       denylist,
+		LoginLimiter:   loginLimiter,
+		RateLimiter:    rateLimiter,
+		Usage:          usage,
+		ShareSigner:    shareSigner,
+		Audit:          audit,
+		Locator:        locator,
+		LookupCacheTTL: config.Lookup.CacheTTL,
+		Lister:         storage,
+		Proxy:          djangoProxy,
+		Logger:         log.Default(),
+	})))
+
+	if denylist != nil {
+		denylistHandler := &DenylistHandler{
+			Denylist:         denylist,
+			AdminCredentials: adminCredentials,
+			LoginLimiter:     loginLimiter,
+			Logger:           log.Default(),
+		}
+		router.Handle("/api/v1/admin/denylist", instrumentRoute("admin_denylist", http.StripPrefix("/api/v1/admin/denylist", denylistHandler)))
+		router.Handle("/api/v1/admin/denylist/", instrumentRoute("admin_denylist", http.StripPrefix("/api/v1/admin/denylist/", denylistHandler)))
+	}
+
+	if usage != nil {
+		usageHandler := &UsageHandler{
+			Usage:            usage,
+			AdminCredentials: adminCredentials,
+			LoginLimiter:     loginLimiter,
+			Logger:           log.Default(),
+		}
+		router.Handle("/api/v1/admin/usage", instrumentRoute("admin_usage", http.StripPrefix("/api/v1/admin/usage", usageHandler)))
+		router.Handle("/api/v1/admin/usage/", instrumentRoute("admin_usage", http.StripPrefix("/api/v1/admin/usage/", usageHandler)))
+	}
+
+	if index != nil {
+		router.Handle("/api/v1/search", instrumentRoute("search", &SearchHandler{
+			Index:         index,
+			Authenticator: dataAuth,
+			Denylist:      denylist,
+			LoginLimiter:  loginLimiter,
+			RateLimiter:   rateLimiter,
+			Logger:        log.Default(),
+		}))
+	}
+
+	if config.Events.BucketSecret != "" {
+		router.Handle("/api/v1/events/bucket", instrumentRoute("bucket_events", &BucketEventsHandler{
+			Bus:        events,
+			Secret:     config.Events.BucketSecret,
+			Bucket:     config.S3.Bucket,
+			RootFolder: rootFolder,
+			Logger:     log.Default(),
+		}))
+
+		feed := &FeedHandler{
+			Bus:            events,
+			Authenticator:  dataAuth,
+			Denylist:       denylist,
+			LoginLimiter:   loginLimiter,
+			MaxSubscribers: config.Events.FeedMaxSubscribers,
+			Done:           ctx.Done(),
+			Logger:         log.Default(),
+		}
+		registerFeedSubscribers(feed)
+		// feeds are long lived, so they are left out of the request latency metrics.
+		router.Handle("/api/v1/feed", feed)
+	}
+
+	nodesHandler := &NodesHandler{
+		Nodes:  auth,
+		Index:  index,
+		Logger: log.Default(),
+	}
+	router.Handle("/api/v1/nodes", instrumentRoute("nodes", http.StripPrefix("/api/v1/nodes", nodesHandler)))
+	router.Handle("/api/v1/nodes/", instrumentRoute("nodes", http.StripPrefix("/api/v1/nodes/", nodesHandler)))
 
 	// add discovery endpoint to show what's under /
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/", instrumentRoute("discovery", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		type response struct {
 			ID      string   `json:"id"`
 			Res     []string `json:"available_resources"`
@@ -64,10 +375,10 @@ func main() {
 			Res:     []string{"api/v1/"},
 			Version: "{RELEASE_VERSION}",
 		})
-	})
+	})))
 
 	// add discovery endpoint to show what's under /api/v1/
-	router.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/api/v1/", instrumentRoute("discovery", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		type response struct {
 			ID  string   `json:"id"`
 			Res []string `json:"available_resources"`
@@ -75,41 +386,126 @@ func main() {
 
 		respondJSON(w, http.StatusOK, &response{
 			ID:  "SAGE object store (node data)",
-			Res: []string{"data/"},
+			Res: []string{"data/", "nodes/"},
 		})
-	})
+	})))
+
+	storageProbe := NewStorageProbe(storage)
+	storageProbe.Logger = log.Default()
+	go storageProbe.Watch(ctx, 15*time.Second)
+
+	router.Handle("/healthz", instrumentRoute("healthz", &HealthHandler{}))
+	router.Handle("/readyz", instrumentRoute("readyz", &HealthHandler{
+		Checks: []HealthCheck{
+			NodeTableHealthCheck(auth),
+			storageProbe.HealthCheck(),
+		},
+	}))
 
 	// add prometheus metrics endpoint
 	router.Handle("/metrics", promhttp.Handler())
 
-	log.Printf("listening on %s", *addr)
-	log.Fatal(http.ListenAndServe(*addr, router))
+	server := config.Server.NewServer(config.Addr, &AccessLogger{
+		Handler:           &TracingHandler{Handler: &CORSHandler{Handler: router, Policy: cors}},
+		Logger:            newJSONLogger(config.Logging.AccessLog, &config.Logging),
+		AnonymizeIP:       anonymizeIP,
+		TrustForwardedFor: trustForwardedFor,
+	})
+
+	if config.TLS.CertFile != "" {
+		certs, err := NewCertReloader(config.TLS.CertFile, config.TLS.KeyFile, log.Default())
+		if err != nil {
+			log.Fatalf("failed to load tls certificate: %s", err.Error())
+		}
+
+		server.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if config.TLS.ClientCAFile != "" {
+			server.TLSConfig, err = newClientCATLSConfig(config.TLS.ClientCAFile)
+			if err != nil {
+				log.Fatalf("failed to load tls client ca file: %s", err.Error())
+			}
+		}
+
+		server.TLSConfig.GetCertificate = certs.GetCertificate
+	}
+
+	log.Printf("listening on %s (tls: %v)", config.Addr, server.TLSConfig != nil)
+
+	if err := runServer(ctx, server, config.Server.ShutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("shutdown complete")
 }
 
-func periodicallyUpdateAuthConfig(authStaticCredentials []*Credential, auth *TableAuthenticator) {
+// periodicallyUpdateAuthConfig keeps auth up to date with the node table until ctx is done.
+func periodicallyUpdateAuthConfig(ctx context.Context, auth *TableAuthenticator, productionURL string) {
 	for {
-		nodes, err := GetNodeTableFromURL(mustGetenv("productionURL"))
+		wait := time.Minute
+
+		nodes, err := GetNodeTableFromURL(ctx, productionURL)
 
 		if err != nil {
 			log.Printf("failed to get node table: %s", err.Error())
-			time.Sleep(10 * time.Second)
-			continue
+			nodeTableRefreshes.WithLabelValues("failure").Inc()
+			wait = 10 * time.Second
+		} else {
+			auth.UpdateNodes(nodes)
+			nodeTableRefreshes.WithLabelValues("success").Inc()
+			log.Printf("updated auth config")
 		}
 
-		auth.UpdateConfig(&TableAuthenticatorConfig{
-			Credentials: authStaticCredentials,
-			Nodes:       nodes,
-		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// newDenylist creates a denylist stored in the configured file or, if set, the configured
+// object in the data bucket. It returns nil if neither is set.
+func newDenylist(ctx context.Context, config *DenylistConfig, storage *S3Storage) *Denylist {
+	var store DenylistStore
+
+	if config.S3Key != "" {
+		store = &S3DenylistStore{
+			S3:     storage.S3,
+			Bucket: storage.Bucket,
+			Key:    config.S3Key,
+		}
+	} else if config.File != "" {
+		store = &FileDenylistStore{
+			Path: config.File,
+		}
+	} else {
+		return nil
+	}
+
+	denylist := NewDenylist(store, log.Default())
 
-		log.Printf("updated auth config")
-		time.Sleep(time.Minute)
+	// security: refuse to start rather than serve files which may have been taken down.
+	if err := denylist.Reload(ctx); err != nil {
+		log.Fatalf("failed to load denylist: %s", err.Error())
 	}
+
+	go denylist.Watch(ctx, 10*time.Second)
+
+	return denylist
 }
 
-func mustGetenv(key string) string {
-	val, ok := os.LookupEnv(key)
-	if !ok {
-		log.Fatalf("env %q is required", key)
+// newJSONLogger creates a JSONLogger writing to dest, which is "stdout", "stderr" or a file
+// path rotated using the logging config. It returns nil if dest is empty.
+func newJSONLogger(dest string, config *LoggingConfig) *JSONLogger {
+	if dest == "" {
+		return nil
+	}
+	out, err := OpenLogSink(dest, config.MaxBytes, config.MaxBackups)
+	if err != nil {
+		log.Fatalf("failed to open log %s: %s", dest, err.Error())
 	}
-	return val
+	return NewJSONLogger(out)
 }
@@ -1,40 +1,251 @@
 package main
 
 import (
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	createSageBucketErrors = promauto.NewCounterVec(
+	httpRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of http requests by route, method and status code",
+		},
+		[]string{"route", "method", "code"},
+	)
+	httpRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of http requests by route, method and status code",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "method", "code"},
+	)
+	authDecisions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_decisions_total",
+			Help: "Number of data access decisions by reason",
+		},
+		[]string{"reason"},
+	)
+	authFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "auth_failures_total",
+			Help: "Number of failed basic auth attempts",
+		},
+		[]string{"reason"},
+	)
+	authLockouts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "auth_lockouts_total",
+			Help: "Number of remote addresses or usernames locked out after repeated failed logins",
+		},
+	)
+	s3RequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "s3_request_duration_seconds",
+			Help:    "Latency of s3 requests by operation, including retries",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+	s3RequestErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "s3_request_errors_total",
+			Help: "Number of failed s3 requests by operation and error code",
+		},
+		[]string{"operation", "code"},
+	)
+	djangoProxyRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "django_proxy_requests_total",
+			Help: "Number of requests proxied to django by upstream status code, error or canceled",
+		},
+		[]string{"result"},
+	)
+	djangoProxyDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "django_proxy_request_duration_seconds",
+			Help:    "Latency of requests proxied to django, including retries and streaming the response",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	djangoProxyRetries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "django_proxy_retries_total",
+			Help: "Number of retried requests to django",
+		},
+	)
+	rateLimitDecisions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_decisions_total",
+			Help: "Number of rate limited and allowed requests by tier",
+		},
+		[]string{"tier", "result"},
+	)
+	s3InFlightRejections = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "s3_in_flight_rejections_total",
+			Help: "Number of s3 requests rejected because too many were in flight",
+		},
+	)
+	quotaRejections = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "sage_bucket_creation_errors_total",
-			Help: "Number of errors during the sage bucket creation",
+			Name: "download_quota_rejections_total",
+			Help: "Number of downloads rejected by quota period",
 		},
-		[]string{"error"},
+		[]string{"period"},
 	)
-	bucketCounter = promauto.NewCounter(
+	indexScans = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "bucket_creation_total",
-			Help: "Number of sage bucket creations",
+			Name: "object_index_scans_total",
+			Help: "Number of object index scans by type and result",
 		},
+		[]string{"type", "result"},
 	)
-	fileUploadCounter = promauto.NewCounter(
+	indexScanDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "object_index_scan_duration_seconds",
+			Help:    "Duration of object index scans by type",
+			Buckets: []float64{1, 5, 15, 60, 300, 900, 3600},
+		},
+		[]string{"type"},
+	)
+	bucketEvents = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "file_upload_total",
-			Help: "Number of file uploads",
+			Name: "bucket_events_total",
+			Help: "Number of bucket notification records by result",
 		},
+		[]string{"result"},
 	)
-	fileUploadByteSize = promauto.NewCounter(
+	objectEventsDropped = promauto.NewCounter(
 		prometheus.CounterOpts{
-			Name: "file_upload_byte_size_total",
-			Help: "the number of bytes uploaded",
+			Name: "object_events_dropped_total",
+			Help: "Number of object events dropped because a subscriber was too slow",
 		},
 	)
-	fileDownloadByteSize = promauto.NewCounter(
+	nodeTableRefreshes = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "file_download_byte_size_total",
-			Help: "the number of bytes downloaded",
+			Name: "node_table_refreshes_total",
+			Help: "Number of node table refreshes by result",
 		},
+		[]string{"result"},
 	)
 )
+
+// instrumentRoute records request counts and latencies for h under the given route name. Route
+// names are used instead of paths to keep the number of series bounded.
+func instrumentRoute(route string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels), h))
+}
+
+// instrumentS3Handlers records the latency and errors of every request sent by an aws session.
+func instrumentS3Handlers(handlers *request.Handlers) {
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "sage.metrics",
+		Fn:   observeS3Request,
+	})
+}
+
+func observeS3Request(r *request.Request) {
+	operation := "unknown"
+	if r.Operation != nil {
+		operation = r.Operation.Name
+	}
+
+	s3RequestDuration.WithLabelValues(operation).Observe(time.Since(r.Time).Seconds())
+
+	if r.Error == nil {
+		return
+	}
+	code := "unknown"
+	if aerr, ok := r.Error.(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	s3RequestErrors.WithLabelValues(operation, code).Inc()
+}
+
+// registerNodeTableAge exports how long ago the node table was last loaded. The age is -1 until
+// the first load.
+func registerNodeTableAge(nodes NodeTable) {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "node_table_age_seconds",
+			Help: "Time since the node table was last loaded",
+		},
+		func() float64 {
+			_, updated := nodes.Nodes()
+			if updated.IsZero() {
+				return -1
+			}
+			return time.Since(updated).Seconds()
+		},
+	)
+}
+
+// registerLimiterState exports the number of clients tracked by the rate limiter and the number
+// of s3 requests in flight. Either limiter may be nil.
+func registerLimiterState(limiter *RateLimiter, inFlight *ConcurrencyLimiter) {
+	if limiter != nil {
+		promauto.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "rate_limiter_clients",
+				Help: "Number of clients tracked by the rate limiter",
+			},
+			func() float64 {
+				return float64(limiter.Len())
+			},
+		)
+	}
+	if inFlight != nil {
+		promauto.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "s3_in_flight_requests",
+				Help: "Number of s3 requests in flight",
+			},
+			func() float64 {
+				return float64(inFlight.InFlight())
+			},
+		)
+		promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "s3_in_flight_limit",
+				Help: "Maximum number of s3 requests in flight",
+			},
+		).Set(float64(cap(inFlight.slots)))
+	}
+}
+
+// registerIndexSize exports the number of objects in the object index.
+func registerIndexSize(index *ObjectIndex) {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "object_index_objects",
+			Help: "Number of objects in the object index",
+		},
+		func() float64 {
+			return float64(index.Len())
+		},
+	)
+}
+
+// registerFeedSubscribers exports the number of open feeds.
+func registerFeedSubscribers(feed *FeedHandler) {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "feed_subscribers",
+			Help: "Number of open feeds",
+		},
+		func() float64 {
+			return float64(feed.Subscribers())
+		},
+	)
+}
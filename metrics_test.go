@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentRoute(t *testing.T) {
+	handler := instrumentRoute("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	counter := httpRequests.WithLabelValues("test", "get", "418")
+	before := testutil.ToFloat64(counter)
+
+	getResponse(t, handler, "GET", "/some/path")
+	getResponse(t, handler, "GET", "/other/path")
+
+	if n := testutil.ToFloat64(counter) - before; n != 2 {
+		t.Fatalf("expected 2 requests counted for route. got: %v", n)
+	}
+}
+
+func TestObserveS3Request(t *testing.T) {
+	errors := s3RequestErrors.WithLabelValues("HeadObject", "NotFound")
+	before := testutil.ToFloat64(errors)
+
+	observeS3Request(&request.Request{
+		Operation: &request.Operation{Name: "HeadObject"},
+		Time:      time.Now(),
+	})
+	observeS3Request(&request.Request{
+		Operation: &request.Operation{Name: "HeadObject"},
+		Time:      time.Now(),
+		Error:     awserr.New("NotFound", "not found", nil),
+	})
+
+	if n := testutil.ToFloat64(errors) - before; n != 1 {
+		t.Fatalf("expected 1 error counted. got: %v", n)
+	}
+
+	unknown := s3RequestErrors.WithLabelValues("HeadObject", "unknown")
+	before = testutil.ToFloat64(unknown)
+
+	observeS3Request(&request.Request{
+		Operation: &request.Operation{Name: "HeadObject"},
+		Time:      time.Now(),
+		Error:     fmt.Errorf("connection refused"),
+	})
+
+	if n := testutil.ToFloat64(unknown) - before; n != 1 {
+		t.Fatalf("expected 1 unknown error counted. got: %v", n)
+	}
+}
+
+func TestAuthDecisionMetrics(t *testing.T) {
+	handler := &StorageHandler{
+		Storage: &mockStorage{
+			files: map[string][]byte{
+				"node-data/sage/sage-imagesampler-top-0.2.5/000048b02d05a0a4/1638576647406523064-sample.jpg": randomContent(),
+			},
+		},
+		RootFolder:    "node-data",
+		Authenticator: &mockAuthenticator{},
+	}
+
+	denied := authDecisions.WithLabelValues("denied")
+	before := testutil.ToFloat64(denied)
+
+	resp := getResponse(t, handler, "GET", "sage/sage-imagesampler-top-0.2.5/000048b02d05a0a4/1638576647406523064-sample.jpg")
+	assertStatusCode(t, resp, http.StatusUnauthorized)
+
+	if n := testutil.ToFloat64(denied) - before; n != 1 {
+		t.Fatalf("expected 1 denied decision counted. got: %v", n)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// clientNodeID returns the node ID from the verified client certificate of r, if any.
+func clientNodeID(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return nodeIDFromCertificate(r.TLS.VerifiedChains[0][0])
+}
+
+// nodeIDFromCertificate extracts a node ID from the certificate subject common name or, failing
+// that, from the first label of a DNS subject alternative name such as 000048b02d15bc7c.nodes.example.org.
+func nodeIDFromCertificate(cert *x509.Certificate) (string, bool) {
+	if id := strings.ToLower(cert.Subject.CommonName); nodeIDRE.MatchString(id) {
+		return id, true
+	}
+	for _, name := range cert.DNSNames {
+		label, _, _ := strings.Cut(name, ".")
+		if id := strings.ToLower(label); nodeIDRE.MatchString(id) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// newClientCATLSConfig creates a TLS config which verifies client certificates against the CA
+// bundle in caFile. Client certificates are optional so other clients can still connect.
+func newClientCATLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNodeIDFromCertificate(t *testing.T) {
+	testcases := map[string]struct {
+		Cert   *x509.Certificate
+		NodeID string
+	}{
+		"commonName":    {&x509.Certificate{Subject: pkix.Name{CommonName: "000048B02D15BC7C"}}, "000048b02d15bc7c"},
+		"dnsName":       {&x509.Certificate{Subject: pkix.Name{CommonName: "node"}, DNSNames: []string{"other.example.org", "000048b02d15bc7c.nodes.example.org"}}, "000048b02d15bc7c"},
+		"noNodeID":      {&x509.Certificate{Subject: pkix.Name{CommonName: "user"}, DNSNames: []string{"www.example.org"}}, ""},
+		"invalidNodeID": {&x509.Certificate{Subject: pkix.Name{CommonName: "000048b02d15bc7"}}, ""},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			nodeID, ok := nodeIDFromCertificate(tc.Cert)
+			if ok != (tc.NodeID != "") || nodeID != tc.NodeID {
+				t.Fatalf("incorrect node id. got: %q want: %q", nodeID, tc.NodeID)
+			}
+		})
+	}
+}
+
+func TestHandlerClientCertificate(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	newClientCert := func(nodeID string, signer *ecdsa.PrivateKey, parent *x509.Certificate) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: nodeID},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if parent == nil {
+			parent, signer = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	// strip the leading slash so paths match the data handler.
+	server := httptest.NewUnstartedServer(http.StripPrefix("/", &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: &mockAuthenticator{false},
+	}))
+	server.TLS = &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	do := func(method, path string, certs ...tls.Certificate) int {
+		client := server.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		client = &http.Client{
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		req, err := http.NewRequest(method, server.URL+"/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	nodeCert := newClientCert("000048b02d15bc7c", caKey, caCert)
+	selfSignedCert := newClientCert("000048b02d15bc7c", nil, nil)
+
+	ownFile := "job/task/000048b02d15bc7c/1643842551600000001-sample.jpg"
+	otherFile := "job/task/000048b02d05a0a4/1643842551600000001-sample.jpg"
+	uppercaseFile := "job/task/000048B02D15BC7C/1643842551600000001-sample.jpg"
+
+	testcases := map[string]struct {
+		Method string
+		Path   string
+		Certs  []tls.Certificate
+		Status int
+	}{
+		"getOwnFile":   {http.MethodGet, ownFile, []tls.Certificate{nodeCert}, http.StatusTemporaryRedirect},
+		"getOtherFile": {http.MethodGet, otherFile, []tls.Certificate{nodeCert}, http.StatusUnauthorized},
+		"getNoCert":    {http.MethodGet, ownFile, nil, http.StatusUnauthorized},
+		"putOwnFile":   {http.MethodPut, ownFile, []tls.Certificate{nodeCert}, http.StatusTemporaryRedirect},
+		"putOtherFile": {http.MethodPut, otherFile, []tls.Certificate{nodeCert}, http.StatusForbidden},
+		"putUppercase": {http.MethodPut, uppercaseFile, []tls.Certificate{nodeCert}, http.StatusBadRequest},
+		"putNoCert":    {http.MethodPut, ownFile, nil, http.StatusUnauthorized},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if status := do(tc.Method, tc.Path, tc.Certs...); status != tc.Status {
+				t.Fatalf("incorrect status code. got: %d want: %d", status, tc.Status)
+			}
+		})
+	}
+
+	// certificates not signed by the CA do not identify a node.
+	if status := do(http.MethodGet, ownFile, selfSignedCert); status != http.StatusUnauthorized {
+		t.Fatalf("expected untrusted certificate to be unauthorized. got: %d", status)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NodeTable provides read access to the node table used for authorization.
+type NodeTable interface {
+	Nodes() ([]*TableAuthenticatorNode, time.Time)
+	Node(nodeID string) (*TableAuthenticatorNode, time.Time, bool)
+	NodeAccess(nodeID string) NodeAccess
+}
+
+// NodeAccess describes what limits public access to a node's files besides the node table.
+type NodeAccess struct {
+	// Embargo is how long after their timestamp files become public.
+	Embargo time.Duration
+	// RestrictedTasks is whether task policies keep some of the node's files from being public.
+	RestrictedTasks bool
+}
+
+// NodesHandler serves the node catalog. Requests are expected to have the
+// /api/v1/nodes prefix stripped, so the path is either empty or a node ID.
+type NodesHandler struct {
+	Nodes NodeTable
+	// Index is optional and used to compute per node storage stats.
+	Index  *ObjectIndex
+	Logger *log.Logger
+}
+
+type nodeItem struct {
+	NodeID         string     `json:"node_id"`
+	Public         bool       `json:"public"`
+	CommissionDate *time.Time `json:"commission_date"`
+	RetireDate     *time.Time `json:"retire_date"`
+	// PublicSince is the earliest timestamp of files which are publicly available.
+	// It is null if none of the node's files are public.
+	PublicSince *time.Time `json:"public_since"`
+	// PublicBefore is the end of the public range when the node has an embargo. Newer files
+	// are only available with credentials. It is null if the node has no embargo.
+	PublicBefore *time.Time `json:"public_before"`
+	// RestrictedTasks is whether files from some tasks are never public.
+	RestrictedTasks bool       `json:"restricted_tasks"`
+	Stats           *nodeStats `json:"stats,omitempty"`
+}
+
+type nodeStats struct {
+	Objects int64      `json:"objects"`
+	Bytes   int64      `json:"bytes"`
+	Oldest  *time.Time `json:"oldest,omitempty"`
+	Newest  *time.Time `json:"newest,omitempty"`
+}
+
+func (h *NodesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	nodeID := strings.Trim(r.URL.Path, "/")
+
+	if nodeID == "" {
+		h.handleList(w, r)
+	} else {
+		h.handleNode(w, r, strings.ToLower(nodeID))
+	}
+}
+
+func (h *NodesHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Updated *time.Time  `json:"updated"`
+		Nodes   []*nodeItem `json:"nodes"`
+	}
+
+	nodes, updated := h.Nodes.Nodes()
+	now := time.Now()
+
+	items := make([]*nodeItem, 0, len(nodes))
+	for _, node := range nodes {
+		items = append(items, newNodeItem(node, h.Nodes.NodeAccess(node.NodeID), now))
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].NodeID < items[j].NodeID
+	})
+
+	respondJSON(w, http.StatusOK, &response{
+		Updated: timeOrNil(updated),
+		Nodes:   items,
+	})
+}
+
+func (h *NodesHandler) handleNode(w http.ResponseWriter, r *http.Request, nodeID string) {
+	type response struct {
+		Updated *time.Time `json:"updated"`
+		Node    *nodeItem  `json:"node"`
+	}
+
+	node, updated, ok := h.Nodes.Node(nodeID)
+	if !ok {
+		respondJSONError(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	item := newNodeItem(node, h.Nodes.NodeAccess(nodeID), time.Now())
+
+	if r.URL.Query().Get("stats") == "true" {
+		if h.Index == nil {
+			respondJSONError(w, http.StatusNotImplemented, "storage stats are not available")
+			return
+		}
+		stats, err := h.nodeStats(nodeID)
+		if err != nil {
+			h.log("%s %s -> %s: failed to get node stats: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+			respondJSONError(w, http.StatusInternalServerError, "failed to get node stats")
+			return
+		}
+		item.Stats = stats
+	}
+
+	respondJSON(w, http.StatusOK, &response{
+		Updated: timeOrNil(updated),
+		Node:    item,
+	})
+}
+
+// nodeStats totals the indexed objects stored under {job}/{task}/{node}/. Stats come from the
+// index, as walking the bucket for every request would be slow and easy to abuse.
+func (h *NodesHandler) nodeStats(nodeID string) (*nodeStats, error) {
+	stats := &nodeStats{}
+
+	prefixes, err := h.Index.NodePrefixes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, prefix := range prefixes {
+		if !strings.EqualFold(path.Base(prefix), nodeID) {
+			continue
+		}
+		err := h.Index.Objects(prefix, func(o *IndexedObject) {
+			stats.Objects++
+			stats.Bytes += o.Size
+			ts := o.Timestamp
+			if stats.Oldest == nil || ts.Before(*stats.Oldest) {
+				stats.Oldest = &ts
+			}
+			if stats.Newest == nil || ts.After(*stats.Newest) {
+				stats.Newest = &ts
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read objects under %s: %s", prefix, err.Error())
+		}
+	}
+
+	return stats, nil
+}
+
+func (h *NodesHandler) log(format string, v ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Printf(format, v...)
+}
+
+// newNodeItem describes node's public access at now. Files are public from the commission date
+// until the embargo, unless a task policy restricts them.
+func newNodeItem(node *TableAuthenticatorNode, access NodeAccess, now time.Time) *nodeItem {
+	item := &nodeItem{
+		NodeID:          node.NodeID,
+		Public:          node.Public && node.CommissionDate != nil,
+		CommissionDate:  node.CommissionDate,
+		RetireDate:      node.RetireDate,
+		RestrictedTasks: access.RestrictedTasks,
+	}
+	if !item.Public {
+		return item
+	}
+	if access.Embargo > 0 {
+		before := now.Add(-access.Embargo)
+		item.PublicBefore = &before
+		if before.Before(*node.CommissionDate) {
+			return item
+		}
+	}
+	item.PublicSince = node.CommissionDate
+	return item
+}
+
+// folderPrefix returns folder as a listing prefix ending in "/", or the empty string for the bucket root.
+func folderPrefix(folder string) string {
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		return ""
+	}
+	return folder + "/"
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
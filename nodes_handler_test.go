@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNodesList(t *testing.T) {
+	auth := newTestNodesAuthenticator()
+	handler := &NodesHandler{Nodes: auth}
+
+	resp := getResponse(t, handler, http.MethodGet, "")
+	assertStatusCode(t, resp, http.StatusOK)
+
+	var body struct {
+		Updated *time.Time  `json:"updated"`
+		Nodes   []*nodeItem `json:"nodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	if body.Updated == nil {
+		t.Fatalf("expected updated time to be set")
+	}
+
+	expect := []struct {
+		NodeID string
+		Public bool
+	}{
+		{"0000000000000001", true},
+		{"0000000000000002", false},
+		{"000000000000000a", false},
+	}
+
+	if len(body.Nodes) != len(expect) {
+		t.Fatalf("incorrect number of nodes. got: %d want: %d", len(body.Nodes), len(expect))
+	}
+
+	for i, e := range expect {
+		node := body.Nodes[i]
+		if node.NodeID != e.NodeID {
+			t.Fatalf("incorrect node order. got: %s want: %s", node.NodeID, e.NodeID)
+		}
+		if node.Public != e.Public {
+			t.Fatalf("incorrect public status for %s. got: %v want: %v", node.NodeID, node.Public, e.Public)
+		}
+		if node.Public != (node.PublicSince != nil) {
+			t.Fatalf("public_since must be set only for public nodes. got: %v", node.PublicSince)
+		}
+	}
+}
+
+func TestNodesListNeverUpdated(t *testing.T) {
+	handler := &NodesHandler{Nodes: NewTableAuthenticator()}
+	resp := getResponse(t, handler, http.MethodGet, "")
+	assertStatusCode(t, resp, http.StatusOK)
+	assertReadContent(t, resp, []byte(`{
+  "updated": null,
+  "nodes": []
+}
+`))
+}
+
+func TestNodesGetNode(t *testing.T) {
+	handler := &NodesHandler{Nodes: newTestNodesAuthenticator()}
+
+	testcases := map[string]struct {
+		URL    string
+		Status int
+	}{
+		"Found":          {"0000000000000001", http.StatusOK},
+		"FoundUppercase": {"000000000000000A", http.StatusOK},
+		"TrailingSlash":  {"0000000000000002/", http.StatusOK},
+		"NotFound":       {"00000000000000ff", http.StatusNotFound},
+		"StatsNoIndex":   {"0000000000000001?stats=true", http.StatusNotImplemented},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			resp := getResponse(t, handler, http.MethodGet, tc.URL)
+			assertStatusCode(t, resp, tc.Status)
+		})
+	}
+}
+
+func TestNodesGetNodeStats(t *testing.T) {
+	index := newTestObjectIndex(t)
+	var objs []*IndexedObject
+	for i, o := range []struct {
+		Job  string
+		Task string
+		Node string
+		Size int64
+	}{
+		{"job1", "task1", "0000000000000001", 10},
+		{"job1", "task2", "0000000000000001", 20},
+		{"job2", "task1", "0000000000000001", 30},
+		{"job2", "task1", "0000000000000002", 40},
+	} {
+		obj := testIndexedObject(o.Job, o.Task, o.Node, time.Unix(0, 1643842551600000001+int64(i)), "sample.jpg")
+		obj.Size = o.Size
+		objs = append(objs, obj)
+	}
+	if err := index.Put(objs...); err != nil {
+		t.Fatal(err)
+	}
+	handler := &NodesHandler{
+		Nodes: newTestNodesAuthenticator(),
+		Index: index,
+	}
+
+	resp := getResponse(t, handler, http.MethodGet, "0000000000000001?stats=true")
+	assertStatusCode(t, resp, http.StatusOK)
+
+	var body struct {
+		Node *nodeItem `json:"node"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	stats := body.Node.Stats
+	if stats == nil {
+		t.Fatalf("expected stats in response")
+	}
+	if stats.Objects != 3 || stats.Bytes != 60 {
+		t.Fatalf("incorrect stats. got: %d objects %d bytes want: 3 objects 60 bytes", stats.Objects, stats.Bytes)
+	}
+	if !stats.Oldest.Equal(time.Unix(0, 1643842551600000001)) || !stats.Newest.Equal(time.Unix(0, 1643842551600000003)) {
+		t.Fatalf("incorrect time range. got: %s to %s", stats.Oldest, stats.Newest)
+	}
+}
+
+func TestNodesGetNodeAccess(t *testing.T) {
+	auth := newTestNodesAuthenticator()
+	auth.UpdateSettings(&TableAuthenticatorConfig{
+		NodeEmbargo: map[string]time.Duration{
+			"0000000000000001": 24 * time.Hour,
+			"000000000000000a": 24 * time.Hour,
+		},
+		TaskPolicies: []*TaskPolicyRule{
+			{Match: TaskPolicyMatchExact, Pattern: "imagesampler-bottom", Nodes: []string{"0000000000000001"}},
+		},
+	})
+	commissionDate := time.Now().Add(-time.Hour)
+	auth.UpdateNodes(map[string]*TableAuthenticatorNode{
+		"0000000000000001": {Public: true, CommissionDate: &commissionDate},
+		"000000000000000a": {Public: true, CommissionDate: &commissionDate},
+		"000000000000000b": {Public: true, CommissionDate: &commissionDate},
+	})
+	handler := &NodesHandler{Nodes: auth}
+
+	testcases := map[string]struct {
+		NodeID          string
+		PublicSince     bool
+		PublicBefore    bool
+		RestrictedTasks bool
+	}{
+		"EmbargoAndPolicy": {"0000000000000001", false, true, true},
+		"EmbargoOnly":      {"000000000000000a", false, true, false},
+		"NoEmbargo":        {"000000000000000b", true, false, false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			resp := getResponse(t, handler, http.MethodGet, tc.NodeID)
+			assertStatusCode(t, resp, http.StatusOK)
+
+			var body struct {
+				Node *nodeItem `json:"node"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+			node := body.Node
+			if !node.Public {
+				t.Fatalf("expected node to be public")
+			}
+			if (node.PublicSince != nil) != tc.PublicSince {
+				t.Fatalf("incorrect public_since. got: %v", node.PublicSince)
+			}
+			if (node.PublicBefore != nil) != tc.PublicBefore {
+				t.Fatalf("incorrect public_before. got: %v", node.PublicBefore)
+			}
+			if node.PublicBefore != nil && time.Since(*node.PublicBefore) < 24*time.Hour {
+				t.Fatalf("public_before must be before the embargo. got: %s", node.PublicBefore)
+			}
+			if node.RestrictedTasks != tc.RestrictedTasks {
+				t.Fatalf("incorrect restricted_tasks. got: %v want: %v", node.RestrictedTasks, tc.RestrictedTasks)
+			}
+		})
+	}
+}
+
+func TestNodesMethodNotAllowed(t *testing.T) {
+	handler := &NodesHandler{Nodes: newTestNodesAuthenticator()}
+	resp := getResponse(t, handler, http.MethodPost, "")
+	assertStatusCode(t, resp, http.StatusMethodNotAllowed)
+}
+
+func newTestNodesAuthenticator() *TableAuthenticator {
+	commissionDate := time.Now().AddDate(-1, 0, 0)
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Nodes: map[string]*TableAuthenticatorNode{
+			"0000000000000001": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+			"0000000000000002": {
+				Public:         false,
+				CommissionDate: &commissionDate,
+			},
+			"000000000000000a": {
+				Public: true,
+			},
+		},
+	})
+	return auth
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TaskPolicyMatch defines how a TaskPolicyRule pattern is compared against a task ID.
+type TaskPolicyMatch string
+
+const (
+	TaskPolicyMatchExact     TaskPolicyMatch = "exact"
+	TaskPolicyMatchSubstring TaskPolicyMatch = "substring"
+	TaskPolicyMatchGlob      TaskPolicyMatch = "glob"
+)
+
+// TaskPolicyRule restricts files from matching tasks from ever being public. Restricted
+// files are still available with credentials.
+type TaskPolicyRule struct {
+	Match   TaskPolicyMatch
+	Pattern string
+	// Nodes limits the rule to the given node IDs. The rule applies to all nodes when empty.
+	Nodes []string
+}
+
+// Restricts returns whether the rule applies to the given file.
+func (rule *TaskPolicyRule) Restricts(f *StorageFile) bool {
+	if len(rule.Nodes) > 0 && !containsString(rule.Nodes, f.NodeID) {
+		return false
+	}
+
+	switch rule.Match {
+	case TaskPolicyMatchExact:
+		return f.TaskID == rule.Pattern
+	case TaskPolicyMatchSubstring:
+		return strings.Contains(f.TaskID, rule.Pattern)
+	case TaskPolicyMatchGlob:
+		ok, err := path.Match(rule.Pattern, f.TaskID)
+		return ok && err == nil
+	}
+
+	// security: fail closed on rules we don't understand.
+	return true
+}
+
+func (rule *TaskPolicyRule) validate() error {
+	switch rule.Match {
+	case TaskPolicyMatchExact, TaskPolicyMatchSubstring:
+	case TaskPolicyMatchGlob:
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %q", rule.Pattern)
+		}
+	default:
+		return fmt.Errorf("invalid match type %q", rule.Match)
+	}
+	if rule.Pattern == "" {
+		return fmt.Errorf("pattern must be nonempty")
+	}
+	return nil
+}
+
+func taskRestricted(rules []*TaskPolicyRule, f *StorageFile) bool {
+	for _, rule := range rules {
+		if rule.Restricts(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTaskPolicyRules parses a comma separated list of match:pattern rules, for example
+// "exact:imagesampler-top,substring:bottom,glob:*-street". The rules are limited to nodes,
+// if any are provided.
+func ParseTaskPolicyRules(s string, nodes []string) ([]*TaskPolicyRule, error) {
+	rules := []*TaskPolicyRule{}
+
+	for _, s := range splitList(s) {
+		match, pattern, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("failed to parse task policy rule %q", s)
+		}
+		rule := &TaskPolicyRule{
+			Match:   TaskPolicyMatch(match),
+			Pattern: pattern,
+			Nodes:   nodes,
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("failed to parse task policy rule %q: %s", s, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ParseTaskSubstrings parses a comma separated list of task substrings into substring rules.
+// This is the format used by the policyRestrictedTaskSubstrings env var.
+func ParseTaskSubstrings(s string, nodes []string) []*TaskPolicyRule {
+	rules := []*TaskPolicyRule{}
+	for _, substring := range splitList(s) {
+		rules = append(rules, &TaskPolicyRule{
+			Match:   TaskPolicyMatchSubstring,
+			Pattern: substring,
+			Nodes:   nodes,
+		})
+	}
+	return rules
+}
+
+// ParseNodeList parses a comma separated list of node IDs.
+func ParseNodeList(s string) []string {
+	nodes := splitList(s)
+	for i := range nodes {
+		nodes[i] = strings.ToLower(nodes[i])
+	}
+	return nodes
+}
+
+// splitList splits a comma separated list, ignoring surrounding whitespace and empty items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
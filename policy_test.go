@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTaskPolicyRuleRestricts(t *testing.T) {
+	testcases := map[string]struct {
+		Rule       *TaskPolicyRule
+		File       *StorageFile
+		Restricted bool
+	}{
+		"exactMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchExact, Pattern: "imagesampler-bottom"},
+			File:       &StorageFile{NodeID: "node", TaskID: "imagesampler-bottom"},
+			Restricted: true,
+		},
+		"exactNoMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchExact, Pattern: "imagesampler"},
+			File:       &StorageFile{NodeID: "node", TaskID: "imagesampler-bottom"},
+			Restricted: false,
+		},
+		"substringMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchSubstring, Pattern: "street"},
+			File:       &StorageFile{NodeID: "node", TaskID: "imagesampler-street-left"},
+			Restricted: true,
+		},
+		"substringNoMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchSubstring, Pattern: "street"},
+			File:       &StorageFile{NodeID: "node", TaskID: "imagesampler-top"},
+			Restricted: false,
+		},
+		"globMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchGlob, Pattern: "imagesampler-*"},
+			File:       &StorageFile{NodeID: "node", TaskID: "imagesampler-top"},
+			Restricted: true,
+		},
+		"globNoMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchGlob, Pattern: "imagesampler-?"},
+			File:       &StorageFile{NodeID: "node", TaskID: "imagesampler-top"},
+			Restricted: false,
+		},
+		"nodeMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchSubstring, Pattern: "bottom", Nodes: []string{"node1", "node2"}},
+			File:       &StorageFile{NodeID: "node2", TaskID: "imagesampler-bottom"},
+			Restricted: true,
+		},
+		"nodeNoMatch": {
+			Rule:       &TaskPolicyRule{Match: TaskPolicyMatchSubstring, Pattern: "bottom", Nodes: []string{"node1", "node2"}},
+			File:       &StorageFile{NodeID: "node3", TaskID: "imagesampler-bottom"},
+			Restricted: false,
+		},
+		"unknownMatchFailsClosed": {
+			Rule:       &TaskPolicyRule{Match: "regexp", Pattern: "^$"},
+			File:       &StorageFile{NodeID: "node", TaskID: "imagesampler-top"},
+			Restricted: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if tc.Rule.Restricts(tc.File) != tc.Restricted {
+				t.Fatalf("incorrect restriction for %+v. got: %v want: %v", tc.File, !tc.Restricted, tc.Restricted)
+			}
+		})
+	}
+}
+
+func TestParseTaskPolicyRules(t *testing.T) {
+	testcases := map[string]struct {
+		Input       string
+		ExpectError bool
+		ExpectRules []*TaskPolicyRule
+	}{
+		"empty": {
+			Input:       "",
+			ExpectRules: []*TaskPolicyRule{},
+		},
+		"multiple": {
+			Input: "exact:imagesampler-top, substring:bottom,glob:*-street",
+			ExpectRules: []*TaskPolicyRule{
+				{Match: TaskPolicyMatchExact, Pattern: "imagesampler-top"},
+				{Match: TaskPolicyMatchSubstring, Pattern: "bottom"},
+				{Match: TaskPolicyMatchGlob, Pattern: "*-street"},
+			},
+		},
+		"missingMatch": {
+			Input:       "bottom",
+			ExpectError: true,
+		},
+		"unknownMatch": {
+			Input:       "regexp:bottom",
+			ExpectError: true,
+		},
+		"emptyPattern": {
+			Input:       "exact:",
+			ExpectError: true,
+		},
+		"badGlob": {
+			Input:       "glob:[bottom",
+			ExpectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			rules, err := ParseTaskPolicyRules(tc.Input, nil)
+
+			if tc.ExpectError && err == nil {
+				t.Fatalf("expecting error but got none")
+			}
+
+			if !tc.ExpectError && err != nil {
+				t.Fatalf("not expecting error but got %s", err)
+			}
+
+			if len(rules) != len(tc.ExpectRules) {
+				t.Fatalf("incorrect number of rules. got: %d want: %d", len(rules), len(tc.ExpectRules))
+			}
+
+			for i, r := range tc.ExpectRules {
+				if rules[i].Match != r.Match || rules[i].Pattern != r.Pattern {
+					t.Fatalf("expecting rule %+v but got %+v", r, rules[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizedTaskPolicies(t *testing.T) {
+	commissionDate := time.Now().AddDate(-1, 0, 0)
+
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Credentials: []*Credential{
+			{
+				Username: "user",
+				Password: "secret",
+			},
+		},
+		Nodes: map[string]*TableAuthenticatorNode{
+			"restrictedNode": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+			"otherNode": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+		},
+		TaskPolicies: append(
+			ParseTaskSubstrings("bottom,street", []string{"restrictedNode"}),
+			&TaskPolicyRule{Match: TaskPolicyMatchGlob, Pattern: "audio-*"},
+		),
+	})
+
+	assertPrivate(t, auth, &StorageFile{NodeID: "restrictedNode", TaskID: "imagesampler-bottom", Timestamp: time.Now()})
+	assertPrivate(t, auth, &StorageFile{NodeID: "restrictedNode", TaskID: "imagesampler-street", Timestamp: time.Now()})
+	assertPublic(t, auth, &StorageFile{NodeID: "restrictedNode", TaskID: "imagesampler-top", Timestamp: time.Now()})
+	assertPublic(t, auth, &StorageFile{NodeID: "otherNode", TaskID: "imagesampler-bottom", Timestamp: time.Now()})
+	assertPrivate(t, auth, &StorageFile{NodeID: "otherNode", TaskID: "audio-sampler", Timestamp: time.Now()})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateTier is the request rate allowed for each client in a tier.
+type RateTier struct {
+	// Rate is the sustained number of requests per second. Zero disables limiting.
+	Rate float64
+	// Burst is the number of requests which can be made at once.
+	Burst int
+}
+
+// RateLimiter limits the request rate of each client using a token bucket. Authenticated
+// clients are keyed by principal and anonymous clients by remote address.
+type RateLimiter struct {
+	Anonymous     RateTier
+	Authenticated RateTier
+	// TrustForwardedFor uses the last X-Forwarded-For address as the remote address. Only enable
+	// this behind a proxy which appends to the header, otherwise clients can choose their own
+	// address.
+	TrustForwardedFor bool
+
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+	mu         sync.Mutex
+}
+
+type rateBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter tracking at most maxEntries clients. The least recently
+// seen clients are forgotten first, which gives them a full bucket.
+func NewRateLimiter(anonymous, authenticated RateTier, maxEntries int) *RateLimiter {
+	return &RateLimiter{
+		Anonymous:     anonymous,
+		Authenticated: authenticated,
+		maxEntries:    maxEntries,
+		entries:       make(map[string]*list.Element),
+		order:         list.New(),
+	}
+}
+
+// Allow takes a token for the client making r. An empty principal means the client is
+// anonymous. It returns how long until the client may make a request, or zero if it may
+// proceed.
+func (l *RateLimiter) Allow(r *http.Request, principal string) time.Duration {
+	tierName, tier, key := "authenticated", l.Authenticated, "principal:"+principal
+	if principal == "" {
+		tierName, tier, key = "anonymous", l.Anonymous, "addr:"+clientIP(r, l.TrustForwardedFor)
+	}
+
+	if tier.Rate <= 0 {
+		return 0
+	}
+
+	wait := l.take(key, tier, time.Now())
+	if wait > 0 {
+		rateLimitDecisions.WithLabelValues(tierName, "limited").Inc()
+	} else {
+		rateLimitDecisions.WithLabelValues(tierName, "allowed").Inc()
+	}
+	return wait
+}
+
+func (l *RateLimiter) take(key string, tier RateTier, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(tier.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	elem, ok := l.entries[key]
+	if !ok {
+		for l.order.Len() >= l.maxEntries {
+			l.remove(l.order.Back())
+		}
+		elem = l.order.PushFront(&rateBucket{key: key, tokens: burst, last: now})
+		l.entries[key] = elem
+	}
+	l.order.MoveToFront(elem)
+
+	bucket := elem.Value.(*rateBucket)
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*tier.Rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / tier.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return 0
+}
+
+func (l *RateLimiter) remove(elem *list.Element) {
+	l.order.Remove(elem)
+	delete(l.entries, elem.Value.(*rateBucket).key)
+}
+
+// Len returns the number of clients being tracked.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// ErrTooManyInFlight is returned when a ConcurrencyLimiter has no free slot in time.
+var ErrTooManyInFlight = errors.New("too many requests in flight")
+
+// ConcurrencyLimiter limits the number of calls in flight at once.
+type ConcurrencyLimiter struct {
+	// MaxWait is how long to wait for a free slot before giving up.
+	MaxWait time.Duration
+	slots   chan struct{}
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter allowing limit calls in flight.
+func NewConcurrencyLimiter(limit int, maxWait time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		MaxWait: maxWait,
+		slots:   make(chan struct{}, limit),
+	}
+}
+
+// Acquire waits for a free slot. The returned release func must be called once the call is
+// done. It returns ErrTooManyInFlight if no slot frees up within MaxWait.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	timer := time.NewTimer(l.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-timer.C:
+		return nil, ErrTooManyInFlight
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *ConcurrencyLimiter) release() {
+	<-l.slots
+}
+
+// InFlight returns the number of calls in flight.
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+// setRetryAfter sets the Retry-After header to wait rounded up to whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+}
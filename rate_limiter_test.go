@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	tier := RateTier{Rate: 2, Burst: 3}
+	limiter := NewRateLimiter(tier, tier, 100)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if wait := limiter.take("client", tier, now); wait != 0 {
+			t.Fatalf("expected burst request %d to be allowed. got wait %s", i, wait)
+		}
+	}
+	if wait := limiter.take("client", tier, now); wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms. got %s", wait)
+	}
+
+	// other clients have their own bucket.
+	if wait := limiter.take("other", tier, now); wait != 0 {
+		t.Fatalf("expected other client to be allowed. got wait %s", wait)
+	}
+
+	if wait := limiter.take("client", tier, now.Add(250*time.Millisecond)); wait != 250*time.Millisecond {
+		t.Fatalf("expected to wait 250ms. got %s", wait)
+	}
+	if wait := limiter.take("client", tier, now.Add(500*time.Millisecond)); wait != 0 {
+		t.Fatalf("expected refilled token to be allowed. got wait %s", wait)
+	}
+
+	// buckets never hold more than the burst.
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		limiter.take("client", tier, later)
+	}
+	if wait := limiter.take("client", tier, later); wait == 0 {
+		t.Fatalf("expected bucket to be limited to burst")
+	}
+}
+
+func TestRateLimiterTiers(t *testing.T) {
+	limiter := NewRateLimiter(RateTier{Rate: 1, Burst: 1}, RateTier{Rate: 1, Burst: 2}, 100)
+
+	newRequest := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	if limiter.Allow(newRequest("10.0.0.1:1000"), "") != 0 {
+		t.Fatalf("expected first anonymous request to be allowed")
+	}
+	if limiter.Allow(newRequest("10.0.0.1:2000"), "") == 0 {
+		t.Fatalf("expected second anonymous request from same address to be limited")
+	}
+	if limiter.Allow(newRequest("10.0.0.2:1000"), "") != 0 {
+		t.Fatalf("expected anonymous request from other address to be allowed")
+	}
+
+	// authenticated clients are keyed by principal across addresses.
+	for i, addr := range []string{"10.0.0.1:1000", "10.0.0.3:1000"} {
+		if limiter.Allow(newRequest(addr), "user") != 0 {
+			t.Fatalf("expected authenticated request %d to be allowed", i)
+		}
+	}
+	if limiter.Allow(newRequest("10.0.0.4:1000"), "user") == 0 {
+		t.Fatalf("expected authenticated request past burst to be limited")
+	}
+
+	// a zero rate disables limiting.
+	limiter.Anonymous = RateTier{}
+	if limiter.Allow(newRequest("10.0.0.1:1000"), "") != 0 {
+		t.Fatalf("expected disabled tier to allow requests")
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlySeen(t *testing.T) {
+	tier := RateTier{Rate: 1, Burst: 1}
+	limiter := NewRateLimiter(tier, tier, 2)
+	now := time.Now()
+
+	limiter.take("a", tier, now)
+	limiter.take("b", tier, now)
+	limiter.take("a", tier, now)
+	limiter.take("c", tier, now)
+
+	if limiter.Len() != 2 {
+		t.Fatalf("expected 2 tracked clients. got %d", limiter.Len())
+	}
+	// b was evicted, so it starts with a full bucket.
+	if wait := limiter.take("b", tier, now); wait != 0 {
+		t.Fatalf("expected evicted client to be allowed")
+	}
+	if wait := limiter.take("c", tier, now); wait == 0 {
+		t.Fatalf("expected tracked client to be limited")
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter(1, 10*time.Millisecond)
+
+	release, err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter.InFlight() != 1 {
+		t.Fatalf("expected 1 in flight. got %d", limiter.InFlight())
+	}
+
+	if _, err := limiter.Acquire(context.Background()); err != ErrTooManyInFlight {
+		t.Fatalf("expected ErrTooManyInFlight. got %v", err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond)
+		release()
+	}()
+	limiter.MaxWait = time.Second
+	release, err = limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("expected to acquire released slot. got %v", err)
+	}
+	release()
+
+	if limiter.InFlight() != 0 {
+		t.Fatalf("expected 0 in flight. got %d", limiter.InFlight())
+	}
+}
+
+func TestHandlerRateLimited(t *testing.T) {
+	url := "job/task/node/1643842551600000000-sample.jpg"
+	tier := RateTier{Rate: 0.1, Burst: 1}
+	handler := &StorageHandler{
+		Storage:       &mockStorage{files: map[string][]byte{url: randomContent()}},
+		Authenticator: &mockAuthenticator{true},
+		RateLimiter:   NewRateLimiter(tier, tier, 100),
+	}
+
+	assertStatusCode(t, getResponse(t, handler, http.MethodGet, url), http.StatusTemporaryRedirect)
+
+	resp := getResponse(t, handler, http.MethodGet, url)
+	assertStatusCode(t, resp, http.StatusTooManyRequests)
+	if resp.Header.Get("Retry-After") != "10" {
+		t.Fatalf("incorrect Retry-After. got %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestHandlerS3InFlightLimited(t *testing.T) {
+	handler := &StorageHandler{
+		Storage:       &mockStorage{err: ErrTooManyInFlight},
+		Authenticator: &mockAuthenticator{true},
+	}
+
+	resp := getResponse(t, handler, http.MethodHead, randomURL())
+	assertStatusCode(t, resp, http.StatusTooManyRequests)
+	if resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("incorrect Retry-After. got %q", resp.Header.Get("Retry-After"))
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the IP address of the client making r. When trustForwarded is set, the last
+// address in X-Forwarded-For is used, as appended by a reverse proxy such as the ingress. Earlier
+// addresses are set by the client, so they can't be trusted.
+func clientIP(r *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			xff := values[len(values)-1]
+			if i := strings.LastIndex(xff, ","); i >= 0 {
+				xff = xff[i+1:]
+			}
+			if ip := strings.TrimSpace(xff); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// SearchHandler serves searches of the object index. Only objects the client is authorized to
+// download are returned, using the same node certificate, bearer token, basic auth and public
+// access rules as the data endpoint.
+type SearchHandler struct {
+	Index         *ObjectIndex
+	Authenticator Authenticator
+	// Denylist is optional. Blocked files are left out of results.
+	Denylist *Denylist
+	// LoginLimiter is optional and rejects basic auth from clients which are locked out.
+	LoginLimiter *LoginLimiter
+	// RateLimiter is optional and limits the request rate of each client.
+	RateLimiter *RateLimiter
+	Logger      *log.Logger
+}
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+	// maxSearchScan bounds the objects examined by a single request. Searches which match few
+	// objects return a cursor to continue rather than scanning the whole index.
+	maxSearchScan = 100000
+)
+
+type searchItem struct {
+	*IndexedObject
+	Path string `json:"path"`
+}
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	q, limit, err := parseSearchQuery(r)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	authorized, err := authorizeRequestFiles(w, r, h.Authenticator, h.LoginLimiter)
+	if err != nil {
+		h.log("%s %s -> %s: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		return
+	}
+
+	if h.RateLimiter != nil {
+		if wait := h.RateLimiter.Allow(r, requestLogInfoFromContext(r.Context()).Principal); wait > 0 {
+			h.log("%s %s -> %s: rate limited", r.Method, r.URL, r.RemoteAddr)
+			setRetryAfter(w, wait)
+			respondProblem(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+			return
+		}
+	}
+
+	items := []*searchItem{}
+
+	next, err := h.Index.Search(q, maxSearchScan, func(o *IndexedObject) bool {
+		f := o.File()
+		if h.Denylist != nil {
+			if _, blocked := h.Denylist.Blocked(f); blocked {
+				return true
+			}
+		}
+		if authorized(f) {
+			items = append(items, &searchItem{IndexedObject: o, Path: o.Path()})
+		}
+		return len(items) < limit
+	})
+	if err != nil {
+		if errors.Is(err, errInvalidCursor) {
+			respondJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		h.log("%s %s -> %s: failed to search index: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "failed to search index")
+		return
+	}
+
+	type response struct {
+		Objects    []*searchItem `json:"objects"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}
+
+	respondJSON(w, http.StatusOK, &response{
+		Objects:    items,
+		NextCursor: next,
+	})
+}
+
+func (h *SearchHandler) log(format string, v ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Printf(format, v...)
+}
+
+// parseSearchQuery reads the search query and page size from the url query. Times are RFC3339.
+func parseSearchQuery(r *http.Request) (*SearchQuery, int, error) {
+	values := r.URL.Query()
+
+	q := &SearchQuery{
+		JobID:        values.Get("job"),
+		TaskID:       values.Get("task"),
+		NodeID:       values.Get("node"),
+		FilenameGlob: values.Get("filename"),
+		Cursor:       values.Get("cursor"),
+	}
+
+	if q.FilenameGlob != "" {
+		if _, err := path.Match(q.FilenameGlob, ""); err != nil {
+			return nil, 0, fmt.Errorf("invalid filename glob")
+		}
+	}
+
+	for _, t := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"after", &q.After},
+		{"before", &q.Before},
+	} {
+		s := values.Get(t.name)
+		if s == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid %s time. must be RFC3339", t.name)
+		}
+		*t.value = v
+	}
+
+	limit := defaultSearchLimit
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxSearchLimit {
+			return nil, 0, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit)
+		}
+		limit = n
+	}
+
+	return q, limit, nil
+}
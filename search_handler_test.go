@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSearchHandler(t *testing.T) {
+	index := newTestObjectIndex(t)
+
+	t0 := time.Now().AddDate(0, 0, -1).Truncate(time.Second)
+	public := testIndexedObject("sage", "imagesampler-top", "0000000000000001", t0, "sample.jpg")
+	private := testIndexedObject("sage", "imagesampler-top", "0000000000000002", t0.Add(time.Second), "sample.jpg")
+	index.Put(public, private)
+
+	auth := newTestNodesAuthenticator()
+	auth.UpdateSettings(&TableAuthenticatorConfig{
+		Credentials: []*Credential{{Username: "user", Password: "secret"}},
+	})
+
+	handler := &SearchHandler{
+		Index:         index,
+		Authenticator: auth,
+	}
+
+	search := func(url, username, password string) ([]string, *http.Response) {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp
+		}
+		var body struct {
+			Objects []struct {
+				Path string `json:"path"`
+			} `json:"objects"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, o := range body.Objects {
+			paths = append(paths, o.Path)
+		}
+		return paths, resp
+	}
+
+	paths, resp := search("/?task=imagesampler-top", "", "")
+	assertStatusCode(t, resp, http.StatusOK)
+	if len(paths) != 1 || paths[0] != public.Path() {
+		t.Fatalf("expected only public objects for anonymous search. got: %v", paths)
+	}
+
+	paths, resp = search("/?task=imagesampler-top", "user", "secret")
+	assertStatusCode(t, resp, http.StatusOK)
+	if len(paths) != 2 {
+		t.Fatalf("expected all objects for authenticated search. got: %v", paths)
+	}
+
+	_, resp = search("/?task=imagesampler-top", "user", "wrong")
+	assertStatusCode(t, resp, http.StatusUnauthorized)
+
+	paths, resp = search("/?filename=*.flac", "user", "secret")
+	assertStatusCode(t, resp, http.StatusOK)
+	if len(paths) != 0 {
+		t.Fatalf("expected no results. got: %v", paths)
+	}
+
+	for _, url := range []string{
+		"/?after=yesterday",
+		"/?limit=0",
+		"/?limit=1001",
+		"/?filename=[",
+		"/?cursor=!",
+	} {
+		_, resp = search(url, "", "")
+		assertStatusCode(t, resp, http.StatusBadRequest)
+	}
+
+	assertStatusCode(t, getResponse(t, handler, http.MethodPost, "/"), http.StatusMethodNotAllowed)
+
+	handler.RateLimiter = NewRateLimiter(RateTier{Rate: 1, Burst: 1}, RateTier{Rate: 1, Burst: 1}, 100)
+	_, resp = search("/?task=imagesampler-top", "", "")
+	assertStatusCode(t, resp, http.StatusOK)
+	_, resp = search("/?task=imagesampler-top", "", "")
+	assertStatusCode(t, resp, http.StatusTooManyRequests)
+}
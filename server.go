@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServerConfig configures the HTTP server timeouts and limits.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// NewServer creates an http.Server for handler using the configured timeouts and limits.
+func (c *ServerConfig) NewServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
+
+// runServer listens on the server address and serves until ctx is done.
+func runServer(ctx context.Context, server *http.Server, shutdownTimeout time.Duration) error {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return serveListener(ctx, server, ln, shutdownTimeout)
+}
+
+// serveListener serves on ln until ctx is done and then shuts down, giving in-flight requests
+// until shutdownTimeout to finish. The server uses TLS if its TLSConfig is set.
+func serveListener(ctx context.Context, server *http.Server, ln net.Listener, shutdownTimeout time.Duration) error {
+	errc := make(chan error, 1)
+
+	go func() {
+		if server.TLSConfig != nil {
+			errc <- server.ServeTLS(ln, "", "")
+		} else {
+			errc <- server.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shutdown gracefully: %s", err.Error())
+	}
+
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// CertReloader serves a TLS certificate which is reloaded when its files change, so rotated
+// certificates are picked up without a restart.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	// CheckInterval limits how often the files are checked for changes.
+	CheckInterval time.Duration
+	Logger        *log.Logger
+
+	cert        *tls.Certificate
+	modTime     time.Time
+	lastChecked time.Time
+	mu          sync.Mutex
+}
+
+// NewCertReloader creates a CertReloader and loads the initial certificate.
+func NewCertReloader(certFile, keyFile string, logger *log.Logger) (*CertReloader, error) {
+	r := &CertReloader{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CheckInterval: 10 * time.Second,
+		Logger:        logger,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastChecked) >= r.CheckInterval {
+		r.lastChecked = time.Now()
+		if r.filesModTime().After(r.modTime) {
+			if err := r.reload(); err != nil {
+				// keep serving the current certificate, since the new one may only be partially written.
+				r.log("failed to reload tls certificate: %s", err.Error())
+			} else {
+				r.log("reloaded tls certificate")
+			}
+		}
+	}
+
+	return r.cert, nil
+}
+
+func (r *CertReloader) reload() error {
+	modTime := r.filesModTime()
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the latest modification time of the cert and key files.
+func (r *CertReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.CertFile, r.KeyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *CertReloader) log(format string, v ...interface{}) {
+	if r.Logger == nil {
+		return
+	}
+	r.Logger.Printf(format, v...)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeListenerGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	config := &ServerConfig{ShutdownTimeout: 5 * time.Second}
+	server := config.NewServer("", handler)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serveListener(ctx, server, ln, config.ShutdownTimeout)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+
+	<-started
+	cancel()
+
+	// the in-flight request must finish before the server returns.
+	select {
+	case err := <-served:
+		t.Fatalf("server returned before in-flight request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	if b := <-body; b != "done" {
+		t.Fatalf("in-flight request was not drained. got: %q", b)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("expected clean shutdown. got: %s", err)
+	}
+
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+		t.Fatalf("expected new connections to be refused after shutdown")
+	}
+}
+
+func TestServeListenerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serveListener(ctx, (&ServerConfig{}).NewServer("", handler), ln, 50*time.Millisecond)
+	}()
+
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+	cancel()
+
+	if err := <-served; err == nil {
+		t.Fatalf("expected error when in-flight requests exceed shutdown timeout")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	writeTestCert(t, certFile, keyFile, "first")
+
+	reloader, err := NewCertReloader(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatalf("failed to load certificate: %s", err)
+	}
+	reloader.CheckInterval = 0
+
+	assertCertName := func(name string) {
+		t.Helper()
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName != name {
+			t.Fatalf("incorrect certificate. got: %s want: %s", leaf.Subject.CommonName, name)
+		}
+	}
+
+	assertCertName("first")
+
+	writeTestCert(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	assertCertName("second")
+
+	// a broken rotation keeps serving the current certificate.
+	os.WriteFile(certFile, []byte("partial"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	assertCertName("second")
+}
+
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the key pair is valid before returning.
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShareKey is a secret used to sign share tokens. The ID is embedded in each token so keys
+// can be rotated. Removing a key from the list revokes every token signed with it.
+type ShareKey struct {
+	ID     string
+	Secret []byte
+}
+
+// ShareSigner mints and verifies share tokens, which grant access to a single file path or
+// all files under a path prefix until they expire.
+type ShareSigner struct {
+	// Keys lists all valid keys. New tokens are signed with the first key. Use SetKeys to
+	// change them once the signer is in use.
+	Keys   []*ShareKey
+	MaxTTL time.Duration
+
+	mu sync.RWMutex
+}
+
+// SetKeys replaces the valid keys. Tokens signed with a removed key are rejected from then on.
+func (s *ShareSigner) SetKeys(keys []*ShareKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Keys = keys
+}
+
+// ShareClaims are the contents of a share token. Exactly one of Path or Prefix is set.
+type ShareClaims struct {
+	KeyID   string `json:"kid"`
+	Path    string `json:"path,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+// Allows returns whether the claims grant access to the file.
+func (c *ShareClaims) Allows(f *StorageFile) bool {
+	p := storageFilePath(f)
+	if c.Path != "" {
+		return p == c.Path
+	}
+	return c.Prefix != "" && strings.HasPrefix(p, c.Prefix)
+}
+
+func (c *ShareClaims) validate() error {
+	if (c.Path == "") == (c.Prefix == "") {
+		return fmt.Errorf("exactly one of path or prefix must be set")
+	}
+	if c.Path != "" && strings.Count(c.Path, "/") < 3 {
+		return fmt.Errorf("path must be {job}/{task}/{node}/{filename}")
+	}
+	// security: limit prefixes to a single node's files within a task.
+	if c.Prefix != "" && strings.Count(c.Prefix, "/") < 3 {
+		return fmt.Errorf("prefix must include at least {job}/{task}/{node}/")
+	}
+	return nil
+}
+
+// Sign creates a token for claims, which expires after ttl. The key ID and expiry are set by Sign.
+func (s *ShareSigner) Sign(claims *ShareClaims, ttl time.Duration) (string, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.Keys) == 0 {
+		return "", time.Time{}, fmt.Errorf("no share keys configured")
+	}
+	if ttl <= 0 || ttl > s.MaxTTL {
+		return "", time.Time{}, fmt.Errorf("ttl must be between 0 and %s", s.MaxTTL)
+	}
+	if err := claims.validate(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	key := s.Keys[0]
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	claims.KeyID = key.ID
+	claims.Expires = expires.Unix()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(shareSignature(key.Secret, encoded)), expires, nil
+}
+
+// Verify checks the token signature and expiry and returns its claims.
+func (s *ShareSigner) Verify(token string) (*ShareClaims, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed share token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed share token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, fmt.Errorf("malformed share token")
+	}
+
+	var claims ShareClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed share token")
+	}
+
+	key := s.key(claims.KeyID)
+	if key == nil {
+		return nil, fmt.Errorf("share token key %q is not valid", claims.KeyID)
+	}
+	if !hmac.Equal(signature, shareSignature(key.Secret, encoded)) {
+		return nil, fmt.Errorf("invalid share token signature")
+	}
+	if !time.Now().Before(time.Unix(claims.Expires, 0)) {
+		return nil, fmt.Errorf("share token expired")
+	}
+	if err := claims.validate(); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+func (s *ShareSigner) key(id string) *ShareKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.Keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+func shareSignature(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// ParseShareKeys parses a comma separated list of keyID:secret pairs. The first key is used
+// for signing new tokens.
+func ParseShareKeys(s string) ([]*ShareKey, error) {
+	keys := []*ShareKey{}
+
+	for _, s := range splitList(s) {
+		id, secret, ok := strings.Cut(s, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("failed to parse share keys")
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("share key %q must be at least 32 characters", id)
+		}
+		keys = append(keys, &ShareKey{
+			ID:     id,
+			Secret: []byte(secret),
+		})
+	}
+
+	return keys, nil
+}
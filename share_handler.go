@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ShareHandler mints share tokens for users with credentials.
+type ShareHandler struct {
+	Signer      *ShareSigner
+	Credentials CredentialChecker
+	// LoginLimiter is optional and locks out clients after repeated failed logins.
+	LoginLimiter *LoginLimiter
+	// DataURL is the public URL of the data endpoint, used to build share links.
+	DataURL string
+	Logger  *log.Logger
+}
+
+func (h *ShareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type request struct {
+		Path   string `json:"path"`
+		Prefix string `json:"prefix"`
+		TTL    string `json:"ttl"`
+	}
+
+	type response struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+		URL     string    `json:"url,omitempty"`
+	}
+
+	if r.Method != http.MethodPost {
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	username, ok := checkBasicAuth(w, r, h.LoginLimiter, h.Credentials.Authenticated)
+	if !ok {
+		h.log("%s %s -> %s: not authorized", r.Method, r.URL, r.RemoteAddr)
+		return
+	}
+
+	var req request
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		respondJSONError(w, http.StatusBadRequest, "invalid share request: %s", err.Error())
+		return
+	}
+
+	ttl := 24 * time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			respondJSONError(w, http.StatusBadRequest, "invalid ttl: %s", err.Error())
+			return
+		}
+		ttl = d
+	}
+
+	token, expires, err := h.Signer.Sign(&ShareClaims{
+		Path:    req.Path,
+		Prefix:  req.Prefix,
+		Subject: username,
+	}, ttl)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, "invalid share request: %s", err.Error())
+		return
+	}
+
+	h.log("%s %s -> %s: %s shared path=%q prefix=%q until %s", r.Method, r.URL, r.RemoteAddr, username, req.Path, req.Prefix, expires)
+
+	resp := &response{
+		Token:   token,
+		Expires: expires,
+	}
+	if req.Path != "" && h.DataURL != "" {
+		resp.URL = h.DataURL + req.Path + "?token=" + url.QueryEscape(token)
+	}
+
+	respondJSON(w, http.StatusCreated, resp)
+}
+
+func (h *ShareHandler) log(format string, v ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Printf(format, v...)
+}
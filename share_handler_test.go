@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShareHandler(t *testing.T) {
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Credentials: []*Credential{{Username: "user", Password: "secret"}},
+	})
+
+	handler := &ShareHandler{
+		Signer:      newTestShareSigner(),
+		Credentials: auth,
+		DataURL:     "https://storage.example.org/api/v1/data/",
+	}
+
+	do := func(method, body, username, password string) *http.Response {
+		r := httptest.NewRequest(method, "/api/v1/share", strings.NewReader(body))
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assertStatusCode(t, do(http.MethodGet, "", "user", "secret"), http.StatusMethodNotAllowed)
+	assertStatusCode(t, do(http.MethodPost, `{"path": "job/task/node/1-sample.jpg"}`, "", ""), http.StatusUnauthorized)
+	assertStatusCode(t, do(http.MethodPost, `{"path": "job/task/node/1-sample.jpg"}`, "user", "wrong"), http.StatusUnauthorized)
+	assertStatusCode(t, do(http.MethodPost, `{"prefix": "job/"}`, "user", "secret"), http.StatusBadRequest)
+	assertStatusCode(t, do(http.MethodPost, `{"path": "job/task/node/1-sample.jpg", "ttl": "1 week"}`, "user", "secret"), http.StatusBadRequest)
+
+	resp := do(http.MethodPost, `{"path": "job/task/node/1-sample.jpg", "ttl": "1h"}`, "user", "secret")
+	assertStatusCode(t, resp, http.StatusCreated)
+
+	var body struct {
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	claims, err := handler.Signer.Verify(body.Token)
+	if err != nil {
+		t.Fatalf("failed to verify minted token: %s", err)
+	}
+	if claims.Subject != "user" || claims.Path != "job/task/node/1-sample.jpg" {
+		t.Fatalf("incorrect claims: %+v", claims)
+	}
+	if !strings.HasPrefix(body.URL, "https://storage.example.org/api/v1/data/job/task/node/1-sample.jpg?token=") {
+		t.Fatalf("incorrect share url: %s", body.URL)
+	}
+
+	// failed logins count towards the lockout.
+	handler.LoginLimiter = NewLoginLimiter()
+	for i := 0; i < handler.LoginLimiter.Threshold; i++ {
+		assertStatusCode(t, do(http.MethodPost, `{"path": "job/task/node/1-sample.jpg"}`, "user", "wrong"), http.StatusUnauthorized)
+	}
+	assertStatusCode(t, do(http.MethodPost, `{"path": "job/task/node/1-sample.jpg"}`, "user", "secret"), http.StatusTooManyRequests)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShareSigner() *ShareSigner {
+	return &ShareSigner{
+		Keys: []*ShareKey{
+			{ID: "key2", Secret: []byte("0123456789abcdef0123456789abcdef")},
+			{ID: "key1", Secret: []byte("fedcba9876543210fedcba9876543210")},
+		},
+		MaxTTL: 24 * time.Hour,
+	}
+}
+
+func TestShareSignVerify(t *testing.T) {
+	signer := newTestShareSigner()
+
+	token, expires, err := signer.Sign(&ShareClaims{Path: "job/task/node/1-sample.jpg", Subject: "user"}, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err)
+	}
+	if expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("incorrect expiry: %s", expires)
+	}
+
+	claims, err := signer.Verify(token)
+	if err != nil {
+		t.Fatalf("failed to verify token: %s", err)
+	}
+	if claims.KeyID != "key2" || claims.Subject != "user" {
+		t.Fatalf("incorrect claims: %+v", claims)
+	}
+
+	// tokens signed by a key remain valid while the key is listed for verification.
+	rotated := &ShareSigner{Keys: []*ShareKey{{ID: "key3", Secret: []byte("abcdefabcdefabcdefabcdefabcdefab")}, signer.Keys[0]}, MaxTTL: time.Hour}
+	if _, err := rotated.Verify(token); err != nil {
+		t.Fatalf("expected token to be valid after rotation: %s", err)
+	}
+
+	// removing the key revokes its tokens.
+	revoked := &ShareSigner{Keys: signer.Keys[1:], MaxTTL: time.Hour}
+	if _, err := revoked.Verify(token); err == nil {
+		t.Fatalf("expected token to be revoked with its key")
+	}
+
+	payload, sig, _ := strings.Cut(token, ".")
+	if _, err := signer.Verify(payload + "." + sig[1:]); err == nil {
+		t.Fatalf("expected tampered signature to be rejected")
+	}
+	if _, err := signer.Verify("garbage"); err == nil {
+		t.Fatalf("expected malformed token to be rejected")
+	}
+}
+
+func TestShareSetKeys(t *testing.T) {
+	signer := newTestShareSigner()
+
+	token, _, err := signer.Sign(&ShareClaims{Path: "sage/imagesampler-top/node/1-sample.jpg"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the signing key revokes its tokens.
+	signer.SetKeys(signer.Keys[1:])
+	if _, err := signer.Verify(token); err == nil {
+		t.Fatalf("expected token signed with removed key to be rejected")
+	}
+
+	signer.SetKeys(nil)
+	if _, _, err := signer.Sign(&ShareClaims{Path: "sage/imagesampler-top/node/1-sample.jpg"}, time.Hour); err == nil {
+		t.Fatalf("expected sign to fail without keys")
+	}
+}
+
+func TestShareSignInvalid(t *testing.T) {
+	signer := newTestShareSigner()
+
+	testcases := map[string]struct {
+		Claims *ShareClaims
+		TTL    time.Duration
+	}{
+		"noPathOrPrefix": {&ShareClaims{}, time.Hour},
+		"pathAndPrefix":  {&ShareClaims{Path: "job/task/node/1-sample.jpg", Prefix: "job/task/node/"}, time.Hour},
+		"shortPath":      {&ShareClaims{Path: "job/task/1-sample.jpg"}, time.Hour},
+		"broadPrefix":    {&ShareClaims{Prefix: "job/task/"}, time.Hour},
+		"ttlTooLong":     {&ShareClaims{Path: "job/task/node/1-sample.jpg"}, 48 * time.Hour},
+		"ttlNegative":    {&ShareClaims{Path: "job/task/node/1-sample.jpg"}, -time.Hour},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := signer.Sign(tc.Claims, tc.TTL); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestShareClaimsAllows(t *testing.T) {
+	file := &StorageFile{JobID: "job", TaskID: "task", NodeID: "node", Filename: "1-sample.jpg"}
+
+	if !(&ShareClaims{Path: "job/task/node/1-sample.jpg"}).Allows(file) {
+		t.Fatalf("expected path to allow file")
+	}
+	if (&ShareClaims{Path: "job/task/node/1-sample.jp"}).Allows(file) {
+		t.Fatalf("expected path to require exact match")
+	}
+	if !(&ShareClaims{Prefix: "job/task/node/"}).Allows(file) {
+		t.Fatalf("expected prefix to allow file")
+	}
+	if (&ShareClaims{Prefix: "job/task/other/"}).Allows(file) {
+		t.Fatalf("expected other prefix not to allow file")
+	}
+}
+
+func TestHandlerGetShareToken(t *testing.T) {
+	signer := newTestShareSigner()
+	handler := &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: &mockAuthenticator{false},
+		ShareSigner:   signer,
+	}
+
+	token, _, err := signer.Sign(&ShareClaims{Prefix: "job/task/node/"}, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err)
+	}
+	q := "?token=" + url.QueryEscape(token)
+
+	assertStatusCode(t, getResponse(t, handler, http.MethodGet, "job/task/node/1643842551600000001-sample.jpg"+q), http.StatusTemporaryRedirect)
+	assertStatusCode(t, getResponse(t, handler, http.MethodGet, "job/task/other/1643842551600000001-sample.jpg"+q), http.StatusUnauthorized)
+	assertStatusCode(t, getResponse(t, handler, http.MethodGet, "job/task/node/1643842551600000001-sample.jpg?token=invalid"), http.StatusUnauthorized)
+}
+
+func TestParseShareKeys(t *testing.T) {
+	keys, err := ParseShareKeys("new:0123456789abcdef0123456789abcdef,old:fedcba9876543210fedcba9876543210")
+	if err != nil {
+		t.Fatalf("not expecting error but got %s", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "new" || keys[1].ID != "old" {
+		t.Fatalf("incorrect keys: %+v", keys)
+	}
+	if _, err := ParseShareKeys("short:secret"); err == nil {
+		t.Fatalf("expecting error for short secret")
+	}
+	if _, err := ParseShareKeys("0123456789abcdef0123456789abcdef"); err == nil {
+		t.Fatalf("expecting error for missing key id")
+	}
+}
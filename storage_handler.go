@@ -3,18 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Storage interface {
@@ -22,35 +25,189 @@ type Storage interface {
 	GetObjectPresignedURL(ctx context.Context, key string) (string, error)
 }
 
+// ObjectLister is implemented by storages which can enumerate their contents.
+type ObjectLister interface {
+	// ListPrefixes returns the common prefixes directly under prefix, using "/" as the delimiter.
+	ListPrefixes(ctx context.Context, prefix string) ([]string, error)
+	// ListObjects calls fn for each object under prefix until fn returns false.
+	ListObjects(ctx context.Context, prefix string, fn func(obj *s3.Object) bool) error
+}
+
+// ObjectListerAfter is implemented by storages which can resume listing after a key, so new
+// objects can be found without listing everything again.
+type ObjectListerAfter interface {
+	ObjectLister
+	// ListObjectsAfter calls fn for each object under prefix with a key after startAfter until
+	// fn returns false.
+	ListObjectsAfter(ctx context.Context, prefix, startAfter string, fn func(obj *s3.Object) bool) error
+}
+
+// UploadStorage is implemented by storages which can presign uploads.
+type UploadStorage interface {
+	GetObjectPresignedUploadURL(ctx context.Context, key string) (string, error)
+}
+
 type S3Storage struct {
 	Bucket string
 	S3     s3iface.S3API
+	// InFlight is optional and limits the number of s3 requests in flight at once.
+	InFlight *ConcurrencyLimiter
+
+	// presignTTL and uploadPresignTTL are set by SetPresignTTLs and default to a minute.
+	presignTTL       atomic.Int64
+	uploadPresignTTL atomic.Int64
+}
+
+// SetPresignTTLs sets how long presigned download and upload URLs are valid. It can be called
+// while serving requests.
+func (s *S3Storage) SetPresignTTLs(download, upload time.Duration) {
+	s.presignTTL.Store(int64(download))
+	s.uploadPresignTTL.Store(int64(upload))
+}
+
+func presignTTLOrDefault(ttl int64) time.Duration {
+	if ttl <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(ttl)
+}
+
+// acquire waits for a free in flight slot, if limited. The returned release func must be called
+// once the request is done.
+func (s *S3Storage) acquire(ctx context.Context) (release func(), err error) {
+	if s.InFlight == nil {
+		return func() {}, nil
+	}
+	release, err = s.InFlight.Acquire(ctx)
+	if err == ErrTooManyInFlight {
+		s3InFlightRejections.Inc()
+	}
+	return release, err
 }
 
 func (s *S3Storage) GetObjectInfo(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
-	return s.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, span := tracer.Start(ctx, "S3Storage.GetObjectInfo", trace.WithSpanKind(trace.SpanKindClient))
+	resp, err := s.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 	})
+	endSpan(span, err)
+	return resp, err
 }
 
 func (s *S3Storage) GetObjectPresignedURL(ctx context.Context, key string) (string, error) {
+	_, span := tracer.Start(ctx, "S3Storage.GetObjectPresignedURL")
+	defer span.End()
 	req, _ := s.S3.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 	})
-	presignedURL, err := req.Presign(60 * time.Second)
+	presignedURL, err := req.Presign(presignTTLOrDefault(s.presignTTL.Load()))
 	if err != nil {
+		span.RecordError(err)
 		return "", fmt.Errorf("error getting presigned url: %s", err.Error())
 	}
 	return presignedURL, nil
 }
 
+func (s *S3Storage) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, span := tracer.Start(ctx, "S3Storage.ListPrefixes", trace.WithSpanKind(trace.SpanKindClient))
+	var prefixes []string
+	err = s.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(p.Prefix))
+		}
+		return true
+	})
+	endSpan(span, err)
+	return prefixes, err
+}
+
+func (s *S3Storage) ListObjects(ctx context.Context, prefix string, fn func(obj *s3.Object) bool) error {
+	return s.ListObjectsAfter(ctx, prefix, "", fn)
+}
+
+func (s *S3Storage) ListObjectsAfter(ctx context.Context, prefix, startAfter string, fn func(obj *s3.Object) bool) error {
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, span := tracer.Start(ctx, "S3Storage.ListObjects", trace.WithSpanKind(trace.SpanKindClient))
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	if startAfter != "" {
+		input.StartAfter = aws.String(startAfter)
+	}
+	err = s.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if !fn(obj) {
+				return false
+			}
+		}
+		return true
+	})
+	endSpan(span, err)
+	return err
+}
+
+func (s *S3Storage) GetObjectPresignedUploadURL(ctx context.Context, key string) (string, error) {
+	_, span := tracer.Start(ctx, "S3Storage.GetObjectPresignedUploadURL")
+	defer span.End()
+	req, _ := s.S3.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	presignedURL, err := req.Presign(presignTTLOrDefault(s.uploadPresignTTL.Load()))
+	if err != nil {
+		span.RecordError(err)
+		return "", fmt.Errorf("error getting presigned upload url: %s", err.Error())
+	}
+	return presignedURL, nil
+}
+
 type StorageHandler struct {
 	Storage       Storage
 	RootFolder    string
 	Authenticator Authenticator
-	Logger        *log.Logger
+	// Denylist is optional and blocks files regardless of authorization.
+	Denylist *Denylist
+	// LoginLimiter is optional and locks out clients after repeated failed logins.
+	LoginLimiter *LoginLimiter
+	// RateLimiter is optional and limits the request rate of each client.
+	RateLimiter *RateLimiter
+	// Usage is optional and records and limits the bytes downloaded by each principal.
+	Usage *UsageLedger
+	// ShareSigner is optional and allows access using share tokens in the token query parameter.
+	ShareSigner *ShareSigner
+	// Audit is optional and records authorized access to files which are not public.
+	Audit *AuditLogger
+	// Locator is optional and serves {job}/{task}/{node}/latest and ?nearest= lookups.
+	Locator FileLocator
+	// LookupCacheTTL is the max-age of lookup responses. Zero disables caching.
+	LookupCacheTTL time.Duration
+	// Lister is optional and serves HTML directory views of prefixes to browsers.
+	Lister ObjectListerAfter
+	// Proxy is optional and handles requests with authorization which can't be checked locally.
+	// These requests are rejected if it is nil.
+	Proxy  http.Handler
+	Logger *log.Logger
 }
 
 type StorageFile struct {
@@ -63,59 +220,59 @@ type StorageFile struct {
 
 func (h *StorageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Requests which provide an authorization header should be forwarded to the Django site so they can
-	// start using the new auth system.
-	if r.Header.Get("authorization") != "" {
-		h.handleProxyToDjango(w, r)
+	// start using the new auth system. Basic auth is handled here against the static credentials,
+	// falling back to Django if they don't match, and bearer tokens which are JWTs are handled here if
+	// the Authenticator can validate them.
+	if r.Header.Get("authorization") != "" && !h.handlesAuthorization(r) {
+		// takedowns apply to every client, so blocked files are never proxied.
+		if sf, err := getRequestFileID(r); err == nil {
+			annotateRequestFile(r, sf)
+			if err := h.handleDenylist(w, r, sf); err != nil {
+				return
+			}
+		}
+		if h.Proxy == nil {
+			respondProblem(w, http.StatusUnauthorized, "unsupported_authorization", "authorization scheme is not supported")
+			return
+		}
+		h.log("client provided authorization. proxying to django downloads endpoint. %s", r.URL.Path)
+		h.Proxy.ServeHTTP(w, r)
 		return
 	}
 
 	h.log("%s %s -> %s: serving", r.Method, r.URL, r.RemoteAddr)
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
 	switch r.Method {
-	case http.MethodOptions:
-		// what response goes here?
-	case http.MethodHead:
-		h.handleHEAD(w, r)
-	case http.MethodGet:
-		h.handleGET(w, r)
+	case http.MethodHead, http.MethodGet:
+		if h.Locator != nil && isLookupRequest(r) {
+			h.handleLookup(w, r)
+		} else if h.Lister != nil && isBrowseRequest(r) {
+			h.handleBrowse(w, r)
+		} else if r.Method == http.MethodHead {
+			h.handleHEAD(w, r)
+		} else {
+			h.handleGET(w, r)
+		}
+	case http.MethodPut:
+		h.handlePUT(w, r)
 	default:
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 	}
 }
 
-func (h *StorageHandler) handleProxyToDjango(w http.ResponseWriter, r *http.Request) {
-	h.log("client provided authorization. proxying to django downloads endpoint. %s", r.URL.Path)
-	auth := r.Header.Get("authorization")
-	proxyURL := "https://auth.sagecontinuum.org/downloads/" + r.URL.Path
-
-	req, err := http.NewRequest(http.MethodGet, proxyURL, nil)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+func (h *StorageHandler) handlesAuthorization(r *http.Request) bool {
+	if _, _, ok := r.BasicAuth(); ok {
+		return true
 	}
-
-	// Forward Authorization to Django site.
-	req.Header.Set("authorization", auth)
-
-	// Create http Client which does not follow redirects.
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+	if token, ok := bearerToken(r); ok {
+		// tokens which aren't JWTs may be Django tokens, so they're proxied when possible.
+		if h.Proxy != nil && !isJWT(token) {
+			return false
+		}
+		_, ok := h.Authenticator.(TokenAuthenticator)
+		return ok
 	}
-
-	// Forward
-	w.Header().Set("location", resp.Header.Get("location"))
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	return false
 }
 
 func (h *StorageHandler) handleHEAD(w http.ResponseWriter, r *http.Request) {
@@ -124,6 +281,15 @@ func (h *StorageHandler) handleHEAD(w http.ResponseWriter, r *http.Request) {
 		respondJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	annotateRequestFile(r, sf)
+
+	if err := h.handleDenylist(w, r, sf); err != nil {
+		return
+	}
+
+	if err := h.handleRateLimit(w, r); err != nil {
+		return
+	}
 
 	resp, err := h.Storage.GetObjectInfo(r.Context(), h.keyForFileID(sf))
 	if err != nil {
@@ -144,21 +310,261 @@ func (h *StorageHandler) handleGET(w http.ResponseWriter, r *http.Request) {
 		respondJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	annotateRequestFile(r, sf)
+
+	if err := h.handleDenylist(w, r, sf); err != nil {
+		return
+	}
 
 	if err := h.handleAuth(w, r, sf); err != nil {
 		return
 	}
 
+	if err := h.handleRateLimit(w, r); err != nil {
+		return
+	}
+
+	if err := h.handleQuota(w, r, sf); err != nil {
+		return
+	}
+
 	presignedURL, err := h.Storage.GetObjectPresignedURL(r.Context(), h.keyForFileID(sf))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error getting presigned url: %s", err.Error()), http.StatusInternalServerError)
+		h.log("%s %s -> %s: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "")
 		return
 	}
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", sf.Filename))
 	http.Redirect(w, r, presignedURL, http.StatusTemporaryRedirect)
 }
 
+// isLookupRequest reports whether r is for the latest file of a node, {job}/{task}/{node}/latest,
+// or the file nearest a time, {job}/{task}/{node}/?nearest=<time>.
+func isLookupRequest(r *http.Request) bool {
+	parts := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 4 && parts[3] == "latest":
+		return true
+	case len(parts) == 3 && r.URL.Query().Has("nearest"):
+		return true
+	}
+	return false
+}
+
+// handleLookup finds the latest file or the file nearest a time and redirects to it. Link
+// headers point to the previous and next files. With ?format=json, the file is described instead.
+func (h *StorageHandler) handleLookup(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	for _, part := range parts[:3] {
+		if part == "" {
+			respondJSONError(w, http.StatusBadRequest, "job, task and node must be nonempty")
+			return
+		}
+	}
+	prefix := strings.Join(parts[:3], "/") + "/"
+
+	var match, prev, next *IndexedObject
+	var prevKnown, nextKnown bool
+	var err error
+
+	if len(parts) == 4 {
+		match, _, err = h.Locator.Neighbors(r.Context(), prefix, prefix+"\xff")
+		nextKnown = true
+		if err == nil && match != nil && anonymousRequest(r) && !h.public(match.File()) {
+			var public *IndexedObject
+			public, err = h.latestPublic(r.Context(), prefix, match)
+			// clients get the usual error for the newest file if no public file was found, so
+			// they can still learn when it becomes public.
+			if public != nil {
+				match, nextKnown = public, false
+			}
+		}
+	} else {
+		t, perr := time.Parse(time.RFC3339Nano, r.URL.Query().Get("nearest"))
+		if perr != nil {
+			respondJSONError(w, http.StatusBadRequest, "invalid nearest time. must be RFC3339")
+			return
+		}
+		var before, after *IndexedObject
+		before, after, err = h.Locator.Neighbors(r.Context(), prefix, prefix+strconv.FormatInt(t.UnixNano(), 10))
+		if after == nil || (before != nil && t.Sub(before.Timestamp) < after.Timestamp.Sub(t)) {
+			match, next, nextKnown = before, after, true
+		} else {
+			match, prev, prevKnown = after, before, true
+		}
+	}
+	if err == nil && match != nil && !prevKnown {
+		prev, _, err = h.Locator.Neighbors(r.Context(), prefix, match.Path())
+	}
+	if err == nil && match != nil && !nextKnown {
+		_, next, err = h.Locator.Neighbors(r.Context(), prefix, match.Path()+"\x00")
+	}
+	if err != nil {
+		h.log("%s %s -> %s: failed to locate file: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "failed to locate file")
+		return
+	}
+	if match == nil {
+		respondJSONError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	sf := match.File()
+	annotateRequestFile(r, sf)
+
+	if err := h.handleDenylist(w, r, sf); err != nil {
+		return
+	}
+
+	// the file name is only revealed to clients which could download the file.
+	authorized, err := h.authorize(w, r, sf)
+	if err != nil {
+		return
+	}
+
+	if err := h.handleRateLimit(w, r); err != nil {
+		return
+	}
+
+	// references are relative to the request, which is either {node}/latest, {node}/?nearest= or
+	// {node}?nearest=.
+	ref := func(o *IndexedObject) string {
+		if len(parts) == 3 && !strings.HasSuffix(r.URL.Path, "/") {
+			return url.PathEscape(o.NodeID) + "/" + url.PathEscape(o.Filename)
+		}
+		return url.PathEscape(o.Filename)
+	}
+
+	// neighbours are only linked if the client could download them too.
+	linkable := func(o *IndexedObject) bool {
+		if o == nil {
+			return false
+		}
+		f := o.File()
+		if h.Denylist != nil {
+			if _, blocked := h.Denylist.Blocked(f); blocked {
+				return false
+			}
+		}
+		return authorized(f)
+	}
+
+	if linkable(prev) {
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="prev"`, ref(prev)))
+	}
+	if linkable(next) {
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="next"`, ref(next)))
+	}
+	if h.LookupCacheTTL > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(h.LookupCacheTTL.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		respondJSON(w, http.StatusOK, &searchItem{IndexedObject: match, Path: match.Path()})
+		return
+	}
+
+	// http.Redirect would resolve the reference against the path with the route prefix stripped.
+	w.Header().Set("Location", ref(match))
+	w.WriteHeader(http.StatusFound)
+}
+
+// maxLookupScan is the most files latestPublic steps back through before giving up.
+const maxLookupScan = 100
+
+// latestPublic walks back from newest to the latest file anyone may download. Embargoed files are
+// skipped in one step by jumping to the newest timestamp the embargo allows. It returns nil if no
+// public file was found within maxLookupScan steps.
+func (h *StorageHandler) latestPublic(ctx context.Context, prefix string, newest *IndexedObject) (*IndexedObject, error) {
+	reporter, _ := h.Authenticator.(EmbargoReporter)
+	match := newest
+	for i := 0; i < maxLookupScan; i++ {
+		key := match.Path()
+		if reporter != nil {
+			if t, ok := reporter.PublicAfter(match.File()); ok {
+				cutoff := time.Now().Add(-t.Sub(match.Timestamp))
+				key = prefix + strconv.FormatInt(cutoff.UnixNano(), 10) + "\xff"
+			}
+		}
+		prev, _, err := h.Locator.Neighbors(ctx, prefix, key)
+		if err != nil || prev == nil {
+			return nil, err
+		}
+		if h.public(prev.File()) {
+			return prev, nil
+		}
+		match = prev
+	}
+	return nil, nil
+}
+
+// anonymousRequest reports whether r carries no credentials, share token or node certificate.
+func anonymousRequest(r *http.Request) bool {
+	if _, ok := clientNodeID(r); ok {
+		return false
+	}
+	return r.Header.Get("Authorization") == "" && r.URL.Query().Get("token") == ""
+}
+
+// handlePUT redirects nodes to a presigned upload URL for their own files. Nodes are identified
+// by a verified client certificate.
+func (h *StorageHandler) handlePUT(w http.ResponseWriter, r *http.Request) {
+	sf, err := getRequestFileID(r)
+	if err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	annotateRequestFile(r, sf)
+
+	uploads, ok := h.Storage.(UploadStorage)
+	if !ok {
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	nodeID, ok := clientNodeID(r)
+	if !ok {
+		h.log("%s %s -> %s: upload without node certificate", r.Method, r.URL, r.RemoteAddr)
+		respondProblem(w, http.StatusUnauthorized, "node_certificate_required", "node certificate required")
+		return
+	}
+	// node IDs from certificates are lowercase. uploads must use the same case, so a node's files
+	// are never split across keys which only differ in case.
+	if sf.NodeID != nodeID {
+		h.log("%s %s -> %s: node %s cannot upload files for node %s", r.Method, r.URL, r.RemoteAddr, nodeID, sf.NodeID)
+		h.recordDecision(r, sf, "denied", "node:"+nodeID)
+		if strings.EqualFold(sf.NodeID, nodeID) {
+			respondJSONError(w, http.StatusBadRequest, "node id must be lowercase")
+		} else {
+			respondJSONError(w, http.StatusForbidden, "not authorized")
+		}
+		return
+	}
+	h.recordDecision(r, sf, "node_certificate", "node:"+nodeID)
+
+	if err := h.handleRateLimit(w, r); err != nil {
+		return
+	}
+
+	presignedURL, err := uploads.GetObjectPresignedUploadURL(r.Context(), h.keyForFileID(sf))
+	if err != nil {
+		h.log("%s %s -> %s: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "")
+		return
+	}
+	http.Redirect(w, r, presignedURL, http.StatusTemporaryRedirect)
+}
+
 func (h *StorageHandler) handleS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrTooManyInFlight {
+		h.log("%s %s -> %s: too many s3 requests in flight", r.Method, r.URL, r.RemoteAddr)
+		setRetryAfter(w, time.Second)
+		respondProblem(w, http.StatusTooManyRequests, "storage_busy", "too many requests to storage. try again later")
+		return
+	}
+
 	switch err := err.(type) {
 	case awserr.Error:
 		switch err.Code() {
@@ -176,19 +582,271 @@ func (h *StorageHandler) handleS3Error(w http.ResponseWriter, r *http.Request, e
 		return
 	}
 
+	// security: s3 errors may include internal details, so they are only logged.
 	h.log("%s %s -> %s: s3 error: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
-	respondJSONError(w, http.StatusInternalServerError, "internal server error with S3 request: %s", err.Error())
+	respondProblem(w, http.StatusInternalServerError, "storage_error", "error when accessing storage")
+}
+
+// handleRateLimit limits requests by the principal recorded by auth or, for anonymous requests,
+// by remote address.
+func (h *StorageHandler) handleRateLimit(w http.ResponseWriter, r *http.Request) error {
+	if h.RateLimiter == nil {
+		return nil
+	}
+	wait := h.RateLimiter.Allow(r, requestLogInfoFromContext(r.Context()).Principal)
+	if wait <= 0 {
+		return nil
+	}
+	h.log("%s %s -> %s: rate limited", r.Method, r.URL, r.RemoteAddr)
+	setRetryAfter(w, wait)
+	respondProblem(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+	return fmt.Errorf("rate limited")
+}
+
+// handleQuota records the download of f by an authenticated principal, if it fits in their quota.
+// The object size is looked up in storage, as the download itself goes directly to storage. The
+// quota counts authorized downloads rather than bytes transferred: the whole object is charged
+// each time a download url is issued, even if the client never uses it or only reads a range.
+func (h *StorageHandler) handleQuota(w http.ResponseWriter, r *http.Request, f *StorageFile) error {
+	if h.Usage == nil {
+		return nil
+	}
+	principal := requestLogInfoFromContext(r.Context()).Principal
+	if principal == "" {
+		return nil
+	}
+
+	info, err := h.Storage.GetObjectInfo(r.Context(), h.keyForFileID(f))
+	if err != nil {
+		h.handleS3Error(w, r, err)
+		return err
+	}
+
+	now := time.Now()
+	result, err := h.Usage.Reserve(principal, aws.Int64Value(info.ContentLength), now)
+	if err != nil {
+		// fail open so an unavailable ledger does not block downloads.
+		h.log("%s %s -> %s: failed to record usage: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		return nil
+	}
+	if result.Allowed {
+		return nil
+	}
+
+	quotaRejections.WithLabelValues(result.Period).Inc()
+	h.log("%s %s -> %s: %s exceeded %s download quota", r.Method, r.URL, r.RemoteAddr, principal, result.Period)
+	if result.TooLarge {
+		respondProblem(w, http.StatusForbidden, "quota_too_small", fmt.Sprintf("file is larger than the %s download quota", result.Period))
+		return fmt.Errorf("quota too small")
+	}
+	setRetryAfter(w, result.ResetAt.Sub(now))
+	respondProblem(w, http.StatusTooManyRequests, "quota_exceeded", fmt.Sprintf("%s download quota exceeded", result.Period))
+	return fmt.Errorf("quota exceeded")
+}
+
+func (h *StorageHandler) handleDenylist(w http.ResponseWriter, r *http.Request, f *StorageFile) error {
+	if h.Denylist == nil {
+		return nil
+	}
+	entry, blocked := h.Denylist.Blocked(f)
+	if !blocked {
+		return nil
+	}
+	h.log("%s %s -> %s: blocked by denylist entry %s", r.Method, r.URL, r.RemoteAddr, entry.ID)
+	respondJSONError(w, http.StatusUnavailableForLegalReasons, "unavailable")
+	return fmt.Errorf("blocked by denylist")
 }
 
 func (h *StorageHandler) handleAuth(w http.ResponseWriter, r *http.Request, f *StorageFile) error {
+	_, err := h.authorize(w, r, f)
+	return err
+}
+
+// authorize checks that the client may download f. It also returns a fileAuthorizer for other
+// files using the same credentials, without checking them again.
+func (h *StorageHandler) authorize(w http.ResponseWriter, r *http.Request, f *StorageFile) (fileAuthorizer, error) {
+	ctx, span := tracer.Start(r.Context(), "StorageHandler.handleAuth")
+	defer func() {
+		span.SetAttributes(attribute.String("sage.auth_decision", requestLogInfoFromContext(ctx).Decision))
+		span.End()
+	}()
+	r = r.WithContext(ctx)
+
+	// nodes can always access their own files.
+	if nodeID, ok := clientNodeID(r); ok && strings.EqualFold(nodeID, f.NodeID) {
+		h.recordDecision(r, f, "node_certificate", "node:"+strings.ToLower(nodeID))
+		return func(g *StorageFile) bool {
+			return strings.EqualFold(nodeID, g.NodeID) || h.public(g)
+		}, nil
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" && h.ShareSigner != nil {
+		claims, err := h.ShareSigner.Verify(token)
+		if err == nil && claims.Allows(f) {
+			h.log("%s %s -> %s: authorized by share token from %s", r.Method, r.URL.Path, r.RemoteAddr, claims.Subject)
+			// downloads are charged to the quota of the user who created the link.
+			h.recordDecision(r, f, "share_token", claims.Subject)
+			return func(g *StorageFile) bool {
+				return claims.Allows(g) || h.public(g)
+			}, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("share token does not allow this file")
+		}
+		h.log("%s %s -> %s: share token rejected: %s", r.Method, r.URL.Path, r.RemoteAddr, err.Error())
+	}
+
+	if token, ok := bearerToken(r); ok {
+		if tokenAuth, ok := h.Authenticator.(TokenAuthenticator); ok {
+			return h.handleTokenAuth(w, r, f, tokenAuth, token)
+		}
+	}
+
 	username, password, hasAuth := r.BasicAuth()
-	if h.Authenticator.Authorized(f, username, password, hasAuth) {
-		return nil
+	rejected := false
+
+	if hasAuth {
+		if h.LoginLimiter != nil {
+			if wait := h.LoginLimiter.Check(r, username); wait > 0 {
+				authFailures.WithLabelValues("locked_out").Inc()
+				h.recordDecision(r, f, "locked_out", username)
+				h.log("%s %s -> %s: locked out after failed logins", r.Method, r.URL, r.RemoteAddr)
+				setRetryAfter(w, wait)
+				respondProblem(w, http.StatusTooManyRequests, "locked_out", "too many failed login attempts")
+				return nil, fmt.Errorf("locked out")
+			}
+		}
+		if checker, ok := h.Authenticator.(CredentialChecker); ok {
+			if checker.Authenticated(username, password) {
+				if h.LoginLimiter != nil {
+					h.LoginLimiter.Success(r, username)
+				}
+				h.recordDecision(r, f, "credential", username)
+				return func(g *StorageFile) bool {
+					return true
+				}, nil
+			}
+			// credentials which don't match locally may be for a Django account.
+			if h.Proxy != nil {
+				h.proxyCredentials(w, r, username)
+				return nil, fmt.Errorf("proxied")
+			}
+			authFailures.WithLabelValues("invalid_credentials").Inc()
+			if h.LoginLimiter != nil {
+				h.LoginLimiter.Failure(r, username)
+			}
+			rejected = true
+		}
+	}
+
+	// rejected credentials only get public access. they aren't passed on, as checking them
+	// again would hash the password a second time.
+	authorized := h.public
+	if !rejected {
+		authorized = func(g *StorageFile) bool {
+			return h.Authenticator.Authorized(g, username, password, hasAuth)
+		}
+	}
+
+	if authorized(f) {
+		// credentials were already checked above if the authenticator supports it. public access
+		// has no principal, so unverified usernames aren't logged or charged quota.
+		if _, ok := h.Authenticator.(CredentialChecker); hasAuth && !ok {
+			h.recordDecision(r, f, "credential", username)
+		} else {
+			h.recordDecision(r, f, "public", "")
+		}
+		return authorized, nil
 	}
 	h.log("%s %s -> %s: not authorized", r.Method, r.URL, r.RemoteAddr)
+	h.recordDecision(r, f, "denied", "")
+	if reporter, ok := h.Authenticator.(EmbargoReporter); ok {
+		if t, ok := reporter.PublicAfter(f); ok {
+			w.Header().Set("X-Public-After", t.UTC().Format(http.TimeFormat))
+		}
+	}
 	w.Header().Set("WWW-Authenticate", "Basic domain=storage.sagecontinuum.org")
 	respondJSONError(w, http.StatusUnauthorized, "not authorized")
-	return fmt.Errorf("not authorized")
+	return nil, fmt.Errorf("not authorized")
+}
+
+// public reports whether anyone may download f.
+func (h *StorageHandler) public(f *StorageFile) bool {
+	return h.Authenticator.Authorized(f, "", "", false)
+}
+
+// proxyCredentials forwards a request with basic auth which doesn't match the local credentials
+// to Django. Logins rejected by Django count towards the lockout like local failures.
+func (h *StorageHandler) proxyCredentials(w http.ResponseWriter, r *http.Request, username string) {
+	h.log("%s %s -> %s: credentials not found locally. proxying to django downloads endpoint", r.Method, r.URL, r.RemoteAddr)
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	h.Proxy.ServeHTTP(lw, r)
+	if h.LoginLimiter == nil {
+		return
+	}
+	switch {
+	case lw.status == http.StatusUnauthorized || lw.status == http.StatusForbidden:
+		authFailures.WithLabelValues("invalid_credentials").Inc()
+		h.LoginLimiter.Failure(r, username)
+	case lw.status < http.StatusBadRequest:
+		h.LoginLimiter.Success(r, username)
+	}
+}
+
+func (h *StorageHandler) handleTokenAuth(w http.ResponseWriter, r *http.Request, f *StorageFile, tokenAuth TokenAuthenticator, token string) (fileAuthorizer, error) {
+	authorized, err := tokenAuth.ValidateToken(r.Context(), token)
+	if err != nil {
+		h.log("%s %s -> %s: invalid token: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		h.recordDecision(r, f, "invalid_token", "")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		respondProblem(w, http.StatusUnauthorized, "invalid_token", "invalid token")
+		return nil, err
+	}
+	if authorized(f) {
+		h.recordDecision(r, f, "token", "")
+		return authorized, nil
+	}
+	h.log("%s %s -> %s: token not authorized", r.Method, r.URL, r.RemoteAddr)
+	h.recordDecision(r, f, "denied", "")
+	respondJSONError(w, http.StatusForbidden, "not authorized")
+	return nil, fmt.Errorf("not authorized")
+}
+
+// annotateRequestFile adds the requested file to the request log and trace.
+func annotateRequestFile(r *http.Request, f *StorageFile) {
+	requestLogInfoFromContext(r.Context()).File = f
+	trace.SpanFromContext(r.Context()).SetAttributes(fileAttributes(f)...)
+}
+
+// authorizedDecisions are the decisions which grant access to a file.
+var authorizedDecisions = map[string]bool{
+	"public":           true,
+	"credential":       true,
+	"token":            true,
+	"share_token":      true,
+	"node_certificate": true,
+}
+
+// recordDecision records an access decision in the metrics and request log and audits
+// authorized access to files which are not public. An empty principal keeps any principal
+// already set by the authenticator.
+func (h *StorageHandler) recordDecision(r *http.Request, f *StorageFile, decision, principal string) {
+	authDecisions.WithLabelValues(decision).Inc()
+
+	info := requestLogInfoFromContext(r.Context())
+	info.Decision = decision
+	if principal != "" {
+		info.Principal = principal
+	}
+
+	if h.Audit == nil || !authorizedDecisions[decision] || decision == "public" {
+		return
+	}
+	// credentials may have been used for a file which anyone can access.
+	if h.Authenticator.Authorized(f, "", "", false) {
+		return
+	}
+	h.Audit.Record(r, f, info.Principal, decision)
 }
 
 func (h *StorageHandler) keyForFileID(f *StorageFile) string {
@@ -202,6 +860,15 @@ func (h *StorageHandler) log(format string, v ...interface{}) {
 	h.Logger.Printf(format, v...)
 }
 
+// bearerToken returns the token from an Authorization: Bearer header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
 func parseNanosecondTimestamp(s string) (time.Time, error) {
 	nsec, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
@@ -219,10 +886,15 @@ func extractTimestampFromFilename(s string) (time.Time, error) {
 }
 
 func getRequestFileID(r *http.Request) (*StorageFile, error) {
-	// url format is {jobID}/{taskID}/{nodeID}/{timestampAndFilename}
-	parts := strings.SplitN(r.URL.Path, "/", 4)
+	return parseStorageFilePath(r.URL.Path)
+}
+
+// parseStorageFilePath parses a path in the {jobID}/{taskID}/{nodeID}/{timestampAndFilename}
+// format used by both urls and storage keys.
+func parseStorageFilePath(p string) (*StorageFile, error) {
+	parts := strings.SplitN(p, "/", 4)
 	if len(parts) != 4 {
-		return nil, fmt.Errorf("invalid path: %q", r.URL.Path)
+		return nil, fmt.Errorf("invalid path: %q", p)
 	}
 
 	jobID := parts[0]
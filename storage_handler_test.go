@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,11 +30,70 @@ func TestHandlerGetUnauthorized(t *testing.T) {
 	resp := getResponse(t, handler, http.MethodGet, randomURL())
 	assertStatusCode(t, resp, http.StatusUnauthorized)
 	assertReadContent(t, resp, []byte(`{
-  "error": "not authorized"
+  "type": "about:blank",
+  "title": "Unauthorized",
+  "status": 401,
+  "code": "unauthorized",
+  "detail": "not authorized"
 }
 `))
 }
 
+func TestHandlerS3ErrorNotLeaked(t *testing.T) {
+	handler := &AccessLogger{
+		Handler: &StorageHandler{
+			Storage:       &mockStorage{err: fmt.Errorf("InternalError: secret-bucket at 10.0.0.5 is unavailable")},
+			Authenticator: &mockAuthenticator{true},
+		},
+	}
+	resp := getResponse(t, handler, http.MethodHead, randomURL())
+	assertStatusCode(t, resp, http.StatusInternalServerError)
+
+	var body problem
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "storage_error" || strings.Contains(body.Detail, "secret-bucket") {
+		t.Fatalf("expected generic storage error. got: %+v", body)
+	}
+	if body.RequestID == "" || body.RequestID != resp.Header.Get("X-Request-ID") {
+		t.Fatalf("expected request id in body to match header. got: %q want: %q", body.RequestID, resp.Header.Get("X-Request-ID"))
+	}
+}
+
+func TestHandlerGetEmbargoed(t *testing.T) {
+	commissionDate := time.Now().AddDate(-1, 0, 0)
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Nodes: map[string]*TableAuthenticatorNode{
+			"node": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+		},
+		Embargo: 24 * time.Hour,
+	})
+	handler := &StorageHandler{
+		Storage:       &mockStorage{},
+		Authenticator: auth,
+	}
+
+	timestamp := time.Now().Add(-time.Hour).Truncate(time.Second)
+	resp := getResponse(t, handler, http.MethodGet, fmt.Sprintf("job/task/node/%d-sample.jpg", timestamp.UnixNano()))
+	assertStatusCode(t, resp, http.StatusUnauthorized)
+
+	after, err := http.ParseTime(resp.Header.Get("X-Public-After"))
+	if err != nil {
+		t.Fatalf("failed to parse X-Public-After header: %s", err)
+	}
+	if !after.Equal(timestamp.Add(24 * time.Hour)) {
+		t.Fatalf("incorrect X-Public-After header. got: %s want: %s", after, timestamp.Add(24*time.Hour))
+	}
+
+	resp = getResponse(t, handler, http.MethodGet, fmt.Sprintf("job/task/node/%d-sample.jpg", time.Now().AddDate(0, 0, -2).UnixNano()))
+	assertStatusCode(t, resp, http.StatusTemporaryRedirect)
+}
+
 func TestHandlerGetAuthorized(t *testing.T) {
 	handler := &StorageHandler{
 		Storage:       &mockStorage{},
@@ -141,35 +204,204 @@ func TestHandlerGetContentDisposition(t *testing.T) {
 	}
 }
 
-func TestHandlerCORSHeaders(t *testing.T) {
+func TestHandlerLookup(t *testing.T) {
+	storage := newTestLookupStorage()
 	handler := &StorageHandler{
-		Storage:       &mockStorage{},
-		Authenticator: &mockAuthenticator{true},
+		Storage:        storage,
+		RootFolder:     "node-data",
+		Authenticator:  &mockAuthenticator{true},
+		Locator:        newTestLookupIndex(t, storage),
+		LookupCacheTTL: 10 * time.Second,
 	}
 
-	for _, method := range testMethods {
-		resp := getResponse(t, handler, method, randomURL())
+	testcases := map[string]struct {
+		URL      string
+		Location string
+		Links    []string
+	}{
+		"Latest": {
+			URL:      "sage/imagesampler-top/0000000000000001/latest",
+			Location: "1672531320000000000-sample.jpg",
+			Links:    []string{`<1672531260000000000-sample.jpg>; rel="prev"`},
+		},
+		"NearestBefore": {
+			URL:      "sage/imagesampler-top/0000000000000001/?nearest=2023-01-01T00:01:10Z",
+			Location: "1672531260000000000-sample.jpg",
+			Links:    []string{`<1672531200000000000-sample.jpg>; rel="prev"`, `<1672531320000000000-sample.jpg>; rel="next"`},
+		},
+		"NearestAfter": {
+			URL:      "sage/imagesampler-top/0000000000000001?nearest=2023-01-01T00:01:50Z",
+			Location: "0000000000000001/1672531320000000000-sample.jpg",
+			Links:    []string{`<0000000000000001/1672531260000000000-sample.jpg>; rel="prev"`},
+		},
+		"NearestFirst": {
+			URL:      "sage/imagesampler-top/0000000000000001/?nearest=2022-01-01T00:00:00Z",
+			Location: "1672531200000000000-sample.jpg",
+			Links:    []string{`<1672531260000000000-sample.jpg>; rel="next"`},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			resp := getResponse(t, handler, http.MethodGet, tc.URL)
+			assertStatusCode(t, resp, http.StatusFound)
+			if loc := resp.Header.Get("Location"); loc != tc.Location {
+				t.Fatalf("incorrect location. got: %s want: %s", loc, tc.Location)
+			}
+			if links := resp.Header.Values("Link"); strings.Join(links, ",") != strings.Join(tc.Links, ",") {
+				t.Fatalf("incorrect links. got: %v want: %v", links, tc.Links)
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != "private, max-age=10" {
+				t.Fatalf("incorrect cache control: %s", cc)
+			}
+		})
+	}
 
-		allowOrigin := resp.Header.Get("Access-Control-Allow-Origin")
-		if allowOrigin != "*" {
-			t.Fatalf("Access-Control-Allow-Origin must be *. got %q", allowOrigin)
+	t.Run("JSON", func(t *testing.T) {
+		resp := getResponse(t, handler, http.MethodGet, "sage/imagesampler-top/0000000000000002/latest?format=json")
+		assertStatusCode(t, resp, http.StatusOK)
+		var item searchItem
+		if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+			t.Fatal(err)
+		}
+		if item.Path != "sage/imagesampler-top/0000000000000002/1672531230000000000-sample.jpg" || item.Size != 1 {
+			t.Fatalf("incorrect file: %+v", item)
 		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		resp := getResponse(t, handler, http.MethodGet, "sage/imagesampler-top/0000000000000003/latest")
+		assertStatusCode(t, resp, http.StatusNotFound)
+	})
+
+	t.Run("InvalidTime", func(t *testing.T) {
+		resp := getResponse(t, handler, http.MethodGet, "sage/imagesampler-top/0000000000000001/?nearest=yesterday")
+		assertStatusCode(t, resp, http.StatusBadRequest)
+	})
+
+	t.Run("DenylistedNeighbour", func(t *testing.T) {
+		handler := *handler
+		handler.Denylist = NewDenylist(&FileDenylistStore{Path: filepath.Join(t.TempDir(), "denylist.json")}, nil)
+		err := handler.Denylist.Add(context.Background(), &DenylistEntry{
+			Prefix: "sage/imagesampler-top/0000000000000001/1672531260000000000-",
+			Reason: "takedown",
+		}, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := getResponse(t, &handler, http.MethodGet, "sage/imagesampler-top/0000000000000001/latest")
+		assertStatusCode(t, resp, http.StatusFound)
+		if links := resp.Header.Values("Link"); len(links) != 0 {
+			t.Fatalf("expected denylisted neighbour to not be linked. got: %v", links)
+		}
+	})
+
+	t.Run("RateLimitedByPrincipal", func(t *testing.T) {
+		handler := *handler
+		handler.RateLimiter = NewRateLimiter(RateTier{Rate: 0.001, Burst: 1}, RateTier{Rate: 0.001, Burst: 3}, 100)
+
+		do := func(username string) *http.Response {
+			r, _ := http.NewRequest(http.MethodGet, "sage/imagesampler-top/0000000000000001/latest", nil)
+			if username != "" {
+				r.SetBasicAuth(username, "secret")
+			}
+			w := httptest.NewRecorder()
+			// the access logger records the principal found by auth.
+			(&AccessLogger{Handler: &handler}).ServeHTTP(w, r)
+			return w.Result()
+		}
+
+		// lookups with credentials are limited at the authenticated tier.
+		for i := 0; i < 3; i++ {
+			assertStatusCode(t, do("user"), http.StatusFound)
+		}
+		assertStatusCode(t, do("user"), http.StatusTooManyRequests)
+
+		assertStatusCode(t, do(""), http.StatusFound)
+		assertStatusCode(t, do(""), http.StatusTooManyRequests)
+	})
 
-		// TODO(sean) check other expected headers
-		// methods := resp.Header.Values("Access-Control-Allow-Methods")
-		// sort.Strings(methods)
-		// if strings.Join(methods, ",") != "GET,HEAD,OPTIONS" {
-		// 	t.Fatalf("allow methods must be GET, HEAD and OPTIONS")
-		// }
+	t.Run("Unauthorized", func(t *testing.T) {
+		handler := *handler
+		handler.Authenticator = &mockAuthenticator{false}
+		resp := getResponse(t, &handler, http.MethodGet, "sage/imagesampler-top/0000000000000001/latest")
+		assertStatusCode(t, resp, http.StatusUnauthorized)
+		if resp.Header.Get("Location") != "" || resp.Header.Get("Link") != "" {
+			t.Fatalf("expected file names to not be revealed")
+		}
+	})
+}
+
+func TestHandlerLookupEmbargoed(t *testing.T) {
+	commissionDate := time.Now().AddDate(-1, 0, 0)
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Nodes: map[string]*TableAuthenticatorNode{
+			"node": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+		},
+		Embargo: 24 * time.Hour,
+	})
+
+	now := time.Now().Truncate(time.Second)
+	filename := func(age time.Duration) string {
+		return fmt.Sprintf("%d-sample.jpg", now.Add(-age).UnixNano())
+	}
+	storage := &mockStorage{files: map[string][]byte{}}
+	for _, age := range []time.Duration{time.Hour, 2 * time.Hour, 48 * time.Hour, 72 * time.Hour} {
+		storage.files["node-data/job/task/node/"+filename(age)] = []byte("a")
 	}
+	handler := &StorageHandler{
+		Storage:       storage,
+		RootFolder:    "node-data",
+		Authenticator: auth,
+		Locator:       newTestLookupIndex(t, storage),
+	}
+
+	t.Run("Anonymous", func(t *testing.T) {
+		resp := getResponse(t, handler, http.MethodGet, "job/task/node/latest")
+		assertStatusCode(t, resp, http.StatusFound)
+		if loc := resp.Header.Get("Location"); loc != filename(48*time.Hour) {
+			t.Fatalf("expected latest public file. got: %q want: %q", loc, filename(48*time.Hour))
+		}
+		want := []string{fmt.Sprintf(`<%s>; rel="prev"`, filename(72*time.Hour))}
+		if links := resp.Header.Values("Link"); strings.Join(links, ",") != strings.Join(want, ",") {
+			t.Fatalf("incorrect links. got: %v want: %v", links, want)
+		}
+	})
+
+	t.Run("AllEmbargoed", func(t *testing.T) {
+		auth.UpdateConfig(&TableAuthenticatorConfig{
+			Nodes: map[string]*TableAuthenticatorNode{
+				"node": {
+					Public:         true,
+					CommissionDate: &commissionDate,
+				},
+			},
+			Embargo: 7 * 24 * time.Hour,
+		})
+		resp := getResponse(t, handler, http.MethodGet, "job/task/node/latest")
+		assertStatusCode(t, resp, http.StatusUnauthorized)
+		if resp.Header.Get("X-Public-After") == "" {
+			t.Fatalf("expected X-Public-After header for the newest file")
+		}
+	})
 }
 
 // mockS3Client provides a fixed set of content using an in-memory map of URLs to data
 type mockStorage struct {
 	files map[string][]byte
+	// err is returned by all calls if set.
+	err error
 }
 
 func (s *mockStorage) GetObjectInfo(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
 	if s.files == nil {
 		return nil, awserr.New(s3.ErrCodeNoSuchKey, "", nil)
 	}
@@ -183,9 +415,54 @@ func (s *mockStorage) GetObjectInfo(ctx context.Context, key string) (*s3.HeadOb
 }
 
 func (s *mockStorage) GetObjectPresignedURL(ctx context.Context, key string) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
 	return fmt.Sprintf("https://real-storage-host/%s", key), nil
 }
 
+func (s *mockStorage) GetObjectPresignedUploadURL(ctx context.Context, key string) (string, error) {
+	return fmt.Sprintf("https://real-storage-host/%s?upload", key), nil
+}
+
+func (s *mockStorage) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	var prefixes []string
+	for key := range s.files {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		dir, _, ok := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		if !ok || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		prefixes = append(prefixes, prefix+dir+"/")
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+func (s *mockStorage) ListObjects(ctx context.Context, prefix string, fn func(obj *s3.Object) bool) error {
+	return s.ListObjectsAfter(ctx, prefix, "", fn)
+}
+
+func (s *mockStorage) ListObjectsAfter(ctx context.Context, prefix, startAfter string, fn func(obj *s3.Object) bool) error {
+	var keys []string
+	for key := range s.files {
+		if strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(&s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(s.files[key])))}) {
+			return nil
+		}
+	}
+	return nil
+}
+
 // mockAuthenticator provides a simple "allow all" or "reject all" policy for testing
 type mockAuthenticator struct {
 	authorized bool
@@ -250,3 +527,53 @@ func randomContent() []byte {
 	}
 	return b
 }
+
+// countingCredentialAuthenticator counts how many times credentials are checked, each of which
+// would hash the password with a real authenticator.
+type countingCredentialAuthenticator struct {
+	public bool
+	checks int
+}
+
+func (a *countingCredentialAuthenticator) Authenticated(username, password string) bool {
+	a.checks++
+	return username == "user" && password == "secret"
+}
+
+func (a *countingCredentialAuthenticator) Authorized(f *StorageFile, username, password string, hasAuth bool) bool {
+	if hasAuth && a.Authenticated(username, password) {
+		return true
+	}
+	return a.public
+}
+
+func TestHandlerRejectedCredentialsCheckedOnce(t *testing.T) {
+	testcases := map[string]struct {
+		Public bool
+		Status int
+	}{
+		"Public":  {true, http.StatusTemporaryRedirect},
+		"Private": {false, http.StatusUnauthorized},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			auth := &countingCredentialAuthenticator{public: tc.Public}
+			handler := &StorageHandler{
+				Storage:       &mockStorage{},
+				Authenticator: auth,
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.URL.Path = "job/task/node/1643842551600000001-sample.jpg"
+			r.SetBasicAuth("user", "wrong")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assertStatusCode(t, w.Result(), tc.Status)
+			if auth.checks != 1 {
+				t.Fatalf("expected credentials to be checked once. got: %d", auth.checks)
+			}
+		})
+	}
+}
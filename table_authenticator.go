@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/subtle"
 	"encoding/json"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,23 +18,49 @@ import (
 // TableAuthenticator is an Authenticator which authenticates based
 // on a fixed username / password and table of nodes.
 type TableAuthenticator struct {
-	config *TableAuthenticatorConfig
-	mu     sync.RWMutex
+	config  *TableAuthenticatorConfig
+	updated time.Time
+	mu      sync.RWMutex
 }
 
 type Credential struct {
 	Username string
+	// Password is a plaintext password. It is ignored if Hash is set.
 	Password string
+	// Hash is a bcrypt or argon2id password hash.
+	Hash string
+	// Label describes who or what the credential was issued to.
+	Label string
+	// Expires is optional. The credential is rejected after this time.
+	Expires *time.Time
+}
+
+func (c *Credential) expired(now time.Time) bool {
+	return c.Expires != nil && !now.Before(*c.Expires)
 }
 
 type TableAuthenticatorConfig struct {
 	// NOTE(sean) username / password is part of the config, as this should eventually be "pluggable" against an auth system
 	Credentials []*Credential
 	Nodes       map[string]*TableAuthenticatorNode
+	// Embargo delays public access to files until this long after their timestamp.
+	Embargo time.Duration
+	// NodeEmbargo overrides Embargo for specific nodes.
+	NodeEmbargo map[string]time.Duration
+	// TaskPolicies restricts files from matching tasks from being public, regardless of the node.
+	TaskPolicies []*TaskPolicyRule
+}
+
+func (c *TableAuthenticatorConfig) embargo(nodeID string) time.Duration {
+	if d, ok := c.NodeEmbargo[nodeID]; ok {
+		return d
+	}
+	return c.Embargo
 }
 
 type TableAuthenticatorNode struct {
 	NodeID         string
+	Project        string
 	CommissionDate *time.Time
 	RetireDate     *time.Time
 	Public         bool
@@ -47,14 +75,90 @@ func NewTableAuthenticator() *TableAuthenticator {
 	}
 }
 
-// UpdateConfig updates the config used for authorization.
+// UpdateConfig updates the config used for authorization. A config with a nil
+// node table is treated as not having loaded the node table yet.
 func (a *TableAuthenticator) UpdateConfig(config *TableAuthenticatorConfig) {
 	a.mu.Lock()
 	// TODO(sean) protect against ownership bugs by cloning data
 	a.config = config
+	if config.Nodes != nil {
+		a.updated = time.Now()
+	} else {
+		a.updated = time.Time{}
+	}
+	a.mu.Unlock()
+}
+
+// UpdateNodes replaces the node table, keeping the rest of the config.
+func (a *TableAuthenticator) UpdateNodes(nodes map[string]*TableAuthenticatorNode) {
+	a.mu.Lock()
+	config := *a.config
+	config.Nodes = nodes
+	a.config = &config
+	a.updated = time.Now()
+	a.mu.Unlock()
+}
+
+// UpdateCredentials replaces the credentials, keeping the rest of the config.
+func (a *TableAuthenticator) UpdateCredentials(credentials []*Credential) {
+	a.mu.Lock()
+	config := *a.config
+	config.Credentials = credentials
+	a.config = &config
 	a.mu.Unlock()
 }
 
+// UpdateSettings replaces the credentials, embargoes and task policies from settings, keeping
+// the current node table.
+func (a *TableAuthenticator) UpdateSettings(settings *TableAuthenticatorConfig) {
+	a.mu.Lock()
+	config := *settings
+	config.Nodes = a.config.Nodes
+	a.config = &config
+	a.mu.Unlock()
+}
+
+// Nodes returns a snapshot of the node table along with the time it was last updated.
+// The updated time is zero if the config has never been updated.
+func (a *TableAuthenticator) Nodes() ([]*TableAuthenticatorNode, time.Time) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	nodes := make([]*TableAuthenticatorNode, 0, len(a.config.Nodes))
+	for nodeID, node := range a.config.Nodes {
+		n := *node
+		n.NodeID = nodeID
+		nodes = append(nodes, &n)
+	}
+	return nodes, a.updated
+}
+
+// Node returns a copy of a single node table entry.
+func (a *TableAuthenticator) Node(nodeID string) (*TableAuthenticatorNode, time.Time, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	node, ok := a.config.Nodes[nodeID]
+	if !ok {
+		return nil, a.updated, false
+	}
+	n := *node
+	n.NodeID = nodeID
+	return &n, a.updated, true
+}
+
+// NodeAccess reports the embargo and task policies which apply to a node's files.
+func (a *TableAuthenticator) NodeAccess(nodeID string) NodeAccess {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	access := NodeAccess{Embargo: a.config.embargo(nodeID)}
+	for _, rule := range a.config.TaskPolicies {
+		if len(rule.Nodes) == 0 || containsString(rule.Nodes, nodeID) {
+			access.RestrictedTasks = true
+			break
+		}
+	}
+	return access
+}
+
 // Authorized returns whether or not the given user is authorized to access the given file.
 func (a *TableAuthenticator) Authorized(f *StorageFile, username, password string, hasAuth bool) bool {
 	// TODO(sean) this implementation only uses a single credential for everything,
@@ -62,12 +166,40 @@ func (a *TableAuthenticator) Authorized(f *StorageFile, username, password strin
 	return a.authenticated(username, password, hasAuth) || a.allowed(f)
 }
 
+// Authenticated returns whether the username and password match a valid credential.
+func (a *TableAuthenticator) Authenticated(username, password string) bool {
+	return a.authenticated(username, password, true)
+}
+
 func (a *TableAuthenticator) authenticated(username, password string, hasAuth bool) bool {
 	if !hasAuth {
 		return false
 	}
 
-	for _, credential := range a.config.Credentials {
+	a.mu.RLock()
+	credentials := a.config.Credentials
+	a.mu.RUnlock()
+
+	return matchCredentials(credentials, username, password)
+}
+
+// matchCredentials returns whether username and password match any unexpired credential.
+func matchCredentials(credentials []*Credential, username, password string) bool {
+	now := time.Now()
+
+	for _, credential := range credentials {
+		if credential.expired(now) {
+			continue
+		}
+
+		if credential.Hash != "" {
+			// hashes are intentionally slow to check, so only check the hash when the username matches.
+			if subtle.ConstantTimeCompare([]byte(username), []byte(credential.Username)) == 1 && verifyPasswordHash(credential.Hash, password) {
+				return true
+			}
+			continue
+		}
+
 		// security: use constant time compare of combined username and password to avoid leaking information.
 		x := subtle.ConstantTimeCompare([]byte(username), []byte(credential.Username))
 		y := subtle.ConstantTimeCompare([]byte(password), []byte(credential.Password))
@@ -89,27 +221,70 @@ func (m *TableAuthenticator) allowed(f *StorageFile) bool {
 	if !ok {
 		return false
 	}
-	return node.CommissionDate != nil && !f.Timestamp.Before(*node.CommissionDate) && node.Public
+	if !(node.CommissionDate != nil && !f.Timestamp.Before(*node.CommissionDate) && node.Public) {
+		return false
+	}
+	if taskRestricted(m.config.TaskPolicies, f) {
+		return false
+	}
+	if embargo := m.config.embargo(f.NodeID); embargo > 0 {
+		return !time.Now().Before(f.Timestamp.Add(embargo))
+	}
+	return true
+}
+
+// PublicAfter returns when an embargoed file will become public. It returns false if the file
+// is not under embargo, either because it is already public or because it will never be public.
+func (m *TableAuthenticator) PublicAfter(f *StorageFile) (time.Time, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.config == nil {
+		return time.Time{}, false
+	}
+	node, ok := m.config.Nodes[f.NodeID]
+	if !ok || !node.Public || node.CommissionDate == nil || f.Timestamp.Before(*node.CommissionDate) {
+		return time.Time{}, false
+	}
+	if taskRestricted(m.config.TaskPolicies, f) {
+		return time.Time{}, false
+	}
+	embargo := m.config.embargo(f.NodeID)
+	if embargo <= 0 {
+		return time.Time{}, false
+	}
+	t := f.Timestamp.Add(embargo)
+	if !time.Now().Before(t) {
+		return time.Time{}, false
+	}
+	return t, true
 }
 
 var nodeIDRE = regexp.MustCompile("^[a-f0-9]{16}$")
 
+// nodeTableClient fetches the node table. Its timeout keeps a hung request from stopping updates.
+var nodeTableClient = &http.Client{Timeout: 30 * time.Second}
+
 // GetNodeTableFromURL gets a new node auth list from the provided URL.
-func GetNodeTableFromURL(URL string) (map[string]*TableAuthenticatorNode, error) {
-	resp, err := http.Get(URL)
+func GetNodeTableFromURL(ctx context.Context, URL string) (map[string]*TableAuthenticatorNode, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get node table: %s", err.Error())
 	}
+	resp, err := nodeTableClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node table: %s", err.Error())
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to get node table: %s", http.StatusText(resp.StatusCode))
 	}
-	defer resp.Body.Close()
 	return readNodeTable(resp.Body)
 }
 
 func readNodeTable(r io.Reader) (map[string]*TableAuthenticatorNode, error) {
 	type responseItem struct {
 		NodeID         string `json:"node_id"`
+		Project        string `json:"project"`
 		FilesPublic    bool   `json:"files_public"`
 		CommissionDate string `json:"commission_date"`
 		RetireDate     string `json:"retire_date"`
@@ -131,8 +306,9 @@ func readNodeTable(r io.Reader) (map[string]*TableAuthenticatorNode, error) {
 		}
 
 		node := &TableAuthenticatorNode{
-			NodeID: item.NodeID,
-			Public: item.FilesPublic,
+			NodeID:  item.NodeID,
+			Project: item.Project,
+			Public:  item.FilesPublic,
 		}
 
 		if item.CommissionDate != "" {
@@ -144,7 +320,7 @@ func readNodeTable(r io.Reader) (map[string]*TableAuthenticatorNode, error) {
 		}
 
 		if item.RetireDate != "" {
-			if t, err := time.Parse("2006-01-02", item.CommissionDate); err == nil {
+			if t, err := time.Parse("2006-01-02", item.RetireDate); err == nil {
 				node.RetireDate = &t
 			} else {
 				log.Printf("retired date is invalid for node %s", item.NodeID)
@@ -157,6 +333,8 @@ func readNodeTable(r io.Reader) (map[string]*TableAuthenticatorNode, error) {
 	return nodes, nil
 }
 
+// ParseStaticCredentials parses a comma separated list of username:password pairs. The password
+// may also be a bcrypt hash.
 func ParseStaticCredentials(s string) ([]*Credential, error) {
 	credentials := []*Credential{}
 
@@ -169,6 +347,16 @@ func ParseStaticCredentials(s string) ([]*Credential, error) {
 		if !ok {
 			return nil, fmt.Errorf("failed to parse static credentials")
 		}
+		if isPasswordHash(password) {
+			if err := validatePasswordHash(password); err != nil {
+				return nil, fmt.Errorf("invalid static credentials hash for %s: %s", username, err)
+			}
+			credentials = append(credentials, &Credential{
+				Username: username,
+				Hash:     password,
+			})
+			continue
+		}
 		credentials = append(credentials, &Credential{
 			Username: username,
 			Password: password,
@@ -177,3 +365,43 @@ func ParseStaticCredentials(s string) ([]*Credential, error) {
 
 	return credentials, nil
 }
+
+// ParseEmbargoDuration parses a duration in Go duration format, additionally accepting a
+// whole number of days such as "30d".
+func ParseEmbargoDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid embargo duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid embargo duration %q", s)
+	}
+	return d, nil
+}
+
+// ParseNodeEmbargo parses a comma separated list of nodeID:duration pairs.
+func ParseNodeEmbargo(s string) (map[string]time.Duration, error) {
+	embargo := make(map[string]time.Duration)
+
+	if s == "" {
+		return embargo, nil
+	}
+
+	for _, s := range strings.Split(s, ",") {
+		nodeID, duration, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("failed to parse node embargo")
+		}
+		d, err := ParseEmbargoDuration(duration)
+		if err != nil {
+			return nil, err
+		}
+		embargo[strings.ToLower(nodeID)] = d
+	}
+
+	return embargo, nil
+}
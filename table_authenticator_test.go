@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"io"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -199,6 +204,143 @@ func TestAuthorizedFuzz(t *testing.T) {
 	}
 }
 
+func TestAuthorizedEmbargo(t *testing.T) {
+	commissionDate := time.Now().AddDate(-1, 0, 0)
+
+	auth := NewTableAuthenticator()
+	auth.UpdateConfig(&TableAuthenticatorConfig{
+		Credentials: []*Credential{
+			{
+				Username: "user",
+				Password: "secret",
+			},
+		},
+		Nodes: map[string]*TableAuthenticatorNode{
+			"globalEmbargo": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+			"nodeEmbargo": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+			"noEmbargo": {
+				Public:         true,
+				CommissionDate: &commissionDate,
+			},
+			"privateNode": {
+				Public:         false,
+				CommissionDate: &commissionDate,
+			},
+		},
+		Embargo: 30 * 24 * time.Hour,
+		NodeEmbargo: map[string]time.Duration{
+			"nodeEmbargo": 7 * 24 * time.Hour,
+			"noEmbargo":   0,
+		},
+	})
+
+	var testcases = map[string]struct {
+		File        *StorageFile
+		Public      bool
+		PublicAfter bool
+	}{
+		"globalEmbargoed": {
+			File:        &StorageFile{NodeID: "globalEmbargo", Timestamp: time.Now().AddDate(0, 0, -29)},
+			Public:      false,
+			PublicAfter: true,
+		},
+		"globalReleased": {
+			File:   &StorageFile{NodeID: "globalEmbargo", Timestamp: time.Now().AddDate(0, 0, -31)},
+			Public: true,
+		},
+		"nodeEmbargoed": {
+			File:        &StorageFile{NodeID: "nodeEmbargo", Timestamp: time.Now().AddDate(0, 0, -6)},
+			Public:      false,
+			PublicAfter: true,
+		},
+		"nodeReleased": {
+			File:   &StorageFile{NodeID: "nodeEmbargo", Timestamp: time.Now().AddDate(0, 0, -8)},
+			Public: true,
+		},
+		"noEmbargo": {
+			File:   &StorageFile{NodeID: "noEmbargo", Timestamp: time.Now()},
+			Public: true,
+		},
+		"privateNode": {
+			File:   &StorageFile{NodeID: "privateNode", Timestamp: time.Now()},
+			Public: false,
+		},
+		"beforeCommission": {
+			File:   &StorageFile{NodeID: "globalEmbargo", Timestamp: commissionDate.AddDate(0, 0, -1)},
+			Public: false,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			if tc.Public {
+				assertPublic(t, auth, tc.File)
+			} else {
+				assertPrivate(t, auth, tc.File)
+			}
+			after, ok := auth.PublicAfter(tc.File)
+			if ok != tc.PublicAfter {
+				t.Fatalf("incorrect public after. got: %v want: %v", ok, tc.PublicAfter)
+			}
+			if ok && !after.After(time.Now()) {
+				t.Fatalf("public after must be in the future. got: %s", after)
+			}
+		})
+	}
+}
+
+func TestParseEmbargoDuration(t *testing.T) {
+	testcases := map[string]struct {
+		Input       string
+		ExpectError bool
+		Expect      time.Duration
+	}{
+		"days":     {"30d", false, 30 * 24 * time.Hour},
+		"hours":    {"36h", false, 36 * time.Hour},
+		"zero":     {"0s", false, 0},
+		"negative": {"-1h", true, 0},
+		"badDays":  {"xd", true, 0},
+		"invalid":  {"month", true, 0},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			d, err := ParseEmbargoDuration(tc.Input)
+			if tc.ExpectError && err == nil {
+				t.Fatalf("expecting error but got none")
+			}
+			if !tc.ExpectError && err != nil {
+				t.Fatalf("not expecting error but got %s", err)
+			}
+			if d != tc.Expect {
+				t.Fatalf("incorrect duration. got: %s want: %s", d, tc.Expect)
+			}
+		})
+	}
+}
+
+func TestParseNodeEmbargo(t *testing.T) {
+	embargo, err := ParseNodeEmbargo("000048B02D15BC7C:7d,000048b02d05a0a4:0s")
+	if err != nil {
+		t.Fatalf("not expecting error but got %s", err)
+	}
+	if embargo["000048b02d15bc7c"] != 7*24*time.Hour {
+		t.Fatalf("incorrect embargo for 000048b02d15bc7c. got: %s", embargo["000048b02d15bc7c"])
+	}
+	if d, ok := embargo["000048b02d05a0a4"]; !ok || d != 0 {
+		t.Fatalf("expected zero embargo override for 000048b02d05a0a4")
+	}
+	if _, err := ParseNodeEmbargo("000048b02d15bc7c"); err == nil {
+		t.Fatalf("expecting error for missing duration")
+	}
+}
+
 func TestParseStaticCredentials(t *testing.T) {
 	testcases := map[string]struct {
 		Input             string
@@ -312,3 +454,77 @@ func randomNodeList(n int) map[string]*TableAuthenticatorNode {
 	}
 	return nodes
 }
+
+func TestGetNodeTableFromURL(t *testing.T) {
+	status := http.StatusOK
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-release
+			return
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, `[{"node_id": "000048B02D15BC7C", "files_public": true}]`)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	nodes, err := GetNodeTableFromURL(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node := nodes["000048b02d15bc7c"]; node == nil || !node.Public {
+		t.Fatalf("incorrect node table: %v", nodes)
+	}
+
+	status = http.StatusServiceUnavailable
+	if _, err := GetNodeTableFromURL(context.Background(), server.URL); err == nil {
+		t.Fatalf("expected error for unavailable node table")
+	}
+
+	// requests stop when the context is done, so updates can be stopped cleanly.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := GetNodeTableFromURL(ctx, server.URL+"/hang"); err == nil {
+		t.Fatalf("expected error for canceled request")
+	}
+}
+
+func TestReadNodeTableDates(t *testing.T) {
+	nodes, err := readNodeTable(strings.NewReader(`[
+  {"node_id": "0000000000000001", "commission_date": "2021-06-01", "retire_date": "2023-02-15"},
+  {"node_id": "0000000000000002", "commission_date": "2021-06-01"},
+  {"node_id": "0000000000000003", "commission_date": "2021-06-01", "retire_date": "not a date"}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commissionDate := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	retireDate := time.Date(2023, 2, 15, 0, 0, 0, 0, time.UTC)
+
+	testcases := map[string]struct {
+		NodeID     string
+		RetireDate *time.Time
+	}{
+		"Retired":     {"0000000000000001", &retireDate},
+		"NotRetired":  {"0000000000000002", nil},
+		"InvalidDate": {"0000000000000003", nil},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			node := nodes[tc.NodeID]
+			if node == nil {
+				t.Fatalf("expected node %s", tc.NodeID)
+			}
+			// the retire date must not change the commission date.
+			if node.CommissionDate == nil || !node.CommissionDate.Equal(commissionDate) {
+				t.Fatalf("incorrect commission date. got: %v want: %s", node.CommissionDate, commissionDate)
+			}
+			if (node.RetireDate == nil) != (tc.RetireDate == nil) || (tc.RetireDate != nil && !node.RetireDate.Equal(*tc.RetireDate)) {
+				t.Fatalf("incorrect retire date. got: %v want: %v", node.RetireDate, tc.RetireDate)
+			}
+		})
+	}
+}
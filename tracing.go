@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is used for all spans. It uses the global tracer provider, so spans are no-ops until
+// tracing is set up.
+var tracer = otel.Tracer("github.com/sagecontinuum/sage-object-store")
+
+// NewTracerProvider creates a tracer provider which exports spans using exporter, which is
+// either "otlp" or "stdout". The OTLP exporter is configured using the standard
+// OTEL_EXPORTER_OTLP_* env vars. Spans written by the stdout exporter go to out.
+func NewTracerProvider(ctx context.Context, exporter string, out io.Writer) (*sdktrace.TracerProvider, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+
+	switch exporter {
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("sage-object-store"),
+		semconv.ServiceVersion(ReleaseVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// setupTracing installs provider as the global tracer provider and propagates W3C trace
+// context and baggage.
+func setupTracing(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// TracingHandler starts a server span for each request, continuing any trace from the
+// incoming traceparent header.
+type TracingHandler struct {
+	Handler http.Handler
+}
+
+func (h *TracingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPTarget(r.URL.Path),
+			attribute.String("http.request_id", requestID(r.Context())),
+		),
+	)
+	defer span.End()
+
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	h.Handler.ServeHTTP(lw, r.WithContext(ctx))
+
+	span.SetAttributes(semconv.HTTPStatusCode(lw.status))
+	if lw.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(lw.status))
+	}
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// fileAttributes returns the span attributes identifying f.
+func fileAttributes(f *StorageFile) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("sage.job_id", f.JobID),
+		attribute.String("sage.task_id", f.TaskID),
+		attribute.String("sage.node_id", f.NodeID),
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// testCollector is an in-process stand-in for an OTLP/HTTP collector.
+type testCollector struct {
+	spans []*tracepb.Span
+	mu    sync.Mutex
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.mu.Unlock()
+
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func (c *testCollector) span(name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracingOTLP(t *testing.T) {
+	collector := &testCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL)
+
+	provider, err := NewTracerProvider(context.Background(), "otlp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupTracing(provider)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	defer provider.Shutdown(context.Background())
+
+	handler := &TracingHandler{
+		Handler: http.StripPrefix("/", &StorageHandler{
+			Storage: &mockStorage{
+				files: map[string][]byte{
+					"node-data/sage/imagesampler-top/000048b02d05a0a4/1638576647406523064-sample.jpg": randomContent(),
+				},
+			},
+			RootFolder:    "node-data",
+			Authenticator: &mockAuthenticator{authorized: true},
+		}),
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	r := httptest.NewRequest("GET", "/sage/imagesampler-top/000048b02d05a0a4/1638576647406523064-sample.jpg", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusTemporaryRedirect)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatalf("failed to flush spans: %s", err)
+	}
+
+	serverSpan := collector.span("HTTP GET")
+	if serverSpan == nil {
+		t.Fatalf("expected server span to be exported")
+	}
+	if got := traceIDHex(serverSpan.TraceId); got != traceID {
+		t.Fatalf("expected server span to continue incoming trace. got: %s want: %s", got, traceID)
+	}
+
+	authSpan := collector.span("StorageHandler.handleAuth")
+	if authSpan == nil {
+		t.Fatalf("expected auth span to be exported")
+	}
+	if !bytes.Equal(authSpan.ParentSpanId, serverSpan.SpanId) {
+		t.Fatalf("expected auth span to be a child of the server span")
+	}
+}
+
+func TestTracingStdout(t *testing.T) {
+	var buf bytes.Buffer
+
+	provider, err := NewTracerProvider(context.Background(), "stdout", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := provider.Tracer("test").Start(context.Background(), "test-span")
+	span.End()
+
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "test-span") {
+		t.Fatalf("expected span to be written to stdout exporter. got: %s", buf.String())
+	}
+}
+
+func TestTracingUnknownExporter(t *testing.T) {
+	if _, err := NewTracerProvider(context.Background(), "zipkin", nil); err == nil {
+		t.Fatalf("expected error for unknown exporter")
+	}
+}
+
+func traceIDHex(b []byte) string {
+	var id trace.TraceID
+	copy(id[:], b)
+	return id.String()
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Usage is the amount downloaded by a principal in a period.
+type Usage struct {
+	Bytes     int64 `json:"bytes"`
+	Downloads int64 `json:"downloads"`
+}
+
+// Quota limits the bytes a principal can download per UTC day and month. Zero is unlimited.
+type Quota struct {
+	DailyBytes   int64 `json:"daily_bytes,omitempty"`
+	MonthlyBytes int64 `json:"monthly_bytes,omitempty"`
+}
+
+// QuotaPolicy is the default quota and per principal overrides.
+type QuotaPolicy struct {
+	Default    Quota
+	Principals map[string]Quota
+}
+
+// For returns the quota for principal.
+func (p *QuotaPolicy) For(principal string) Quota {
+	if quota, ok := p.Principals[principal]; ok {
+		return quota
+	}
+	return p.Default
+}
+
+// QuotaResult is the outcome of reserving a download against a quota.
+type QuotaResult struct {
+	Allowed bool
+	// Period is "day" or "month" when the download is not allowed.
+	Period string
+	// TooLarge is set if the download is larger than the whole quota, so it can never be allowed.
+	TooLarge bool
+	// ResetAt is when the exceeded period ends.
+	ResetAt time.Time
+}
+
+// PrincipalUsage is a principal's usage in the current day and month.
+type PrincipalUsage struct {
+	Principal string `json:"principal"`
+	Day       Usage  `json:"day"`
+	Month     Usage  `json:"month"`
+	Quota     Quota  `json:"quota"`
+}
+
+// UsageLedger records the bytes downloaded by each principal in a local bbolt database and
+// enforces their quotas.
+type UsageLedger struct {
+	// DayRetention is how long daily usage is kept. Monthly usage is kept forever.
+	DayRetention time.Duration
+
+	db     *bolt.DB
+	policy QuotaPolicy
+	mu     sync.RWMutex
+}
+
+var usageBucket = []byte("usage")
+
+// OpenUsageLedger opens or creates the ledger database at path.
+func OpenUsageLedger(path string, policy QuotaPolicy) (*UsageLedger, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &UsageLedger{
+		DayRetention: 90 * 24 * time.Hour,
+		db:           db,
+		policy:       policy,
+	}, nil
+}
+
+// Close closes the database.
+func (l *UsageLedger) Close() error {
+	return l.db.Close()
+}
+
+// SetQuotas replaces the quota policy. It can be called while serving requests.
+func (l *UsageLedger) SetQuotas(policy QuotaPolicy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policy = policy
+}
+
+// Quota returns the quota for principal.
+func (l *UsageLedger) Quota(principal string) Quota {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.policy.For(principal)
+}
+
+// Reserve records a download of size bytes by principal if it fits in the principal's quota.
+// The check and update happen in one transaction, so concurrent downloads can't overrun it.
+func (l *UsageLedger) Reserve(principal string, size int64, now time.Time) (QuotaResult, error) {
+	quota := l.Quota(principal)
+	now = now.UTC()
+	day, month := dayPeriod(now), monthPeriod(now)
+
+	var result QuotaResult
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(usageBucket)
+
+		dayUsage, err := getUsage(root, day, principal)
+		if err != nil {
+			return err
+		}
+		monthUsage, err := getUsage(root, month, principal)
+		if err != nil {
+			return err
+		}
+
+		checks := []struct {
+			period string
+			limit  int64
+			used   int64
+			reset  time.Time
+		}{
+			{"day", quota.DailyBytes, dayUsage.Bytes, time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)},
+			{"month", quota.MonthlyBytes, monthUsage.Bytes, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)},
+		}
+		for _, c := range checks {
+			if c.limit <= 0 || c.used+size <= c.limit {
+				continue
+			}
+			result = QuotaResult{
+				Period:   c.period,
+				TooLarge: size > c.limit,
+				ResetAt:  c.reset,
+			}
+			return nil
+		}
+
+		if root.Bucket([]byte(day)) == nil {
+			if err := l.prune(root, now); err != nil {
+				return err
+			}
+		}
+
+		dayUsage.Bytes += size
+		dayUsage.Downloads++
+		monthUsage.Bytes += size
+		monthUsage.Downloads++
+		if err := putUsage(root, day, principal, dayUsage); err != nil {
+			return err
+		}
+		if err := putUsage(root, month, principal, monthUsage); err != nil {
+			return err
+		}
+		result.Allowed = true
+		return nil
+	})
+
+	return result, err
+}
+
+// Usage returns the usage of every principal with downloads in the current day or month, sorted
+// by principal.
+func (l *UsageLedger) Usage(now time.Time) ([]*PrincipalUsage, error) {
+	now = now.UTC()
+	usage := make(map[string]*PrincipalUsage)
+
+	get := func(principal string) *PrincipalUsage {
+		if u, ok := usage[principal]; ok {
+			return u
+		}
+		u := &PrincipalUsage{Principal: principal, Quota: l.Quota(principal)}
+		usage[principal] = u
+		return u
+	}
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(usageBucket)
+		periods := []struct {
+			name string
+			set  func(u *PrincipalUsage, usage Usage)
+		}{
+			{dayPeriod(now), func(u *PrincipalUsage, usage Usage) { u.Day = usage }},
+			{monthPeriod(now), func(u *PrincipalUsage, usage Usage) { u.Month = usage }},
+		}
+		for _, period := range periods {
+			b := root.Bucket([]byte(period.name))
+			if b == nil {
+				continue
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				var u Usage
+				if err := json.Unmarshal(v, &u); err != nil {
+					return err
+				}
+				period.set(get(string(k)), u)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*PrincipalUsage, 0, len(usage))
+	for _, u := range usage {
+		items = append(items, u)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Principal < items[j].Principal
+	})
+	return items, nil
+}
+
+// PrincipalUsage returns the usage of principal in the current day and month.
+func (l *UsageLedger) PrincipalUsage(principal string, now time.Time) (*PrincipalUsage, error) {
+	now = now.UTC()
+	u := &PrincipalUsage{Principal: principal, Quota: l.Quota(principal)}
+	err := l.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(usageBucket)
+		var err error
+		if u.Day, err = getUsage(root, dayPeriod(now), principal); err != nil {
+			return err
+		}
+		u.Month, err = getUsage(root, monthPeriod(now), principal)
+		return err
+	})
+	return u, err
+}
+
+// prune deletes daily usage older than DayRetention. It is called once per day, when the day's
+// bucket is created.
+func (l *UsageLedger) prune(root *bolt.Bucket, now time.Time) error {
+	cutoff := dayPeriod(now.Add(-l.DayRetention))
+	var old [][]byte
+	err := root.ForEach(func(k, v []byte) error {
+		if strings.HasPrefix(string(k), "day/") && string(k) < cutoff {
+			old = append(old, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range old {
+		if err := root.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dayPeriod(t time.Time) string {
+	return "day/" + t.Format("2006-01-02")
+}
+
+func monthPeriod(t time.Time) string {
+	return "month/" + t.Format("2006-01")
+}
+
+func getUsage(root *bolt.Bucket, period, principal string) (Usage, error) {
+	var u Usage
+	b := root.Bucket([]byte(period))
+	if b == nil {
+		return u, nil
+	}
+	v := b.Get([]byte(principal))
+	if v == nil {
+		return u, nil
+	}
+	err := json.Unmarshal(v, &u)
+	return u, err
+}
+
+func putUsage(root *bolt.Bucket, period, principal string, u Usage) error {
+	b, err := root.CreateBucketIfNotExists([]byte(period))
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(&u)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(principal), v)
+}
+
+// ParseQuotas parses a comma separated list of principal=daily/monthly quotas, for example
+// partner=10GiB/100GiB,node:000048b02d15bc7c=0/0. Zero is unlimited.
+func ParseQuotas(s string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	for _, item := range splitList(s) {
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("quota must have format principal=daily/monthly")
+		}
+		principal := item[:i]
+		daily, monthly, ok := strings.Cut(item[i+1:], "/")
+		if !ok {
+			return nil, fmt.Errorf("quota must have format principal=daily/monthly")
+		}
+		var quota Quota
+		var err error
+		if quota.DailyBytes, err = ParseByteSize(daily); err != nil {
+			return nil, fmt.Errorf("invalid daily quota for %s: %s", principal, err.Error())
+		}
+		if quota.MonthlyBytes, err = ParseByteSize(monthly); err != nil {
+			return nil, fmt.Errorf("invalid monthly quota for %s: %s", principal, err.Error())
+		}
+		quotas[principal] = quota
+	}
+	return quotas, nil
+}
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseByteSize parses a number of bytes with an optional unit, such as 500MB or 10GiB. An empty
+// string is zero.
+func ParseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	// the comparison is false for NaN, and also rejects Inf and sizes which overflow an int64.
+	if err != nil || !(n >= 0 && n*float64(unit) < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// UsageHandler serves the admin API reporting download usage. Requests are expected to have the
+// /api/v1/admin/usage prefix stripped, so the path is either empty or a principal.
+type UsageHandler struct {
+	Usage            *UsageLedger
+	AdminCredentials []*Credential
+	// LoginLimiter is optional and locks out clients after repeated failed logins.
+	LoginLimiter *LoginLimiter
+	Logger       *log.Logger
+}
+
+func (h *UsageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := checkBasicAuth(w, r, h.LoginLimiter, func(username, password string) bool {
+		return matchCredentials(h.AdminCredentials, username, password)
+	}); !ok {
+		h.log("%s %s -> %s: admin not authorized", r.Method, r.URL, r.RemoteAddr)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondJSONError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	principal := strings.Trim(r.URL.Path, "/")
+
+	if principal == "" {
+		h.handleList(w, r)
+	} else {
+		h.handlePrincipal(w, r, principal)
+	}
+}
+
+func (h *UsageHandler) handleList(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Principals []*PrincipalUsage `json:"principals"`
+	}
+
+	usage, err := h.Usage.Usage(time.Now())
+	if err != nil {
+		h.log("%s %s -> %s: failed to read usage: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "failed to read usage")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, &response{
+		Principals: usage,
+	})
+}
+
+func (h *UsageHandler) handlePrincipal(w http.ResponseWriter, r *http.Request, principal string) {
+	usage, err := h.Usage.PrincipalUsage(principal, time.Now())
+	if err != nil {
+		h.log("%s %s -> %s: failed to read usage: %s", r.Method, r.URL, r.RemoteAddr, err.Error())
+		respondJSONError(w, http.StatusInternalServerError, "failed to read usage")
+		return
+	}
+	respondJSON(w, http.StatusOK, usage)
+}
+
+func (h *UsageHandler) log(format string, v ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Printf(format, v...)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsageHandler(t *testing.T) {
+	ledger := newTestUsageLedger(t, QuotaPolicy{
+		Principals: map[string]Quota{"partner": {DailyBytes: 1000}},
+	})
+	ledger.Reserve("partner", 100, time.Now())
+	ledger.Reserve("partner", 200, time.Now())
+	ledger.Reserve("node:000048b02d15bc7c", 50, time.Now())
+
+	handler := &UsageHandler{
+		Usage:            ledger,
+		AdminCredentials: []*Credential{{Username: "admin", Password: "secret"}},
+	}
+
+	do := func(method, url, username, password string) *http.Response {
+		r := httptest.NewRequest(method, "/"+url, nil)
+		if username != "" {
+			r.SetBasicAuth(username, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assertStatusCode(t, do(http.MethodGet, "", "", ""), http.StatusUnauthorized)
+	assertStatusCode(t, do(http.MethodGet, "", "partner", "secret"), http.StatusUnauthorized)
+	assertStatusCode(t, do(http.MethodPost, "", "admin", "secret"), http.StatusMethodNotAllowed)
+
+	resp := do(http.MethodGet, "", "admin", "secret")
+	assertStatusCode(t, resp, http.StatusOK)
+
+	var list struct {
+		Principals []*PrincipalUsage `json:"principals"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Principals) != 2 || list.Principals[0].Principal != "node:000048b02d15bc7c" || list.Principals[1].Principal != "partner" {
+		t.Fatalf("incorrect principals: %+v", list.Principals)
+	}
+	partner := list.Principals[1]
+	if partner.Day != (Usage{Bytes: 300, Downloads: 2}) || partner.Quota.DailyBytes != 1000 {
+		t.Fatalf("incorrect partner usage: %+v", partner)
+	}
+
+	resp = do(http.MethodGet, "partner", "admin", "secret")
+	assertStatusCode(t, resp, http.StatusOK)
+
+	var usage PrincipalUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Principal != "partner" || usage.Month != (Usage{Bytes: 300, Downloads: 2}) {
+		t.Fatalf("incorrect usage: %+v", usage)
+	}
+
+	// failed logins count towards the lockout.
+	handler.LoginLimiter = NewLoginLimiter()
+	for i := 0; i < handler.LoginLimiter.Threshold; i++ {
+		assertStatusCode(t, do(http.MethodGet, "", "admin", "wrong"), http.StatusUnauthorized)
+	}
+	assertStatusCode(t, do(http.MethodGet, "", "admin", "secret"), http.StatusTooManyRequests)
+}
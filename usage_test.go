@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestUsageLedger(t *testing.T, policy QuotaPolicy) *UsageLedger {
+	ledger, err := OpenUsageLedger(filepath.Join(t.TempDir(), "usage.db"), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	return ledger
+}
+
+func TestUsageLedgerReserve(t *testing.T) {
+	ledger := newTestUsageLedger(t, QuotaPolicy{
+		Default: Quota{DailyBytes: 100, MonthlyBytes: 250},
+		Principals: map[string]Quota{
+			"unlimited": {},
+		},
+	})
+
+	now := time.Date(2023, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	reserve := func(principal string, size int64, now time.Time) QuotaResult {
+		result, err := ledger.Reserve(principal, size, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if !reserve("user", 60, now).Allowed || !reserve("user", 40, now).Allowed {
+		t.Fatalf("expected downloads within daily quota to be allowed")
+	}
+
+	result := reserve("user", 1, now)
+	if result.Allowed || result.Period != "day" || result.TooLarge || !result.ResetAt.Equal(time.Date(2023, 6, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected daily quota to be exceeded until midnight. got: %+v", result)
+	}
+
+	// rejected downloads are not counted.
+	usage, err := ledger.PrincipalUsage("user", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Day != (Usage{Bytes: 100, Downloads: 2}) || usage.Month != (Usage{Bytes: 100, Downloads: 2}) {
+		t.Fatalf("incorrect usage: %+v", usage)
+	}
+
+	// the daily quota resets the next day, but the monthly quota does not.
+	tomorrow := now.AddDate(0, 0, 1)
+	if !reserve("user", 100, tomorrow).Allowed {
+		t.Fatalf("expected daily quota to reset")
+	}
+	dayAfter := now.AddDate(0, 0, 2)
+	result = reserve("user", 100, dayAfter)
+	if result.Allowed || result.Period != "month" || !result.ResetAt.Equal(time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected monthly quota to be exceeded until next month. got: %+v", result)
+	}
+
+	result = reserve("other", 101, now)
+	if result.Allowed || !result.TooLarge {
+		t.Fatalf("expected download larger than quota to be too large. got: %+v", result)
+	}
+
+	if !reserve("unlimited", 1000, now).Allowed {
+		t.Fatalf("expected principal with zero quota to be unlimited")
+	}
+
+	ledger.SetQuotas(QuotaPolicy{})
+	if !reserve("user", 100, dayAfter).Allowed {
+		t.Fatalf("expected updated quotas to apply")
+	}
+}
+
+func TestUsageLedgerPrunesOldDays(t *testing.T) {
+	ledger := newTestUsageLedger(t, QuotaPolicy{})
+	ledger.DayRetention = 48 * time.Hour
+
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if _, err := ledger.Reserve("user", 10, start.AddDate(0, 0, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := ledger.PrincipalUsage("user", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Day != (Usage{}) {
+		t.Fatalf("expected old daily usage to be pruned. got: %+v", usage.Day)
+	}
+	if usage.Month != (Usage{Bytes: 50, Downloads: 5}) {
+		t.Fatalf("expected monthly usage to be kept. got: %+v", usage.Month)
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := ParseQuotas("partner=10GiB/100GiB, node:000048b02d15bc7c=0/0, small=500MB/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotas["partner"] != (Quota{DailyBytes: 10 << 30, MonthlyBytes: 100 << 30}) ||
+		quotas["node:000048b02d15bc7c"] != (Quota{}) ||
+		quotas["small"] != (Quota{DailyBytes: 500e6}) {
+		t.Fatalf("incorrect quotas: %+v", quotas)
+	}
+
+	for _, s := range []string{"partner", "partner=10GiB", "=1/1", "partner=lots/1", "partner=-1/1"} {
+		if _, err := ParseQuotas(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	testcases := map[string]struct {
+		Size  int64
+		Valid bool
+	}{
+		"":           {0, true},
+		"100":        {100, true},
+		"1.5KB":      {1500, true},
+		"10GiB":      {10 << 30, true},
+		"-1MB":       {0, false},
+		"Inf":        {0, false},
+		"+InfB":      {0, false},
+		"NaN":        {0, false},
+		"NaNGB":      {0, false},
+		"1e30":       {0, false},
+		"10000000TB": {0, false},
+	}
+
+	for s, tc := range testcases {
+		t.Run(s, func(t *testing.T) {
+			n, err := ParseByteSize(s)
+			if (err == nil) != tc.Valid {
+				t.Fatalf("incorrect error for %q: %v", s, err)
+			}
+			if n != tc.Size {
+				t.Fatalf("incorrect size for %q. got: %d want: %d", s, n, tc.Size)
+			}
+		})
+	}
+}
+
+func TestHandlerQuota(t *testing.T) {
+	url := "job/task/node/1643842551600000000-sample.jpg"
+	content := randomContent()
+
+	ledger := newTestUsageLedger(t, QuotaPolicy{
+		Default: Quota{DailyBytes: int64(len(content))},
+	})
+	signer := newTestShareSigner()
+	// the access logger records the principal found by auth.
+	handler := &AccessLogger{
+		Handler: &StorageHandler{
+			Storage:       &mockStorage{files: map[string][]byte{url: content}},
+			Authenticator: &mockAuthenticator{true},
+			Usage:         ledger,
+			ShareSigner:   signer,
+		},
+	}
+
+	do := func(principal string) *http.Response {
+		r, _ := http.NewRequest(http.MethodGet, url, nil)
+		if principal != "" {
+			r.SetBasicAuth(principal, "secret")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	assertStatusCode(t, do("user"), http.StatusTemporaryRedirect)
+
+	resp := do("user")
+	assertStatusCode(t, resp, http.StatusTooManyRequests)
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+
+	// downloads through share links are charged to the user who created them.
+	token, _, err := signer.Sign(&ShareClaims{Path: url, Subject: "user"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest(http.MethodGet, url+"?token="+token, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusTooManyRequests)
+
+	// anonymous downloads are not accounted.
+	assertStatusCode(t, do(""), http.StatusTemporaryRedirect)
+	assertStatusCode(t, do(""), http.StatusTemporaryRedirect)
+
+	usage, err := ledger.Usage(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].Principal != "user" || usage[0].Day != (Usage{Bytes: int64(len(content)), Downloads: 1}) {
+		t.Fatalf("incorrect usage: %+v", usage)
+	}
+
+	ledger.SetQuotas(QuotaPolicy{Default: Quota{MonthlyBytes: 1}})
+	assertStatusCode(t, do("other"), http.StatusForbidden)
+}
+
+func TestHandlerQuotaUnverifiedUsername(t *testing.T) {
+	url := fmt.Sprintf("job/task/0000000000000001/%d-sample.jpg", time.Now().UnixNano())
+	content := randomContent()
+
+	auth := newTestNodesAuthenticator()
+	auth.UpdateSettings(&TableAuthenticatorConfig{
+		Credentials: []*Credential{{Username: "user", Password: "secret"}},
+	})
+
+	ledger := newTestUsageLedger(t, QuotaPolicy{
+		Default: Quota{DailyBytes: int64(len(content))},
+	})
+	handler := &AccessLogger{
+		Handler: &StorageHandler{
+			Storage:       &mockStorage{files: map[string][]byte{url: content}},
+			Authenticator: auth,
+			Usage:         ledger,
+		},
+	}
+
+	do := func(password string) *http.Response {
+		r, _ := http.NewRequest(http.MethodGet, url, nil)
+		r.SetBasicAuth("user", password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// public files can be downloaded with a wrong password, but not at the user's expense.
+	for i := 0; i < 3; i++ {
+		assertStatusCode(t, do("wrong"), http.StatusTemporaryRedirect)
+	}
+	usage, err := ledger.Usage(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 0 {
+		t.Fatalf("expected no usage for unverified username. got: %+v", usage)
+	}
+
+	assertStatusCode(t, do("secret"), http.StatusTemporaryRedirect)
+}